@@ -0,0 +1,13 @@
+package main
+
+import "strings"
+
+// Usernames are kept as typed apart from surrounding spaces; the stores
+// compare them case-insensitively
+func normalizeUsername(username string) string {
+	return strings.TrimSpace(username)
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+
+	"m/v2/storage"
+)
+
+// Register concurrently, returning how many signups succeeded and how many
+// were refused as conflicts
+func registerConcurrently(t *testing.T, app *fiber.App, requests []RegisterRequest) (created, conflicts int) {
+	var wg sync.WaitGroup
+	statuses := make([]int, len(requests))
+	for i, request := range requests {
+		wg.Add(1)
+		go func(i int, request RegisterRequest) {
+			defer wg.Done()
+			status, data := call(t, app, http.MethodPost, "/api/v1/accounts", "", request)
+			if status == http.StatusConflict {
+				var response ErrorResponse
+				decode(t, data, &response)
+				if response.Code != CodeConflict {
+					t.Errorf("conflict with code %q", response.Code)
+				}
+			}
+			statuses[i] = status
+		}(i, request)
+	}
+	wg.Wait()
+
+	for _, status := range statuses {
+		switch status {
+		case http.StatusOK:
+			created++
+		case http.StatusConflict:
+			conflicts++
+		default:
+			t.Errorf("signup answered %d", status)
+		}
+	}
+	return created, conflicts
+}
+
+func TestConcurrentSignupsConflict(t *testing.T) {
+	servers := map[string]func(t *testing.T) (*Repository, *fiber.App){
+		"memory": newTestServer,
+		"sqlite": func(t *testing.T) (*Repository, *fiber.App) { return newSQLiteTestServer(t) },
+	}
+	for name, newServer := range servers {
+		t.Run(name, func(t *testing.T) {
+			_, app := newServer(t)
+
+			// The same username in other cases, with different emails
+			var requests []RegisterRequest
+			for i, username := range []string{"dana", "Dana", "DANA", "daNa", "DanA", "dAnA"} {
+				email := "dana" + string(rune('a'+i)) + "@example.com"
+				requests = append(requests, RegisterRequest{Username: username, Email: email, Password: testPassword, Confirm_Password: testPassword})
+			}
+			if created, conflicts := registerConcurrently(t, app, requests); created != 1 || conflicts != len(requests)-1 {
+				t.Errorf("same username: %d created, %d conflicts", created, conflicts)
+			}
+
+			// The same email, differently spelled, under different usernames
+			requests = nil
+			for i, email := range []string{"eve@example.com", "EVE@example.com", " eve@Example.com", "Eve@EXAMPLE.COM "} {
+				username := "eve" + string(rune('a'+i))
+				requests = append(requests, RegisterRequest{Username: username, Email: email, Password: testPassword, Confirm_Password: testPassword})
+			}
+			if created, conflicts := registerConcurrently(t, app, requests); created != 1 || conflicts != len(requests)-1 {
+				t.Errorf("same email: %d created, %d conflicts", created, conflicts)
+			}
+		})
+	}
+}
+
+func TestMigrationDedupesAccounts(t *testing.T) {
+	// An account table from before the unique indexes, holding usernames and
+	// emails that only differ in case and spaces
+	r, app := newSQLiteTestServer(t,
+		`CREATE TABLE account (
+			id       INTEGER PRIMARY KEY AUTOINCREMENT,
+			fullname TEXT NOT NULL DEFAULT '',
+			email    TEXT NOT NULL DEFAULT '',
+			username TEXT NOT NULL,
+			password TEXT NOT NULL DEFAULT '',
+			role     TEXT NOT NULL DEFAULT 'user'
+		)`,
+		`INSERT INTO account (id, username, email) VALUES
+			(1, 'bob', 'bob@example.com'),
+			(2, ' Bob', 'BOB@example.com '),
+			(3, 'BOB ', 'other@example.com'),
+			(4, 'carl', ' bob@example.com')`,
+	)
+	ctx := context.Background()
+
+	// The oldest account keeps the username and email; the others are marked
+	want := map[uint][2]string{
+		1: {"bob", "bob@example.com"},
+		2: {"Bob#dup2", "BOB@example.com#dup2"},
+		3: {"BOB#dup3", "other@example.com"},
+		4: {"carl", "bob@example.com#dup4"},
+	}
+	for id, fields := range want {
+		account, err := r.Stores.Accounts.Get(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if account.Username != fields[0] || account.Email != fields[1] {
+			t.Errorf("account %d is %q %q, want %q %q", id, account.Username, account.Email, fields[0], fields[1])
+		}
+	}
+	if account, err := r.Stores.Accounts.FindByLogin(ctx, " BOB@Example.com"); err != nil || account.ID != 1 {
+		t.Errorf("login bob@example.com finds %d (%v), want 1", account.ID, err)
+	}
+
+	// The indexes now refuse new duplicates
+	for _, request := range []RegisterRequest{
+		{Username: "BOB", Email: "new@example.com"},
+		{Username: "newbie", Email: "Bob@Example.com"},
+	} {
+		request.Password, request.Confirm_Password = testPassword, testPassword
+		if status, data := call(t, app, http.MethodPost, "/api/v1/accounts", "", request); status != http.StatusConflict {
+			t.Errorf("signing up as %s <%s>: %d %s", request.Username, request.Email, status, data)
+		}
+	}
+	err := r.Stores.Accounts.Create(ctx, &storage.Account{Username: " bob ", Email: "spaces@example.com"})
+	if err != storage.ErrConflict {
+		t.Errorf("storing %q: %v, want a conflict", " bob ", err)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Operational views for admins under /api/v1/admin
+
+// Struct SlowQueriesRequest
+type SlowQueriesRequest struct {
+	Limit int `query:"limit" validate:"min=1,max=100"`
+}
+
+// Struct SlowQueryResponse: one statement shape and its slow runs
+type SlowQueryResponse struct {
+	Fingerprint string    `json:"fingerprint"`
+	Table       string    `json:"table"`
+	Count       int       `json:"count"`
+	TotalMs     float64   `json:"total_ms"`
+	MeanMs      float64   `json:"mean_ms"`
+	MaxMs       float64   `json:"max_ms"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// Struct SlowQueriesResponse; Enabled is false when the slow-query log is off
+type SlowQueriesResponse struct {
+	Enabled     bool                `json:"enabled"`
+	ThresholdMs float64             `json:"threshold_ms"`
+	Since       *time.Time          `json:"since"`
+	Queries     []SlowQueryResponse `json:"queries"`
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// List the statements that spent the most time over the slow-query
+// threshold since startup
+func (r *Repository) GetSlowQueries(context *fiber.Ctx) error {
+	request := SlowQueriesRequest{Limit: 20}
+	if err := bindQuery(context, &request); err != nil {
+		return err
+	}
+
+	log := r.Database.SlowQueries
+	response := SlowQueriesResponse{Queries: []SlowQueryResponse{}}
+	if log != nil {
+		response.Enabled = true
+		response.ThresholdMs = milliseconds(log.Threshold)
+		response.Since = &log.Since
+	}
+	for _, query := range log.Top(request.Limit) {
+		response.Queries = append(response.Queries, SlowQueryResponse{
+			Fingerprint: query.Fingerprint,
+			Table:       query.Table,
+			Count:       query.Count,
+			TotalMs:     milliseconds(query.Total),
+			MeanMs:      milliseconds(query.Total / time.Duration(query.Count)),
+			MaxMs:       milliseconds(query.Max),
+			LastSeen:    query.LastSeen,
+		})
+	}
+	return context.JSON(response)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"m/v2/storage"
+)
+
+// API keys look like "lr_<prefix>_<secret>". The prefix is stored in clear to
+// find the row; only the SHA-256 of the whole key is stored.
+const apiKeyTag = "lr"
+
+// Struct CreateAPIKeyRequest
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name" validate:"required,max=100"`
+	Scopes    []string   `json:"scopes" validate:"required,min=1,dive,scope"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+func apiKeyHasScope(key storage.APIKey, scope string) bool {
+	for _, s := range strings.Split(key.Scopes, ",") {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Find a live API key by its plaintext and record that it was used
+func (r *Repository) lookupAPIKey(ctx context.Context, plaintext string) (*storage.APIKey, bool) {
+	parts := strings.SplitN(plaintext, "_", 3)
+	if len(parts) != 3 || parts[0] != apiKeyTag {
+		return nil, false
+	}
+
+	key, err := r.Stores.APIKeys.FindByPrefix(ctx, parts[1])
+	if err != nil {
+		return nil, false
+	}
+	if subtle.ConstantTimeCompare([]byte(key.KeyHash), []byte(hashToken(plaintext))) != 1 {
+		return nil, false
+	}
+
+	now := time.Now()
+	if key.ExpiresAt != nil && now.After(*key.ExpiresAt) {
+		return nil, false
+	}
+
+	// A failed write of the last use time doesn't stop the request
+	if err := r.Stores.APIKeys.Touch(ctx, key.ID, now); err != nil {
+		slog.ErrorContext(ctx, "recording API key use", "api_key_id", key.ID, "err", err)
+	}
+	key.LastUsedAt = &now
+	return &key, true
+}
+
+// Create an API key by Admin; the plaintext key is only returned here
+func (r *Repository) CreateAPIKey(context *fiber.Ctx) error {
+	request := CreateAPIKeyRequest{}
+	if err := bindBody(context, &request); err != nil {
+		return err
+	}
+
+	if request.ExpiresAt != nil && request.ExpiresAt.Before(time.Now()) {
+		return badRequest(CodeInvalidRequest, "expires_at must be in the future")
+	}
+
+	// Hex keeps the separator out of the prefix
+	rawPrefix := make([]byte, 6)
+	if _, err := rand.Read(rawPrefix); err != nil {
+		return internalError(err)
+	}
+	prefix := hex.EncodeToString(rawPrefix)
+	secret, err := randomToken()
+	if err != nil {
+		return internalError(err)
+	}
+	plaintext := apiKeyTag + "_" + prefix + "_" + secret
+
+	key := storage.APIKey{
+		Name:      request.Name,
+		Prefix:    prefix,
+		KeyHash:   hashToken(plaintext),
+		Scopes:    strings.Join(request.Scopes, ","),
+		CreatedBy: principalFrom(context).Account.ID,
+		CreatedAt: time.Now(),
+		ExpiresAt: request.ExpiresAt,
+	}
+	err = r.audited(context, AuditAPIKeyCreate, "api_key", func(tx storage.Stores) (auditChange, error) {
+		err := tx.APIKeys.Create(context.UserContext(), &key)
+		return auditChange{TargetID: key.ID, After: apiKeyAuditFields(key)}, err
+	})
+	if err != nil {
+		return internalError(err)
+	}
+
+	return context.Status(http.StatusCreated).JSON(&fiber.Map{
+		"message": "API key created; store it now, it won't be shown again",
+		"key":     plaintext,
+		"data":    newAPIKeyResponse(key),
+	})
+}
+
+// Get all API keys by Admin
+func (r *Repository) GetAllAPIKeys(context *fiber.Ctx) error {
+	keys, err := r.Stores.APIKeys.List(context.UserContext())
+	if err != nil {
+		return internalError(err)
+	}
+
+	return context.JSON(newAPIKeyResponses(keys))
+}
+
+// Revoke an API key by Admin
+func (r *Repository) DeleteAPIKey(context *fiber.Ctx) error {
+	keyID, err := strconv.ParseUint(context.Params("id"), 10, 64)
+	if err != nil {
+		return badRequest(CodeInvalidRequest, "Invalid API key ID")
+	}
+
+	ctx := context.UserContext()
+	err = r.audited(context, AuditAPIKeyDelete, "api_key", func(tx storage.Stores) (auditChange, error) {
+		key, err := tx.APIKeys.Get(ctx, uint(keyID))
+		if err != nil {
+			return auditChange{}, err
+		}
+		return auditChange{TargetID: key.ID, Before: apiKeyAuditFields(key)}, tx.APIKeys.Delete(ctx, key.ID)
+	})
+	if err != nil {
+		return storeError(err, "API key not found", "")
+	}
+
+	return context.Status(http.StatusOK).JSON(
+		&fiber.Map{"message": "API key revoked"})
+}
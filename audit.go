@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"m/v2/storage"
+)
+
+// Privileged changes are written to the audit log in the same transaction as
+// the change itself, so neither can happen without the other.
+
+// Audited actions
+const (
+	AuditUserUpdate     = "user.update"
+	AuditUserDelete     = "user.delete"
+	AuditUserRestore    = "user.restore"
+	AuditUserVerify     = "user.verify_email"
+	AuditProductCreate  = "product.create"
+	AuditProductUpdate  = "product.update"
+	AuditProductDelete  = "product.delete"
+	AuditProductRestore = "product.restore"
+	AuditAPIKeyCreate   = "api_key.create"
+	AuditAPIKeyDelete   = "api_key.delete"
+)
+
+// auditChange is what an audited change did to its target. Before is nil
+// for a creation and After is nil for a deletion.
+type auditChange struct {
+	TargetID uint
+	Before   map[string]interface{}
+	After    map[string]interface{}
+}
+
+// audited runs change in a transaction together with the audit entry
+// recording it. Errors from change are returned as they are.
+func (r *Repository) audited(context *fiber.Ctx, action, targetType string, change func(tx storage.Stores) (auditChange, error)) error {
+	entry := storage.AuditEntry{
+		Action:     action,
+		TargetType: targetType,
+		IP:         context.IP(),
+		CreatedAt:  time.Now(),
+	}
+	entry.ActorType, entry.ActorID, entry.ActorName = auditActor(principalFrom(context))
+	if requestID, ok := context.Locals("requestid").(string); ok {
+		entry.RequestID = requestID
+	}
+
+	ctx := context.UserContext()
+	return r.Stores.Tx.Run(ctx, func(tx storage.Stores) error {
+		changed, err := change(tx)
+		if err != nil {
+			return err
+		}
+		entry.TargetID = changed.TargetID
+		if entry.OldValues, entry.NewValues, err = auditDiff(changed.Before, changed.After); err != nil {
+			return err
+		}
+		return tx.Audit.Append(ctx, &entry)
+	})
+}
+
+// Who is acting: an account, or an API key
+func auditActor(principal *Principal) (actorType string, id uint, name string) {
+	switch {
+	case principal == nil:
+		return "anonymous", 0, ""
+	case principal.APIKey != nil:
+		return "api_key", principal.APIKey.ID, principal.APIKey.Name
+	default:
+		return "account", principal.Account.ID, principal.Account.Username
+	}
+}
+
+// The JSON of the fields that differ between before and after; a creation
+// or deletion records the whole side that exists
+func auditDiff(before, after map[string]interface{}) (string, string, error) {
+	if before != nil && after != nil {
+		changedBefore, changedAfter := map[string]interface{}{}, map[string]interface{}{}
+		for field, value := range after {
+			if !reflect.DeepEqual(before[field], value) {
+				changedBefore[field], changedAfter[field] = before[field], value
+			}
+		}
+		before, after = changedBefore, changedAfter
+	}
+
+	encode := func(fields map[string]interface{}) (string, error) {
+		if fields == nil {
+			return "", nil
+		}
+		data, err := json.Marshal(fields)
+		return string(data), err
+	}
+	oldValues, err := encode(before)
+	if err != nil {
+		return "", "", err
+	}
+	newValues, err := encode(after)
+	return oldValues, newValues, err
+}
+
+// The audited fields of each target type; secrets and image bytes stay out
+
+func accountAuditFields(account storage.Account) map[string]interface{} {
+	return map[string]interface{}{
+		"fullname":       account.Fullname,
+		"email":          account.Email,
+		"username":       account.Username,
+		"role":           account.Role,
+		"age":            account.Age,
+		"address":        account.Address,
+		"email_verified": account.EmailVerifiedAt != nil,
+	}
+}
+
+func productAuditFields(product storage.Product) map[string]interface{} {
+	fields := map[string]interface{}{
+		"title":        product.Title,
+		"description":  product.Description,
+		"price":        product.Price,
+		"quantity":     product.Quantity,
+		"image_sha256": "",
+	}
+	if len(product.ImageData) > 0 {
+		sum := sha256.Sum256(product.ImageData)
+		fields["image_sha256"] = hex.EncodeToString(sum[:])
+	}
+	return fields
+}
+
+func apiKeyAuditFields(key storage.APIKey) map[string]interface{} {
+	return map[string]interface{}{
+		"name":       key.Name,
+		"prefix":     key.Prefix,
+		"scopes":     key.Scopes,
+		"expires_at": key.ExpiresAt,
+	}
+}
+
+// Struct AuditQueryRequest filters the audit log; from is inclusive and to
+// exclusive
+type AuditQueryRequest struct {
+	ActorType  string `query:"actor_type" validate:"omitempty,oneof=account api_key"`
+	ActorID    uint   `query:"actor_id"`
+	Action     string `query:"action" validate:"max=50"`
+	TargetType string `query:"target_type" validate:"omitempty,oneof=user product api_key"`
+	TargetID   uint   `query:"target_id"`
+	From       string `query:"from" validate:"omitempty,datetime=2006-01-02T15:04:05Z07:00"`
+	To         string `query:"to" validate:"omitempty,datetime=2006-01-02T15:04:05Z07:00"`
+	Limit      int    `query:"limit" validate:"min=1,max=1000"`
+	Offset     int    `query:"offset" validate:"min=0"`
+	Format     string `query:"format" validate:"omitempty,oneof=json csv"`
+}
+
+// CSV exports may be larger than a page of JSON
+const maxAuditExport = 10000
+
+// Struct AuditEntryResponse; before and after hold the changed fields
+type AuditEntryResponse struct {
+	ID         uint            `json:"id"`
+	ActorType  string          `json:"actor_type"`
+	ActorID    uint            `json:"actor_id"`
+	ActorName  string          `json:"actor_name"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"target_type"`
+	TargetID   uint            `json:"target_id"`
+	Before     json.RawMessage `json:"before"`
+	After      json.RawMessage `json:"after"`
+	IP         string          `json:"ip"`
+	RequestID  string          `json:"request_id"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+func rawJSON(value string) json.RawMessage {
+	if value == "" {
+		return json.RawMessage("null")
+	}
+	return json.RawMessage(value)
+}
+
+func newAuditEntryResponse(entry storage.AuditEntry) AuditEntryResponse {
+	return AuditEntryResponse{
+		ID:         entry.ID,
+		ActorType:  entry.ActorType,
+		ActorID:    entry.ActorID,
+		ActorName:  entry.ActorName,
+		Action:     entry.Action,
+		TargetType: entry.TargetType,
+		TargetID:   entry.TargetID,
+		Before:     rawJSON(entry.OldValues),
+		After:      rawJSON(entry.NewValues),
+		IP:         entry.IP,
+		RequestID:  entry.RequestID,
+		CreatedAt:  entry.CreatedAt,
+	}
+}
+
+// Query the audit log by Admin, newest first, as JSON or (format=csv) as a
+// CSV download
+func (r *Repository) GetAuditLog(context *fiber.Ctx) error {
+	request := AuditQueryRequest{Limit: 100}
+	if err := bindQuery(context, &request); err != nil {
+		return err
+	}
+
+	filter := storage.AuditFilter{
+		ActorType:  request.ActorType,
+		ActorID:    request.ActorID,
+		Action:     request.Action,
+		TargetType: request.TargetType,
+		TargetID:   request.TargetID,
+		Limit:      request.Limit,
+		Offset:     request.Offset,
+	}
+	// Both validated as RFC 3339
+	if request.From != "" {
+		filter.From, _ = time.Parse(time.RFC3339, request.From)
+	}
+	if request.To != "" {
+		filter.To, _ = time.Parse(time.RFC3339, request.To)
+		if !filter.To.After(filter.From) {
+			return invalidField("to", "must be after from")
+		}
+	}
+	if request.Format == "csv" && context.Query("limit") == "" {
+		filter.Limit = maxAuditExport
+	}
+	entries, err := r.Stores.Audit.List(context.UserContext(), filter)
+	if err != nil {
+		return internalError(err)
+	}
+
+	if request.Format == "csv" {
+		return sendAuditCSV(context, entries)
+	}
+	responses := make([]AuditEntryResponse, 0, len(entries))
+	for _, entry := range entries {
+		responses = append(responses, newAuditEntryResponse(entry))
+	}
+	return context.JSON(responses)
+}
+
+func sendAuditCSV(context *fiber.Ctx, entries []storage.AuditEntry) error {
+	context.Attachment(fmt.Sprintf("audit-%s.csv", time.Now().UTC().Format("20060102-150405")))
+	context.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+
+	w := csv.NewWriter(context.Response().BodyWriter())
+	w.Write([]string{"id", "created_at", "actor_type", "actor_id", "actor_name", "action",
+		"target_type", "target_id", "before", "after", "ip", "request_id"})
+	for _, entry := range entries {
+		w.Write([]string{
+			strconv.FormatUint(uint64(entry.ID), 10),
+			entry.CreatedAt.UTC().Format(time.RFC3339),
+			csvSafe(entry.ActorType),
+			strconv.FormatUint(uint64(entry.ActorID), 10),
+			csvSafe(entry.ActorName),
+			csvSafe(entry.Action),
+			csvSafe(entry.TargetType),
+			strconv.FormatUint(uint64(entry.TargetID), 10),
+			csvSafe(entry.OldValues),
+			csvSafe(entry.NewValues),
+			csvSafe(entry.IP),
+			csvSafe(entry.RequestID),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// Spreadsheets run cells starting with these as formulas. Every text column
+// goes through this: even the request ID comes from a client header.
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
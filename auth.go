@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"m/v2/storage"
+)
+
+// Roles
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Scopes that routes can require. Admin sessions hold every scope; API keys hold only the scopes they were created with.
+const (
+	ScopeProductsRead  = "products:read"
+	ScopeProductsWrite = "products:write"
+	ScopeOrdersRead    = "orders:read"
+	ScopeOrdersWrite   = "orders:write"
+	ScopeUsersRead     = "users:read"
+	ScopeUsersWrite    = "users:write"
+)
+
+var allScopes = []string{
+	ScopeProductsRead,
+	ScopeProductsWrite,
+	ScopeOrdersRead,
+	ScopeOrdersWrite,
+	ScopeUsersRead,
+	ScopeUsersWrite,
+}
+
+func validScope(scope string) bool {
+	for _, s := range allScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Struct LoginResponse
+type LoginResponse struct {
+	Message   string    `json:"message"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Principal is whoever made the request: a signed-in account or an API key
+type Principal struct {
+	Account *storage.Account
+	APIKey  *storage.APIKey
+}
+
+// HasScope reports whether the principal may use a route requiring scope
+func (p *Principal) HasScope(scope string) bool {
+	if p.APIKey != nil {
+		return apiKeyHasScope(*p.APIKey, scope)
+	}
+	return p.Account != nil && p.Account.Role == RoleAdmin
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create a session for the account and return the bearer token
+func (r *Repository) issueSession(ctx context.Context, account storage.Account) (LoginResponse, error) {
+	token, err := randomToken()
+	if err != nil {
+		return LoginResponse{}, err
+	}
+
+	session := storage.Session{
+		AccountID: account.ID,
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().Add(r.SessionTTL),
+		CreatedAt: time.Now(),
+	}
+	err = r.Stores.Sessions.Create(ctx, &session)
+	if err != nil {
+		return LoginResponse{}, err
+	}
+	err = r.Stores.Accounts.RecordLogin(ctx, account.ID, session.CreatedAt)
+	if err != nil {
+		return LoginResponse{}, err
+	}
+
+	return LoginResponse{
+		Message:   "Welcome! " + account.Username,
+		Token:     token,
+		ExpiresAt: session.ExpiresAt,
+	}, nil
+}
+
+// Respond to a successful login of any kind with a new session
+func (r *Repository) completeLogin(context *fiber.Ctx, account storage.Account) error {
+	response, err := r.issueSession(context.UserContext(), account)
+	if err != nil {
+		return internalError(err)
+	}
+	return context.JSON(response)
+}
+
+// Resolve the Authorization header to a principal; nil when absent or invalid
+func (r *Repository) authenticate(context *fiber.Ctx) *Principal {
+	scheme, credential, found := strings.Cut(context.Get(fiber.HeaderAuthorization), " ")
+	if !found || credential == "" {
+		return nil
+	}
+
+	switch strings.ToLower(scheme) {
+	case "bearer":
+		session, err := r.Stores.Sessions.FindValid(context.UserContext(), hashToken(credential), time.Now())
+		if err != nil {
+			return nil
+		}
+		account, err := r.Stores.Accounts.Get(context.UserContext(), session.AccountID)
+		if err != nil {
+			return nil
+		}
+		return &Principal{Account: &account}
+
+	case "apikey":
+		key, ok := r.lookupAPIKey(context.UserContext(), credential)
+		if !ok {
+			return nil
+		}
+		return &Principal{APIKey: key}
+	}
+	return nil
+}
+
+var errAuthRequired = unauthorized(CodeUnauthenticated, "Authentication required")
+
+// RequireAuth rejects requests without a valid session or API key
+func (r *Repository) RequireAuth(context *fiber.Ctx) error {
+	principal := r.authenticate(context)
+	if principal == nil {
+		return errAuthRequired
+	}
+	context.Locals("principal", principal)
+	return context.Next()
+}
+
+// RequireScope rejects requests whose principal lacks scope
+func (r *Repository) RequireScope(scope string) fiber.Handler {
+	return func(context *fiber.Ctx) error {
+		principal := r.authenticate(context)
+		if principal == nil {
+			return errAuthRequired
+		}
+		if !principal.HasScope(scope) {
+			return forbidden("Missing scope " + scope).WithDetails(&fiber.Map{"scope": scope})
+		}
+		context.Locals("principal", principal)
+		return context.Next()
+	}
+}
+
+// RequireAdmin only lets signed-in admins through; API keys are refused
+func (r *Repository) RequireAdmin(context *fiber.Ctx) error {
+	principal := r.authenticate(context)
+	if principal == nil {
+		return errAuthRequired
+	}
+	if principal.Account == nil || principal.Account.Role != RoleAdmin {
+		return forbidden("Admin access required")
+	}
+	context.Locals("principal", principal)
+	return context.Next()
+}
+
+// The principal set by the auth middleware
+func principalFrom(context *fiber.Ctx) *Principal {
+	principal, _ := context.Locals("principal").(*Principal)
+	return principal
+}
+
+// Log out by deleting the current session
+func (r *Repository) Logout(context *fiber.Ctx) error {
+	_, token, _ := strings.Cut(context.Get(fiber.HeaderAuthorization), " ")
+
+	err := r.Stores.Sessions.Delete(context.UserContext(), hashToken(token))
+	if err != nil {
+		return internalError(err)
+	}
+
+	return context.Status(http.StatusOK).JSON(
+		&fiber.Map{"message": "Logged out"})
+}
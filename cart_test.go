@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+
+	"m/v2/storage"
+)
+
+func TestCartsArePerAccount(t *testing.T) {
+	r, app := newTestServer(t)
+	admin := signIn(t, r, createAccount(t, r, "admin", RoleAdmin))
+	ann := signIn(t, r, createAccount(t, r, "ann", RoleUser))
+	ben := signIn(t, r, createAccount(t, r, "ben", RoleUser))
+	lamp := storage.Product{Title: "Lamp", Price: 10, Quantity: 5}
+	if err := r.Stores.Products.Create(context.Background(), &lamp); err != nil {
+		t.Fatal(err)
+	}
+	lampID := strconv.Itoa(int(lamp.ID))
+	item := CartItem{ProductID: lamp.ID, Quantity: 2}
+
+	// Visitors have no cart
+	for _, request := range []struct {
+		method, path string
+		body         interface{}
+	}{
+		{http.MethodGet, "/api/v1/cart", nil},
+		{http.MethodPost, "/api/v1/cart/items", item},
+		{http.MethodDelete, "/api/v1/cart/items/" + lampID, nil},
+		{http.MethodPost, "/api/add_to_cart", item},
+		{http.MethodPost, "/api/remove_from_cart/" + lampID, nil},
+	} {
+		response, data := send(t, app, request.method, request.path, "", nil, request.body)
+		checkErrorEnvelope(t, response, data, http.StatusUnauthorized, CodeUnauthenticated)
+	}
+
+	// Nor do API keys
+	status, data := call(t, app, http.MethodPost, "/api/v1/api-keys", admin, CreateAPIKeyRequest{Name: "shop", Scopes: []string{ScopeProductsRead}})
+	var key CreatedAPIKeyResponse
+	decode(t, data, &key)
+	if status != http.StatusCreated {
+		t.Fatalf("creating an API key: %d %s", status, data)
+	}
+	response, data := send(t, app, http.MethodGet, "/api/v1/cart", "", map[string]string{fiber.HeaderAuthorization: "ApiKey " + key.Key}, nil)
+	checkErrorEnvelope(t, response, data, http.StatusForbidden, CodeForbidden)
+
+	// Each account sees only its own cart
+	cart := func(token string) map[uint]int {
+		t.Helper()
+		status, data := call(t, app, http.MethodGet, "/api/v1/cart", token, nil)
+		var response CartResponse
+		decode(t, data, &response)
+		if status != http.StatusOK {
+			t.Fatalf("GET /api/v1/cart: %d %s", status, data)
+		}
+		return response.Data
+	}
+	if status, data := call(t, app, http.MethodPost, "/api/v1/cart/items", ann, item); status != http.StatusOK {
+		t.Fatalf("adding to Ann's cart: %d %s", status, data)
+	}
+	if got := cart(ann); len(got) != 1 || got[lamp.ID] != 2 {
+		t.Errorf("Ann's cart is %v", got)
+	}
+	if got := cart(ben); len(got) != 0 {
+		t.Errorf("Ben sees %v in his cart", got)
+	}
+	if status, data := call(t, app, http.MethodDelete, "/api/v1/cart/items/"+lampID, ben, nil); status != http.StatusOK {
+		t.Fatalf("emptying Ben's cart: %d %s", status, data)
+	}
+	if got := cart(ann); got[lamp.ID] != 2 {
+		t.Errorf("Ben emptied Ann's cart: %v", got)
+	}
+}
+
+func TestAnonymousPurchase(t *testing.T) {
+	r, app := newTestServer(t)
+	ann := createAccount(t, r, "ann", RoleUser)
+	lamp := storage.Product{Title: "Lamp", Price: 10, Quantity: 5}
+	if err := r.Stores.Products.Create(context.Background(), &lamp); err != nil {
+		t.Fatal(err)
+	}
+	order := OrderRequest{Fullname: "Ann A", Mobile: "+1 555 123 4567", Address: "1 Main St", ItemTitle: "Lamp", Quantity: 1}
+
+	// Buying needs no account; signed in, the order is the account's
+	for _, token := range []string{"", signIn(t, r, ann)} {
+		if status, data := call(t, app, http.MethodPost, "/api/v1/orders", token, order); status != http.StatusOK {
+			t.Fatalf("ordering: %d %s", status, data)
+		}
+	}
+	orders, err := r.Stores.Orders.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != 2 || orders[0].AccountID != 0 || orders[1].AccountID != ann.ID {
+		t.Errorf("orders: %+v", orders)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/jinzhu/gorm"
+
+	"m/v2/config"
+	"m/v2/migrate"
+	"m/v2/storage"
+)
+
+const migrateUsage = `usage: server migrate <command> [flags]
+
+commands:
+  up            apply all pending migrations
+  down [N]      roll back the last N migrations (default 1)
+  status        list migrations and when they were applied
+  create NAME   write an empty numbered up/down pair for every driver under migrate/`
+
+// Connect to the configured SQL database
+func openDatabase(cfg config.Database) (*gorm.DB, error) {
+	if cfg.Driver == "sqlite" {
+		return storage.NewSQLiteConnection(cfg.Path)
+	}
+	pool := storage.Pool{
+		MaxOpen:     cfg.MaxOpenConns,
+		MaxIdle:     cfg.MaxIdleConns,
+		MaxLifetime: cfg.ConnMaxLifetime,
+		MaxIdleTime: cfg.ConnMaxIdleTime,
+	}
+	return storage.ConnectWithRetry(context.Background(), cfg.ConnectTimeout, func() (*gorm.DB, error) {
+		return storage.NewConnection(cfg.DSN(), pool)
+	})
+}
+
+// Run "server migrate ..."
+func runMigrate(args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+	command, args := args[0], args[1:]
+
+	if command == "create" {
+		if len(args) == 0 {
+			return errors.New(migrateUsage)
+		}
+		created, err := migrate.Create("migrate", args[0])
+		for _, path := range created {
+			fmt.Println("created", path)
+		}
+		return err
+	}
+
+	steps := 1
+	if command == "down" && len(args) > 0 {
+		if n, err := strconv.Atoi(args[0]); err == nil {
+			if n < 1 {
+				return errors.New("down: N must be at least 1")
+			}
+			steps, args = n, args[1:]
+		}
+	}
+
+	cfg, err := config.Load(args)
+	if err != nil {
+		return err
+	}
+	if cfg.Database.Driver == "memory" {
+		return errors.New("the memory driver has no schema to migrate")
+	}
+	db, err := openDatabase(cfg.Database)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	migrator, err := migrate.New(db.DB(), cfg.Database.Driver)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	switch command {
+	case "up":
+		done, err := migrator.Up(ctx)
+		for _, m := range done {
+			fmt.Printf("applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(done) == 0 {
+			fmt.Println("no pending migrations")
+		}
+		return err
+
+	case "down":
+		done, err := migrator.Down(ctx, steps)
+		for _, m := range done {
+			fmt.Printf("rolled back %04d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(done) == 0 {
+			fmt.Println("nothing to roll back")
+		}
+		return err
+
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(os.Stdout, "%04d_%-40s %s\n", s.Version, s.Name, applied)
+		}
+		return nil
+	}
+	return errors.New(migrateUsage)
+}
@@ -0,0 +1,251 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"m/v2/passwords"
+)
+
+// Config is the whole server configuration
+type Config struct {
+	HTTP     HTTP
+	Database Database
+	Session  Session
+	WebAuthn WebAuthn
+	OIDC     []OIDCProvider
+	Password Password
+	Log      Log
+	Tracing  Tracing
+}
+
+// HTTP listener settings
+type HTTP struct {
+	Addr        string
+	CORSOrigins []string
+	// BodyLimit caps every request body; MaxImageBytes caps product image uploads
+	BodyLimit     int
+	MaxImageBytes int
+	// ShutdownTimeout is how long in-flight requests may take to finish
+	// once the server is asked to stop
+	ShutdownTimeout time.Duration
+}
+
+// Database connection settings. URL, when set, is used as-is instead of the
+// individual fields.
+type Database struct {
+	// Driver picks the storage backend: postgres, sqlite (a single file at
+	// Path, handy for development) or memory for a throwaway store
+	Driver string
+	Path   string
+
+	URL      string
+	Host     string
+	Port     int
+	User     string
+	Password string
+	Name     string
+	SSLMode  string
+
+	// MigrateOnStart applies pending migrations when the server starts;
+	// otherwise the server refuses to start with pending migrations
+	MigrateOnStart bool
+
+	// Postgres connection pool; zero leaves a limit off. SQLite always
+	// shares a single connection.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+	// ConnectTimeout is how long startup keeps retrying while Postgres is
+	// unreachable; zero tries once
+	ConnectTimeout time.Duration
+	// SlowQueryThreshold logs queries taking at least this long; zero turns
+	// the slow-query log off
+	SlowQueryThreshold time.Duration
+
+	// TrashRetentionDays is how long deleted accounts and products can be
+	// restored before they are purged for good; zero keeps them forever
+	TrashRetentionDays int
+}
+
+// Session settings
+type Session struct {
+	TTL time.Duration
+}
+
+// WebAuthn relying party settings
+type WebAuthn struct {
+	RPID    string
+	RPName  string
+	Origins []string
+}
+
+// OIDCProvider is one external identity provider
+type OIDCProvider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// Log output settings
+type Log struct {
+	// Level is debug, info, warn or error
+	Level string
+	// Format is json, or text for reading logs in a terminal
+	Format string
+}
+
+// Tracing settings
+type Tracing struct {
+	// Exporter is none, otlp (OTLP over HTTP) or stdout
+	Exporter string
+	// Endpoint is the OTLP collector URL; empty uses the exporter's default
+	// or OTEL_EXPORTER_OTLP_ENDPOINT
+	Endpoint string
+	// SampleRatio is the share of new traces recorded; incoming requests
+	// follow their caller's sampling decision
+	SampleRatio float64
+	ServiceName string
+}
+
+// Password policy and hashing
+type Password struct {
+	Policy passwords.Policy
+	Hasher passwords.Hasher
+}
+
+// Default returns the configuration used for anything not set explicitly
+func Default() Config {
+	return Config{
+		HTTP: HTTP{
+			Addr:            ":8080",
+			CORSOrigins:     []string{"*"},
+			BodyLimit:       8 << 20,
+			MaxImageBytes:   5 << 20,
+			ShutdownTimeout: 15 * time.Second,
+		},
+		Database: Database{
+			Driver:  "postgres",
+			Path:    "log-reg.db",
+			Host:    "localhost",
+			Port:    5432,
+			User:    "postgres",
+			Name:    "postgres",
+			SSLMode: "disable",
+
+			MigrateOnStart: true,
+
+			MaxOpenConns:       25,
+			MaxIdleConns:       10,
+			ConnMaxLifetime:    30 * time.Minute,
+			ConnMaxIdleTime:    5 * time.Minute,
+			ConnectTimeout:     30 * time.Second,
+			SlowQueryThreshold: 200 * time.Millisecond,
+
+			TrashRetentionDays: 30,
+		},
+		Session: Session{
+			TTL: 24 * time.Hour,
+		},
+		WebAuthn: WebAuthn{
+			RPID:    "localhost",
+			RPName:  "log-reg",
+			Origins: []string{"http://localhost:8080"},
+		},
+		Password: Password{
+			Policy: passwords.DefaultPolicy,
+			Hasher: passwords.DefaultHasher,
+		},
+		Log: Log{
+			Level:  "info",
+			Format: "json",
+		},
+		Tracing: Tracing{
+			Exporter:    "none",
+			SampleRatio: 1,
+			ServiceName: "log-reg",
+		},
+	}
+}
+
+// DSN returns a libpq keyword/value connection string
+func (d Database) DSN() string {
+	if d.URL != "" {
+		return d.URL
+	}
+	pairs := []string{
+		"host=" + quoteDSN(d.Host),
+		"port=" + strconv.Itoa(d.Port),
+		"user=" + quoteDSN(d.User),
+		"dbname=" + quoteDSN(d.Name),
+		"sslmode=" + quoteDSN(d.SSLMode),
+	}
+	if d.Password != "" {
+		pairs = append(pairs, "password="+quoteDSN(d.Password))
+	}
+	return strings.Join(pairs, " ")
+}
+
+// ConnURL returns the same settings as a postgres:// URL
+func (d Database) ConnURL() string {
+	if d.URL != "" {
+		return d.URL
+	}
+	u := url.URL{
+		Scheme:   "postgres",
+		Host:     net.JoinHostPort(d.Host, strconv.Itoa(d.Port)),
+		Path:     "/" + d.Name,
+		RawQuery: url.Values{"sslmode": {d.SSLMode}}.Encode(),
+	}
+	if d.Password != "" {
+		u.User = url.UserPassword(d.User, d.Password)
+	} else {
+		u.User = url.User(d.User)
+	}
+	return u.String()
+}
+
+// Values containing spaces, quotes or backslashes must be single-quoted with escapes
+func quoteDSN(value string) string {
+	if value != "" && !strings.ContainsAny(value, ` '\`) {
+		return value
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
+
+// String describes the configuration with secrets masked, for startup logs
+func (c Config) String() string {
+	dsn := c.Database
+	if dsn.Password != "" {
+		dsn.Password = "****"
+	}
+	if dsn.URL != "" {
+		if u, err := url.Parse(dsn.URL); err == nil {
+			dsn.URL = u.Redacted()
+		} else {
+			dsn.URL = "****"
+		}
+	}
+	providers := make([]string, 0, len(c.OIDC))
+	for _, p := range c.OIDC {
+		providers = append(providers, p.Name)
+	}
+	db := dsn.ConnURL()
+	switch c.Database.Driver {
+	case "sqlite":
+		db = "sqlite:" + c.Database.Path
+	case "memory":
+		db = "memory"
+	}
+	return fmt.Sprintf("addr=%s cors=%v db=%q session_ttl=%s webauthn_rp=%s oidc=%v password_hash=%s",
+		c.HTTP.Addr, c.HTTP.CORSOrigins, db, c.Session.TTL,
+		c.WebAuthn.RPID, providers, c.Password.Hasher.Algorithm)
+}
@@ -0,0 +1,499 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+
+	"m/v2/passwords"
+)
+
+// Settings that can be given as flags too. Every key is read from (lowest to
+// highest precedence) the defaults, the config file, the environment and the
+// command line, where DB_HOST becomes -db-host. Any key may instead be read
+// from a file named by <KEY>_FILE, which is how secrets are usually mounted.
+var keys = []string{
+	"HTTP_ADDR", "CORS_ORIGINS", "HTTP_BODY_LIMIT", "UPLOAD_MAX_IMAGE_BYTES", "HTTP_SHUTDOWN_TIMEOUT",
+	"DB_DRIVER", "DB_PATH", "DATABASE_URL", "DB_HOST", "DB_PORT", "DB_USER", "DB_PASSWORD", "DB_NAME", "DB_SSLMODE",
+	"DB_MIGRATE_ON_START", "DB_MAX_OPEN_CONNS", "DB_MAX_IDLE_CONNS", "DB_CONN_MAX_LIFETIME",
+	"DB_CONN_MAX_IDLE_TIME", "DB_CONNECT_TIMEOUT", "DB_SLOW_QUERY_THRESHOLD",
+	"TRASH_RETENTION_DAYS",
+	"SESSION_TTL",
+	"WEBAUTHN_RP_ID", "WEBAUTHN_RP_NAME", "WEBAUTHN_RP_ORIGINS",
+	"OIDC_PROVIDERS",
+	"PASSWORD_MIN_LENGTH", "PASSWORD_REQUIRE_UPPER", "PASSWORD_REQUIRE_LOWER",
+	"PASSWORD_REQUIRE_DIGIT", "PASSWORD_REQUIRE_SYMBOL", "PASSWORD_REJECT_COMMON",
+	"PASSWORD_REJECT_USERNAME", "PASSWORD_HASH", "PASSWORD_BCRYPT_COST",
+	"PASSWORD_ARGON2_MEMORY_KIB", "PASSWORD_ARGON2_ITERATIONS", "PASSWORD_ARGON2_PARALLELISM",
+	"LOG_LEVEL", "LOG_FORMAT",
+	"TRACING_EXPORTER", "TRACING_OTLP_ENDPOINT", "TRACING_SAMPLE_RATIO", "TRACING_SERVICE_NAME",
+}
+
+// Older names still found in .env files
+var aliases = map[string][]string{
+	"DB_PASSWORD": {"DB_PASS"},
+	"DB_SSLMODE":  {"SSLMODE", "DB_SLLMODE"},
+}
+
+// FieldError is a problem with one setting, named by its environment key
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationError lists every bad setting
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, fieldErr := range e {
+		messages = append(messages, fieldErr.Error())
+	}
+	return "invalid configuration: " + strings.Join(messages, "; ")
+}
+
+func flagName(key string) string {
+	return strings.ReplaceAll(strings.ToLower(key), "_", "-")
+}
+
+// Load reads the configuration from the environment, an optional config file
+// (-config or CONFIG_FILE, default .env when present) and command line args.
+func Load(args []string) (Config, error) {
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	configFile := fs.String("config", "", "path to a KEY=VALUE config file")
+	flagValues := map[string]*string{}
+	for _, key := range keys {
+		flagValues[key] = fs.String(flagName(key), "", key)
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	l := &loader{flags: map[string]string{}}
+	fs.Visit(func(f *flag.Flag) {
+		for key, value := range flagValues {
+			if flagName(key) == f.Name {
+				l.flags[key] = *value
+			}
+		}
+	})
+
+	path := *configFile
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	required := path != ""
+	if path == "" {
+		path = ".env"
+	}
+	file, err := godotenv.Read(path)
+	if err != nil && (required || !errors.Is(err, os.ErrNotExist)) {
+		return Config{}, fmt.Errorf("reading config file %s: %w", path, err)
+	}
+	l.file = file
+
+	cfg := l.build()
+	if len(l.errs) == 0 {
+		cfg.validate(l)
+	}
+	if len(l.errs) > 0 {
+		return cfg, l.errs
+	}
+	return cfg, nil
+}
+
+type loader struct {
+	file  map[string]string
+	flags map[string]string
+	errs  ValidationError
+}
+
+func (l *loader) fail(field, format string, args ...interface{}) {
+	l.errs = append(l.errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (l *loader) lookupOne(key string) (string, bool) {
+	if value, ok := l.flags[key]; ok {
+		return value, true
+	}
+	if value, ok := os.LookupEnv(key); ok {
+		return value, true
+	}
+	if value, ok := l.file[key]; ok {
+		return value, true
+	}
+	return "", false
+}
+
+func (l *loader) lookup(key string) (string, bool) {
+	for _, name := range append([]string{key}, aliases[key]...) {
+		if value, ok := l.lookupOne(name); ok {
+			return strings.TrimSpace(value), true
+		}
+	}
+	if path, ok := l.lookupOne(key + "_FILE"); ok {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			l.fail(key+"_FILE", "%v", err)
+			return "", false
+		}
+		return strings.TrimSpace(string(contents)), true
+	}
+	return "", false
+}
+
+func (l *loader) string(key string, target *string) {
+	if value, ok := l.lookup(key); ok {
+		*target = value
+	}
+}
+
+func (l *loader) list(key string, target *[]string) {
+	value, ok := l.lookup(key)
+	if !ok {
+		return
+	}
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	*target = items
+}
+
+func (l *loader) int(key string, target *int) {
+	value, ok := l.lookup(key)
+	if !ok || value == "" {
+		return
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		l.fail(key, "%q is not a whole number", value)
+		return
+	}
+	*target = parsed
+}
+
+func (l *loader) uint32(key string, target *uint32) {
+	value := int(*target)
+	l.int(key, &value)
+	if value < 0 {
+		l.fail(key, "must not be negative")
+		return
+	}
+	*target = uint32(value)
+}
+
+func (l *loader) float(key string, target *float64) {
+	value, ok := l.lookup(key)
+	if !ok || value == "" {
+		return
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		l.fail(key, "%q is not a number", value)
+		return
+	}
+	*target = parsed
+}
+
+func (l *loader) bool(key string, target *bool) {
+	value, ok := l.lookup(key)
+	if !ok || value == "" {
+		return
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		l.fail(key, "%q is not true or false", value)
+		return
+	}
+	*target = parsed
+}
+
+func (l *loader) duration(key string, target *time.Duration) {
+	value, ok := l.lookup(key)
+	if !ok || value == "" {
+		return
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		l.fail(key, "%q is not a duration such as 30m or 24h", value)
+		return
+	}
+	*target = parsed
+}
+
+func (l *loader) build() Config {
+	cfg := Default()
+
+	l.string("HTTP_ADDR", &cfg.HTTP.Addr)
+	l.list("CORS_ORIGINS", &cfg.HTTP.CORSOrigins)
+	l.int("HTTP_BODY_LIMIT", &cfg.HTTP.BodyLimit)
+	l.int("UPLOAD_MAX_IMAGE_BYTES", &cfg.HTTP.MaxImageBytes)
+	l.duration("HTTP_SHUTDOWN_TIMEOUT", &cfg.HTTP.ShutdownTimeout)
+
+	l.string("DB_DRIVER", &cfg.Database.Driver)
+	l.string("DB_PATH", &cfg.Database.Path)
+	l.string("DATABASE_URL", &cfg.Database.URL)
+	l.string("DB_HOST", &cfg.Database.Host)
+	l.int("DB_PORT", &cfg.Database.Port)
+	l.string("DB_USER", &cfg.Database.User)
+	l.string("DB_PASSWORD", &cfg.Database.Password)
+	l.string("DB_NAME", &cfg.Database.Name)
+	l.string("DB_SSLMODE", &cfg.Database.SSLMode)
+	l.bool("DB_MIGRATE_ON_START", &cfg.Database.MigrateOnStart)
+	l.int("DB_MAX_OPEN_CONNS", &cfg.Database.MaxOpenConns)
+	l.int("DB_MAX_IDLE_CONNS", &cfg.Database.MaxIdleConns)
+	l.duration("DB_CONN_MAX_LIFETIME", &cfg.Database.ConnMaxLifetime)
+	l.duration("DB_CONN_MAX_IDLE_TIME", &cfg.Database.ConnMaxIdleTime)
+	l.duration("DB_CONNECT_TIMEOUT", &cfg.Database.ConnectTimeout)
+	l.duration("DB_SLOW_QUERY_THRESHOLD", &cfg.Database.SlowQueryThreshold)
+	l.int("TRASH_RETENTION_DAYS", &cfg.Database.TrashRetentionDays)
+
+	l.duration("SESSION_TTL", &cfg.Session.TTL)
+
+	l.string("WEBAUTHN_RP_ID", &cfg.WebAuthn.RPID)
+	l.string("WEBAUTHN_RP_NAME", &cfg.WebAuthn.RPName)
+	l.list("WEBAUTHN_RP_ORIGINS", &cfg.WebAuthn.Origins)
+
+	var providers []string
+	l.list("OIDC_PROVIDERS", &providers)
+	for _, name := range providers {
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		provider := OIDCProvider{Name: name}
+		l.string(prefix+"ISSUER", &provider.Issuer)
+		l.string(prefix+"CLIENT_ID", &provider.ClientID)
+		l.string(prefix+"CLIENT_SECRET", &provider.ClientSecret)
+		l.string(prefix+"REDIRECT_URL", &provider.RedirectURL)
+		l.list(prefix+"SCOPES", &provider.Scopes)
+		cfg.OIDC = append(cfg.OIDC, provider)
+	}
+
+	policy := &cfg.Password.Policy
+	l.int("PASSWORD_MIN_LENGTH", &policy.MinLength)
+	l.bool("PASSWORD_REQUIRE_UPPER", &policy.RequireUpper)
+	l.bool("PASSWORD_REQUIRE_LOWER", &policy.RequireLower)
+	l.bool("PASSWORD_REQUIRE_DIGIT", &policy.RequireDigit)
+	l.bool("PASSWORD_REQUIRE_SYMBOL", &policy.RequireSymbol)
+	l.bool("PASSWORD_REJECT_COMMON", &policy.RejectCommon)
+	l.bool("PASSWORD_REJECT_USERNAME", &policy.RejectUsername)
+
+	hasher := &cfg.Password.Hasher
+	l.string("PASSWORD_HASH", &hasher.Algorithm)
+	l.int("PASSWORD_BCRYPT_COST", &hasher.BcryptCost)
+	l.uint32("PASSWORD_ARGON2_MEMORY_KIB", &hasher.Argon2.Memory)
+	l.uint32("PASSWORD_ARGON2_ITERATIONS", &hasher.Argon2.Iterations)
+	parallelism := int(hasher.Argon2.Parallelism)
+	l.int("PASSWORD_ARGON2_PARALLELISM", &parallelism)
+	if parallelism < 1 || parallelism > 255 {
+		l.fail("PASSWORD_ARGON2_PARALLELISM", "must be between 1 and 255")
+	} else {
+		hasher.Argon2.Parallelism = uint8(parallelism)
+	}
+
+	l.string("LOG_LEVEL", &cfg.Log.Level)
+	l.string("LOG_FORMAT", &cfg.Log.Format)
+
+	l.string("TRACING_EXPORTER", &cfg.Tracing.Exporter)
+	l.string("TRACING_OTLP_ENDPOINT", &cfg.Tracing.Endpoint)
+	l.float("TRACING_SAMPLE_RATIO", &cfg.Tracing.SampleRatio)
+	l.string("TRACING_SERVICE_NAME", &cfg.Tracing.ServiceName)
+
+	return cfg
+}
+
+func validURL(raw string, schemes ...string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) validate(l *loader) {
+	if _, _, err := net.SplitHostPort(c.HTTP.Addr); err != nil {
+		l.fail("HTTP_ADDR", "%q is not a host:port address", c.HTTP.Addr)
+	}
+	if len(c.HTTP.CORSOrigins) == 0 {
+		l.fail("CORS_ORIGINS", "must list at least one origin or *")
+	}
+	for _, origin := range c.HTTP.CORSOrigins {
+		if origin != "*" && !validURL(origin, "http", "https") {
+			l.fail("CORS_ORIGINS", "%q is not an http(s) origin", origin)
+		}
+	}
+	if c.HTTP.BodyLimit <= 0 {
+		l.fail("HTTP_BODY_LIMIT", "must be positive")
+	}
+	if c.HTTP.MaxImageBytes <= 0 {
+		l.fail("UPLOAD_MAX_IMAGE_BYTES", "must be positive")
+	} else if c.HTTP.MaxImageBytes > c.HTTP.BodyLimit {
+		l.fail("UPLOAD_MAX_IMAGE_BYTES", "must not exceed HTTP_BODY_LIMIT (%d)", c.HTTP.BodyLimit)
+	}
+	if c.HTTP.ShutdownTimeout <= 0 {
+		l.fail("HTTP_SHUTDOWN_TIMEOUT", "must be positive")
+	}
+
+	switch c.Database.Driver {
+	case "postgres":
+		c.validatePostgres(l)
+	case "sqlite":
+		if c.Database.Path == "" {
+			l.fail("DB_PATH", "is required for the sqlite driver")
+		}
+	case "memory":
+	default:
+		l.fail("DB_DRIVER", "%q is not postgres, sqlite or memory", c.Database.Driver)
+	}
+
+	if c.Database.SlowQueryThreshold < 0 {
+		l.fail("DB_SLOW_QUERY_THRESHOLD", "must not be negative")
+	}
+	if c.Database.TrashRetentionDays < 0 {
+		l.fail("TRASH_RETENTION_DAYS", "must not be negative")
+	}
+
+	if c.Session.TTL <= 0 {
+		l.fail("SESSION_TTL", "must be positive")
+	}
+
+	if c.WebAuthn.RPID == "" {
+		l.fail("WEBAUTHN_RP_ID", "is required")
+	}
+	if c.WebAuthn.RPName == "" {
+		l.fail("WEBAUTHN_RP_NAME", "is required")
+	}
+	if len(c.WebAuthn.Origins) == 0 {
+		l.fail("WEBAUTHN_RP_ORIGINS", "must list at least one origin")
+	}
+	for _, origin := range c.WebAuthn.Origins {
+		if !validURL(origin, "http", "https") {
+			l.fail("WEBAUTHN_RP_ORIGINS", "%q is not an http(s) origin", origin)
+		}
+	}
+
+	for _, provider := range c.OIDC {
+		prefix := "OIDC_" + strings.ToUpper(provider.Name) + "_"
+		if !validURL(provider.Issuer, "https", "http") {
+			l.fail(prefix+"ISSUER", "must be an issuer URL")
+		}
+		if provider.ClientID == "" {
+			l.fail(prefix+"CLIENT_ID", "is required")
+		}
+		if !validURL(provider.RedirectURL, "https", "http") {
+			l.fail(prefix+"REDIRECT_URL", "must be the callback URL")
+		}
+	}
+
+	if c.Password.Policy.MinLength < 1 {
+		l.fail("PASSWORD_MIN_LENGTH", "must be at least 1")
+	}
+	hasher := c.Password.Hasher
+	switch hasher.Algorithm {
+	case passwords.Bcrypt:
+		if hasher.BcryptCost < 4 || hasher.BcryptCost > 31 {
+			l.fail("PASSWORD_BCRYPT_COST", "must be between 4 and 31")
+		}
+	case passwords.Argon2id:
+		if hasher.Argon2.Memory < 8*uint32(hasher.Argon2.Parallelism) {
+			l.fail("PASSWORD_ARGON2_MEMORY_KIB", "must be at least 8 KiB per lane")
+		}
+		if hasher.Argon2.Iterations < 1 {
+			l.fail("PASSWORD_ARGON2_ITERATIONS", "must be at least 1")
+		}
+	default:
+		l.fail("PASSWORD_HASH", "%q is not bcrypt or argon2id", hasher.Algorithm)
+	}
+
+	switch c.Log.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		l.fail("LOG_LEVEL", "%q is not debug, info, warn or error", c.Log.Level)
+	}
+	switch c.Log.Format {
+	case "json", "text":
+	default:
+		l.fail("LOG_FORMAT", "%q is not json or text", c.Log.Format)
+	}
+
+	switch c.Tracing.Exporter {
+	case "none", "stdout":
+	case "otlp":
+		if c.Tracing.Endpoint != "" && !validURL(c.Tracing.Endpoint, "http", "https") {
+			l.fail("TRACING_OTLP_ENDPOINT", "must be an http(s) URL")
+		}
+	default:
+		l.fail("TRACING_EXPORTER", "%q is not none, otlp or stdout", c.Tracing.Exporter)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		l.fail("TRACING_SAMPLE_RATIO", "must be between 0 and 1")
+	}
+	if c.Tracing.ServiceName == "" {
+		l.fail("TRACING_SERVICE_NAME", "is required")
+	}
+}
+
+// The libpq settings only matter when the postgres driver is used
+func (c *Config) validatePostgres(l *loader) {
+	if c.Database.URL != "" {
+		if !validURL(c.Database.URL, "postgres", "postgresql") {
+			l.fail("DATABASE_URL", "must be a postgres:// URL")
+		}
+	} else {
+		if c.Database.Host == "" {
+			l.fail("DB_HOST", "is required")
+		}
+		if c.Database.Port < 1 || c.Database.Port > 65535 {
+			l.fail("DB_PORT", "%d is not a valid port", c.Database.Port)
+		}
+		if c.Database.User == "" {
+			l.fail("DB_USER", "is required")
+		}
+		if c.Database.Name == "" {
+			l.fail("DB_NAME", "is required")
+		}
+		switch c.Database.SSLMode {
+		case "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+		default:
+			l.fail("DB_SSLMODE", "%q is not a libpq sslmode", c.Database.SSLMode)
+		}
+	}
+
+	if c.Database.MaxOpenConns < 0 {
+		l.fail("DB_MAX_OPEN_CONNS", "must not be negative")
+	}
+	if c.Database.MaxIdleConns < 0 {
+		l.fail("DB_MAX_IDLE_CONNS", "must not be negative")
+	} else if c.Database.MaxOpenConns > 0 && c.Database.MaxIdleConns > c.Database.MaxOpenConns {
+		l.fail("DB_MAX_IDLE_CONNS", "must not exceed DB_MAX_OPEN_CONNS (%d)", c.Database.MaxOpenConns)
+	}
+	if c.Database.ConnMaxLifetime < 0 {
+		l.fail("DB_CONN_MAX_LIFETIME", "must not be negative")
+	}
+	if c.Database.ConnMaxIdleTime < 0 {
+		l.fail("DB_CONN_MAX_IDLE_TIME", "must not be negative")
+	}
+	if c.Database.ConnectTimeout < 0 {
+		l.fail("DB_CONNECT_TIMEOUT", "must not be negative")
+	}
+}
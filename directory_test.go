@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestUserDirectoryVerifiedFilter(t *testing.T) {
+	r, app := newTestServer(t)
+	admin := signIn(t, r, createAccount(t, r, "admin", RoleAdmin))
+	verified := createAccount(t, r, "vera", RoleUser)
+	createAccount(t, r, "ursula", RoleUser)
+
+	status, data := call(t, app, http.MethodPost, "/api/v1/users/"+strconv.Itoa(int(verified.ID))+"/email-verification", admin, nil)
+	if status != http.StatusOK {
+		t.Fatalf("verifying the email: %d %s", status, data)
+	}
+
+	for query, want := range map[string][]string{
+		"verified=true":  {"vera"},
+		"verified=false": {"admin", "ursula"},
+		"":               {"admin", "vera", "ursula"},
+	} {
+		status, data := call(t, app, http.MethodGet, "/api/v1/users?"+query, admin, nil)
+		var page []UserSummaryResponse
+		decode(t, data, &page)
+		if status != http.StatusOK || len(page) != len(want) {
+			t.Fatalf("?%s: %d %s", query, status, data)
+		}
+		for i, summary := range page {
+			if summary.Username != want[i] || summary.EmailVerified != (summary.Username == "vera") {
+				t.Errorf("?%s: entry %d is %+v, want %s", query, i, summary, want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+
+	"m/v2/storage"
+)
+
+// Error codes clients can switch on. They are part of the API: add new ones
+// freely, but never rename or reuse them.
+const (
+	CodeInvalidRequest       = "invalid_request"
+	CodeValidationFailed     = "validation_failed"
+	CodePasswordMismatch     = "password_mismatch"
+	CodeWeakPassword         = "weak_password"
+	CodeInvalidCredentials   = "invalid_credentials"
+	CodeUnauthenticated      = "unauthenticated"
+	CodeForbidden            = "forbidden"
+	CodeEmailNotVerified     = "email_not_verified"
+	CodeNotFound             = "not_found"
+	CodeMethodNotAllowed     = "method_not_allowed"
+	CodeConflict             = "conflict"
+	CodePreconditionFailed   = "precondition_failed"
+	CodePreconditionRequired = "precondition_required"
+	CodeOutOfStock           = "out_of_stock"
+	CodePayloadTooLarge      = "payload_too_large"
+	CodeRateLimited          = "rate_limited"
+	CodeUpstreamError        = "upstream_error"
+	CodeInternal             = "internal"
+)
+
+// APIError is a failure to report to the client. Err is the underlying
+// cause; it is logged but never sent.
+type APIError struct {
+	Status  int
+	Code    string
+	Message string
+	Details interface{}
+	Err     error
+}
+
+func (e *APIError) Error() string {
+	if e.Err != nil {
+		return e.Code + ": " + e.Message + ": " + e.Err.Error()
+	}
+	return e.Code + ": " + e.Message
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// WithDetails returns a copy of the error carrying details for the client
+func (e *APIError) WithDetails(details interface{}) *APIError {
+	copied := *e
+	copied.Details = details
+	return &copied
+}
+
+// ErrorResponse is the body of every failed request
+type ErrorResponse struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details"`
+	RequestID string      `json:"request_id"`
+}
+
+func newAPIError(status int, code, message string) *APIError {
+	return &APIError{Status: status, Code: code, Message: message}
+}
+
+func badRequest(code, message string) *APIError {
+	return newAPIError(http.StatusBadRequest, code, message)
+}
+
+// The request body could not be parsed at all
+func invalidBody(err error) *APIError {
+	return &APIError{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Message: "Invalid request body", Err: err}
+}
+
+func unauthorized(code, message string) *APIError {
+	return newAPIError(http.StatusUnauthorized, code, message)
+}
+
+func forbidden(message string) *APIError {
+	return newAPIError(http.StatusForbidden, CodeForbidden, message)
+}
+
+func notFound(message string) *APIError {
+	return newAPIError(http.StatusNotFound, CodeNotFound, message)
+}
+
+func conflict(message string) *APIError {
+	return newAPIError(http.StatusConflict, CodeConflict, message)
+}
+
+// Something went wrong on our side; the cause is logged, not returned
+func internalError(err error) *APIError {
+	return &APIError{Status: http.StatusInternalServerError, Code: CodeInternal, Message: "Internal server error", Err: err}
+}
+
+// Map a store error onto the API: missing rows become 404 with notFoundMessage,
+// uniqueness conflicts 409 with conflictMessage, stale versions 412 and
+// anything else 500
+func storeError(err error, notFoundMessage, conflictMessage string) *APIError {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return notFound(notFoundMessage)
+	case errors.Is(err, storage.ErrConflict):
+		return conflict(conflictMessage)
+	case errors.Is(err, storage.ErrStale):
+		return newAPIError(http.StatusPreconditionFailed, CodePreconditionFailed,
+			"It was changed since you fetched it; fetch it again and retry")
+	case errors.Is(err, storage.ErrOutOfStock):
+		return newAPIError(http.StatusConflict, CodeOutOfStock, "Not enough stock")
+	}
+	return internalError(err)
+}
+
+// Codes for errors raised by Fiber itself, such as unknown routes or bodies
+// over the limit
+var fiberCodes = map[int]string{
+	http.StatusBadRequest:            CodeInvalidRequest,
+	http.StatusUnauthorized:          CodeUnauthenticated,
+	http.StatusForbidden:             CodeForbidden,
+	http.StatusNotFound:              CodeNotFound,
+	http.StatusMethodNotAllowed:      CodeMethodNotAllowed,
+	http.StatusPreconditionFailed:    CodePreconditionFailed,
+	http.StatusPreconditionRequired:  CodePreconditionRequired,
+	http.StatusRequestEntityTooLarge: CodePayloadTooLarge,
+	http.StatusUnprocessableEntity:   CodeInvalidRequest,
+	http.StatusTooManyRequests:       CodeRateLimited,
+}
+
+// ErrorHandler writes every error returned by a handler or middleware as an
+// ErrorResponse
+func ErrorHandler(context *fiber.Ctx, err error) error {
+	var apiErr *APIError
+	var fiberErr *fiber.Error
+	switch {
+	case errors.As(err, &apiErr):
+	case errors.As(err, &fiberErr) && fiberErr.Code < http.StatusInternalServerError:
+		code, ok := fiberCodes[fiberErr.Code]
+		if !ok {
+			code = CodeInvalidRequest
+		}
+		apiErr = &APIError{Status: fiberErr.Code, Code: code, Message: fiberErr.Message}
+	default:
+		apiErr = internalError(err)
+	}
+
+	requestID, _ := context.Locals("requestid").(string)
+	if apiErr.Status >= http.StatusInternalServerError {
+		slog.ErrorContext(context.UserContext(), "request failed",
+			"method", context.Method(), "route", context.Route().Path, "err", apiErr)
+	}
+
+	return context.Status(apiErr.Status).JSON(ErrorResponse{
+		Code:      apiErr.Code,
+		Message:   apiErr.Message,
+		Details:   apiErr.Details,
+		RequestID: requestID,
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+
+	"m/v2/storage"
+)
+
+// Check data is exactly an ErrorResponse with status and code, carrying the
+// request ID the response was sent with
+func checkErrorEnvelope(t *testing.T, response *http.Response, data []byte, status int, code string) ErrorResponse {
+	t.Helper()
+	var members map[string]interface{}
+	decode(t, data, &members)
+	for _, key := range []string{"code", "message", "details", "request_id"} {
+		if _, ok := members[key]; !ok {
+			t.Errorf("error without %q: %s", key, data)
+		}
+	}
+	if len(members) != 4 {
+		t.Errorf("error with members other than code, message, details and request_id: %s", data)
+	}
+
+	var envelope ErrorResponse
+	decode(t, data, &envelope)
+	if response.StatusCode != status || envelope.Code != code || envelope.Message == "" {
+		t.Errorf("got %d %s, want %d with code %q", response.StatusCode, data, status, code)
+	}
+	if envelope.RequestID == "" || envelope.RequestID != response.Header.Get(fiber.HeaderXRequestID) {
+		t.Errorf("request_id %q, but the X-Request-ID header is %q", envelope.RequestID, response.Header.Get(fiber.HeaderXRequestID))
+	}
+	return envelope
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	r, app := newTestServer(t)
+	createAccount(t, r, "bob", RoleUser)
+	user := signIn(t, r, createAccount(t, r, "carl", RoleUser))
+
+	tests := []struct {
+		name         string
+		method, path string
+		token        string
+		body         interface{}
+		status       int
+		code         string
+	}{
+		{"unknown route", http.MethodGet, "/api/v1/nowhere", "", nil, http.StatusNotFound, CodeNotFound},
+		{"signed out", http.MethodGet, "/api/v1/me", "", nil, http.StatusUnauthorized, CodeUnauthenticated},
+		{"bad token", http.MethodGet, "/api/v1/me", "not-a-token", nil, http.StatusUnauthorized, CodeUnauthenticated},
+		{"not an admin", http.MethodGet, "/api/v1/users", user, nil, http.StatusForbidden, CodeForbidden},
+		{"missing product", http.MethodGet, "/api/v1/products/999", "", nil, http.StatusNotFound, CodeNotFound},
+		{"bad ID", http.MethodGet, "/api/v1/products/abc", "", nil, http.StatusBadRequest, CodeInvalidRequest},
+		{"wrong password", http.MethodPost, "/api/v1/sessions", "", LoginRequest{Username: "bob", Password: "wrong-horse-42"}, http.StatusUnauthorized, CodeInvalidCredentials},
+		{"taken username", http.MethodPost, "/api/v1/accounts", "", RegisterRequest{Username: "BOB", Email: "new@example.com", Password: testPassword, Confirm_Password: testPassword}, http.StatusConflict, CodeConflict},
+		{"passwords differ", http.MethodPost, "/api/v1/accounts", "", RegisterRequest{Username: "dora", Email: "dora@example.com", Password: testPassword, Confirm_Password: "other-horse-42"}, http.StatusBadRequest, CodePasswordMismatch},
+		{"legacy route", http.MethodGet, "/api/get_all_accounts", user, nil, http.StatusForbidden, CodeForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, data := send(t, app, test.method, test.path, test.token, nil, test.body)
+			checkErrorEnvelope(t, response, data, test.status, test.code)
+		})
+	}
+
+	t.Run("malformed body", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodPost, "/api/v1/sessions", bytes.NewReader([]byte(`{"username":`)))
+		request.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		response, err := app.Test(request, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		data, err := io.ReadAll(response.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkErrorEnvelope(t, response, data, http.StatusBadRequest, CodeInvalidRequest)
+	})
+
+	t.Run("client request ID", func(t *testing.T) {
+		response, data := send(t, app, http.MethodGet, "/api/v1/me", "", map[string]string{fiber.HeaderXRequestID: "client-chosen-id"}, nil)
+		if envelope := checkErrorEnvelope(t, response, data, http.StatusUnauthorized, CodeUnauthenticated); envelope.RequestID != "client-chosen-id" {
+			t.Errorf("request_id %q, want the client's", envelope.RequestID)
+		}
+	})
+}
+
+// Products whose listing fails the way a broken database would
+type failingProducts struct{ storage.ProductStore }
+
+func (failingProducts) List(ctx context.Context) ([]storage.Product, error) {
+	return nil, errors.New(`pq: relation "product" does not exist`)
+}
+
+func TestInternalErrorsHideCause(t *testing.T) {
+	r, app := newTestServer(t)
+	r.Stores.Products = failingProducts{r.Stores.Products}
+
+	for _, path := range []string{"/api/v1/products", "/api/get_all_products"} {
+		response, data := send(t, app, http.MethodGet, path, "", nil, nil)
+		envelope := checkErrorEnvelope(t, response, data, http.StatusInternalServerError, CodeInternal)
+		if envelope.Message != "Internal server error" || envelope.Details != nil || strings.Contains(string(data), "relation") {
+			t.Errorf("GET %s tells the client the cause: %s", path, data)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"m/v2/storage"
+)
+
+// Accounts and products carry a version that goes up with every write. It is
+// sent as the ETag, and updates sent with If-Match only apply to the version
+// the client last saw, so concurrent edits fail with 412 instead of silently
+// overwriting each other. The v1 updates require If-Match, answering 428
+// without it; If-Match: * overwrites whatever version is current.
+
+// The ETag of a row version
+func etag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// Send body tagged with version, or 304 Not Modified when the client's
+// If-None-Match already has it
+func sendVersioned(context *fiber.Ctx, version int, body interface{}) error {
+	tag := etag(version)
+	context.Set(fiber.HeaderETag, tag)
+	if noneMatch := context.Get(fiber.HeaderIfNoneMatch); noneMatch != "" && etagListed(noneMatch, tag, true) {
+		return context.SendStatus(http.StatusNotModified)
+	}
+	return context.JSON(body)
+}
+
+// Whether the comma-separated ETags in header include tag or *. Weak
+// comparison ignores the W/ prefix; strong comparison never matches a weak
+// tag.
+func etagListed(header, tag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = candidate[2:]
+		}
+		if candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// precondition is the If-Match header of an update
+type precondition struct {
+	header string
+}
+
+// requireIfMatch refuses updates sent without If-Match
+func requireIfMatch(context *fiber.Ctx) error {
+	if strings.TrimSpace(context.Get(fiber.HeaderIfMatch)) == "" {
+		return newAPIError(http.StatusPreconditionRequired, CodePreconditionRequired,
+			"Send If-Match with the ETag you fetched, or * to overwrite any version")
+	}
+	return context.Next()
+}
+
+func ifMatch(context *fiber.Ctx) precondition {
+	return precondition{header: context.Get(fiber.HeaderIfMatch)}
+}
+
+// The version to make an update conditional on, given the current one: zero
+// (unconditional) without If-Match or with If-Match: *, or storage.ErrStale
+// when If-Match names other versions only
+func (p precondition) version(current int) (int, error) {
+	if header := strings.TrimSpace(p.header); header == "" || header == "*" {
+		return 0, nil
+	}
+	if !etagListed(p.header, etag(current), false) {
+		return 0, storage.ErrStale
+	}
+	return current, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+
+	"m/v2/storage"
+)
+
+func TestUpdatesRequireIfMatch(t *testing.T) {
+	r, app := newTestServer(t)
+	admin := signIn(t, r, createAccount(t, r, "admin", RoleAdmin))
+	user := createAccount(t, r, "bob", RoleUser)
+	product := storage.Product{Title: "Lamp", Price: 10, Quantity: 5}
+	if err := r.Stores.Products.Create(context.Background(), &product); err != nil {
+		t.Fatal(err)
+	}
+	ids := strings.NewReplacer(
+		"/users/:id", "/users/"+strconv.Itoa(int(user.ID)),
+		"/products/:id", "/products/"+strconv.Itoa(int(product.ID)))
+
+	required := 0
+	for key, op := range operations {
+		if !op.IfMatchRequired {
+			continue
+		}
+		required++
+		method, path, _ := strings.Cut(key, " ")
+		response, data := send(t, app, method, ids.Replace(path), admin, nil, map[string]interface{}{"fullname": "Changed", "title": "Changed"})
+		checkErrorEnvelope(t, response, data, http.StatusPreconditionRequired, CodePreconditionRequired)
+	}
+	if required == 0 {
+		t.Fatal("no update requires If-Match")
+	}
+
+	// Nothing changed
+	if stored, _ := r.Stores.Accounts.Get(context.Background(), user.ID); stored.Fullname != user.Fullname || stored.Version != 1 {
+		t.Errorf("an update without If-Match changed the account: %+v", stored)
+	}
+	if stored, _ := r.Stores.Products.Get(context.Background(), product.ID); stored.Title != "Lamp" || stored.Version != 1 {
+		t.Errorf("an update without If-Match changed the product: %+v", stored)
+	}
+
+	// The legacy updates stay unconditional
+	status, data := call(t, app, http.MethodPut, "/api/update_product_by_title?title=Lamp", admin, map[string]interface{}{"price": 12})
+	if status != http.StatusOK {
+		t.Errorf("legacy update without If-Match: %d %s", status, data)
+	}
+}
+
+func TestIfMatch(t *testing.T) {
+	r, app := newTestServer(t)
+	admin := signIn(t, r, createAccount(t, r, "admin", RoleAdmin))
+	bob := createAccount(t, r, "bob", RoleUser)
+	bobToken := signIn(t, r, bob)
+	product := storage.Product{Title: "Lamp", Price: 10, Quantity: 5}
+	if err := r.Stores.Products.Create(context.Background(), &product); err != nil {
+		t.Fatal(err)
+	}
+	userPath := "/api/v1/users/" + strconv.Itoa(int(bob.ID))
+	productPath := "/api/v1/products/" + strconv.Itoa(int(product.ID))
+
+	resources := []struct {
+		name  string
+		path  string
+		token string
+		body  map[string]interface{}
+	}{
+		{"product", productPath, admin, map[string]interface{}{"price": 11}},
+		{"user", userPath, admin, map[string]interface{}{"fullname": "Bob B"}},
+		{"me", "/api/v1/me", bobToken, map[string]interface{}{"address": "1 Main St"}},
+	}
+	for _, resource := range resources {
+		t.Run(resource.name, func(t *testing.T) {
+			etagOf := func() string {
+				t.Helper()
+				response, data := send(t, app, http.MethodGet, resource.path, resource.token, nil, nil)
+				if response.StatusCode != http.StatusOK || response.Header.Get(fiber.HeaderETag) == "" {
+					t.Fatalf("GET %s: %d %s without an ETag", resource.path, response.StatusCode, data)
+				}
+				return response.Header.Get(fiber.HeaderETag)
+			}
+			update := func(method, match string) (*http.Response, []byte) {
+				t.Helper()
+				return send(t, app, method, resource.path, resource.token, map[string]string{fiber.HeaderIfMatch: match}, resource.body)
+			}
+
+			// An unchanged version answers 304 to If-None-Match
+			seen := etagOf()
+			response, _ := send(t, app, http.MethodGet, resource.path, resource.token, map[string]string{fiber.HeaderIfNoneMatch: seen}, nil)
+			if response.StatusCode != http.StatusNotModified {
+				t.Errorf("If-None-Match with the current ETag: %d", response.StatusCode)
+			}
+
+			// Two clients edit the version they both fetched: the second fails
+			if response, data := update(http.MethodPatch, seen); response.StatusCode != http.StatusOK {
+				t.Fatalf("first update: %d %s", response.StatusCode, data)
+			}
+			current := etagOf()
+			if current == seen {
+				t.Fatalf("the ETag stayed %s after an update", seen)
+			}
+			for _, method := range []string{http.MethodPatch, http.MethodPut} {
+				response, data := update(method, seen)
+				checkErrorEnvelope(t, response, data, http.StatusPreconditionFailed, CodePreconditionFailed)
+			}
+			if etagOf() != current {
+				t.Fatal("a stale update changed the resource")
+			}
+
+			// Any listed ETag may match; weak ETags never do
+			if response, data := update(http.MethodPatch, `"999", `+current); response.StatusCode != http.StatusOK {
+				t.Errorf("If-Match listing the current ETag: %d %s", response.StatusCode, data)
+			}
+			if response, data := update(http.MethodPatch, "W/"+etagOf()); response.StatusCode != http.StatusPreconditionFailed {
+				t.Errorf("weak If-Match: %d %s", response.StatusCode, data)
+			}
+
+			// * overwrites whatever is current
+			if response, data := update(http.MethodPut, "*"); response.StatusCode != http.StatusOK {
+				t.Errorf("If-Match *: %d %s", response.StatusCode, data)
+			}
+		})
+	}
+
+	// The legacy update honours If-Match when sent
+	response, data := send(t, app, http.MethodPut, "/api/update_product_by_title?title=Lamp", admin, map[string]string{fiber.HeaderIfMatch: `"1"`}, map[string]interface{}{"price": 12})
+	if response.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("stale legacy update: %d %s", response.StatusCode, data)
+	}
+}
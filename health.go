@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const readinessTimeout = 2 * time.Second
+
+// Struct HealthResponse; Checks gives each dependency's state: "ok",
+// "unavailable", "pending" (migrations) or "unknown"
+type HealthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// Liveness: the process is up and serving requests
+func (r *Repository) Healthz(context *fiber.Ctx) error {
+	return context.JSON(HealthResponse{Status: "ok"})
+}
+
+// Readiness: the database answers and its schema is up to date. The memory
+// driver has neither, so it is always ready.
+func (r *Repository) Readyz(context *fiber.Ctx) error {
+	checks := map[string]string{}
+	ready := true
+
+	if r.Database.DB != nil {
+		ctx, cancel := contextWithTimeout(context, readinessTimeout)
+		defer cancel()
+
+		checks["database"] = "ok"
+		checks["migrations"] = "ok"
+		// The details go to the log only; this endpoint is unauthenticated
+		if err := r.Database.DB.PingContext(ctx); err != nil {
+			slog.ErrorContext(ctx, "readiness check failed", "check", "database", "err", err)
+			checks["database"] = "unavailable"
+			checks["migrations"] = "unknown"
+			ready = false
+		} else if pending, err := r.Database.Migrator.Pending(ctx); err != nil {
+			slog.ErrorContext(ctx, "readiness check failed", "check", "migrations", "err", err)
+			checks["migrations"] = "unavailable"
+			ready = false
+		} else if pending > 0 {
+			slog.WarnContext(ctx, "migrations pending", "count", pending)
+			checks["migrations"] = "pending"
+			ready = false
+		}
+	}
+
+	if !ready {
+		return context.Status(http.StatusServiceUnavailable).JSON(HealthResponse{Status: "unavailable", Checks: checks})
+	}
+	return context.JSON(HealthResponse{Status: "ok", Checks: checks})
+}
+
+func contextWithTimeout(c *fiber.Ctx, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(c.UserContext(), timeout)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+
+	"m/v2/storage"
+)
+
+var (
+	successorLink = regexp.MustCompile(`^<(/api/v1/[^>]*)>; rel="successor-version"$`)
+	routeParam    = regexp.MustCompile(`:(\w+)`)
+)
+
+func TestLegacyRoutesAreDeprecated(t *testing.T) {
+	_, app := newTestServer(t)
+
+	// The v1 routes, as the Link header writes them
+	v1Routes := map[string]bool{}
+	for _, route := range app.GetRoutes(true) {
+		if strings.HasPrefix(route.Path, "/api/v1/") {
+			v1Routes[routeParam.ReplaceAllString(route.Path, "{$1}")] = true
+		}
+	}
+
+	legacy := 0
+	for key, op := range operations {
+		if op.Tag != "Legacy" {
+			continue
+		}
+		legacy++
+		method, path, _ := strings.Cut(key, " ")
+		path = routeParam.ReplaceAllString(path, "1")
+
+		// Signed out and without a body most fail, which must not lose the headers
+		response, _ := send(t, app, method, path, "", nil, nil)
+		if response.Header.Get("Deprecation") != "true" {
+			t.Errorf("%s: Deprecation %q", key, response.Header.Get("Deprecation"))
+		}
+		sunset, err := http.ParseTime(response.Header.Get("Sunset"))
+		if err != nil || !sunset.Equal(legacySunset) {
+			t.Errorf("%s: Sunset %q, want %s", key, response.Header.Get("Sunset"), legacySunset.Format(http.TimeFormat))
+		}
+		link := successorLink.FindStringSubmatch(response.Header.Get(fiber.HeaderLink))
+		if link == nil || !v1Routes[link[1]] {
+			t.Errorf("%s: Link %q does not name a v1 route", key, response.Header.Get(fiber.HeaderLink))
+		}
+	}
+	if legacy == 0 {
+		t.Fatal("no legacy routes")
+	}
+
+	// The v1 routes are not deprecated
+	response, _ := send(t, app, http.MethodGet, "/api/v1/products", "", nil, nil)
+	for _, header := range []string{"Deprecation", "Sunset", fiber.HeaderLink} {
+		if value := response.Header.Get(header); value != "" {
+			t.Errorf("GET /api/v1/products: %s %q", header, value)
+		}
+	}
+}
+
+func TestLegacyRoutesShareV1Logic(t *testing.T) {
+	r, app := newTestServer(t)
+	token := signIn(t, r, createAccount(t, r, "bob", RoleUser))
+	ctx := context.Background()
+	lamp := storage.Product{Title: "Lamp", Price: 10, Quantity: 5}
+	if err := r.Stores.Products.Create(ctx, &lamp); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both product listings answer the same
+	_, legacy := call(t, app, http.MethodGet, "/api/get_all_products", "", nil)
+	_, v1 := call(t, app, http.MethodGet, "/api/v1/products", "", nil)
+	if string(legacy) != string(v1) {
+		t.Errorf("product listings differ:\n%s\n%s", legacy, v1)
+	}
+
+	// remove_from_cart takes the product ID from the path
+	if status, data := call(t, app, http.MethodPost, "/api/add_to_cart", token, CartItem{ProductID: lamp.ID, Quantity: 2}); status != http.StatusOK {
+		t.Fatalf("add_to_cart: %d %s", status, data)
+	}
+	status, data := call(t, app, http.MethodPost, "/api/remove_from_cart/"+strconv.Itoa(int(lamp.ID)), token, nil)
+	if status != http.StatusOK {
+		t.Fatalf("remove_from_cart: %d %s", status, data)
+	}
+	status, data = call(t, app, http.MethodGet, "/api/v1/cart", token, nil)
+	var cart CartResponse
+	decode(t, data, &cart)
+	if status != http.StatusOK || len(cart.Data) != 0 {
+		t.Errorf("cart after remove_from_cart: %d %s", status, data)
+	}
+	if status, _ := call(t, app, http.MethodPost, "/api/remove_from_cart/product_id", token, nil); status != http.StatusBadRequest {
+		t.Errorf("remove_from_cart/product_id: %d, want 400", status)
+	}
+}
+
+func TestLegacyUserDataIsPrivate(t *testing.T) {
+	r, app := newTestServer(t)
+	admin := signIn(t, r, createAccount(t, r, "admin", RoleAdmin))
+	bob := signIn(t, r, createAccount(t, r, "bob", RoleUser))
+	createAccount(t, r, "carl", RoleUser)
+
+	apiKey := func(scope string) map[string]string {
+		t.Helper()
+		status, data := call(t, app, http.MethodPost, "/api/v1/api-keys", admin, CreateAPIKeyRequest{Name: scope, Scopes: []string{scope}})
+		var created CreatedAPIKeyResponse
+		decode(t, data, &created)
+		if status != http.StatusCreated {
+			t.Fatalf("creating a %s key: %d %s", scope, status, data)
+		}
+		return map[string]string{fiber.HeaderAuthorization: "ApiKey " + created.Key}
+	}
+	reader, writer := apiKey(ScopeUsersRead), apiKey(ScopeProductsWrite)
+
+	tests := []struct {
+		name     string
+		token    string
+		headers  map[string]string
+		username string
+		status   int
+	}{
+		{"signed out", "", nil, "bob", http.StatusUnauthorized},
+		{"own data", bob, nil, "bob", http.StatusOK},
+		{"own data in other case", bob, nil, " BOB", http.StatusOK},
+		{"someone else's", bob, nil, "carl", http.StatusForbidden},
+		{"unknown user, without telling", bob, nil, "nobody", http.StatusForbidden},
+		{"admin", admin, nil, "carl", http.StatusOK},
+		{"admin, unknown user", admin, nil, "nobody", http.StatusNotFound},
+		{"API key with users:read", "", reader, "carl", http.StatusOK},
+		{"API key without it", "", writer, "carl", http.StatusForbidden},
+	}
+	for _, path := range []string{"/api/get_user_data", "/api/get_userdata"} {
+		for _, test := range tests {
+			t.Run(path+" "+test.name, func(t *testing.T) {
+				response, data := send(t, app, http.MethodGet, path+"?username="+url.QueryEscape(test.username), test.token, test.headers, nil)
+				if response.StatusCode != test.status {
+					t.Fatalf("%d %s, want %d", response.StatusCode, data, test.status)
+				}
+				if test.status != http.StatusOK {
+					return
+				}
+				var profile LegacyUserDataResponse
+				decode(t, data, &profile)
+				if want := strings.ToLower(strings.TrimSpace(test.username)) + "@example.com"; profile.Email != want {
+					t.Errorf("email %q, want %q", profile.Email, want)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"go.opentelemetry.io/otel/trace"
+
+	"m/v2/config"
+)
+
+const redacted = "[REDACTED]"
+
+// Attributes whose key contains one of these are never logged
+var sensitiveKeys = []string{
+	"password", "token", "secret", "authorization", "cookie",
+	"email", "mobile", "phone", "api_key", "apikey",
+}
+
+// Personal data and credentials that turn up inside messages and errors
+var sensitiveValues = []*regexp.Regexp{
+	regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`),
+	regexp.MustCompile(`(?i)\b(bearer|apikey)\s+\S+`),
+	regexp.MustCompile(`\blr_[0-9a-f]+_\S+`),
+}
+
+func sensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactString(value string) string {
+	for _, pattern := range sensitiveValues {
+		value = pattern.ReplaceAllString(value, redacted)
+	}
+	return value
+}
+
+// Redact attributes by key, and scrub strings and errors of anything that
+// looks like an email address or credential. Runs on every attribute,
+// including the message.
+func redactAttr(groups []string, attr slog.Attr) slog.Attr {
+	if sensitiveKey(attr.Key) {
+		return slog.String(attr.Key, redacted)
+	}
+
+	switch attr.Value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, redactString(attr.Value.String()))
+	case slog.KindAny:
+		switch value := attr.Value.Any().(type) {
+		case error:
+			return slog.String(attr.Key, redactString(value.Error()))
+		case interface{ String() string }:
+			return slog.String(attr.Key, redactString(value.String()))
+		}
+	}
+	return attr
+}
+
+type requestIDKey struct{}
+
+// contextHandler adds the request ID and trace carried by the context to
+// every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if requestID, ok := ctx.Value(requestIDKey{}).(string); ok {
+		record.AddAttrs(slog.String("request_id", requestID))
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		record.AddAttrs(slog.String("trace_id", span.TraceID().String()), slog.String("span_id", span.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// Build the logger for cfg and make it the default for slog and the log package
+func setupLogging(cfg config.Log) {
+	var level slog.Level
+	// Validated by config
+	level.UnmarshalText([]byte(cfg.Level))
+
+	options := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+	var handler slog.Handler = slog.NewJSONHandler(os.Stderr, options)
+	if cfg.Format == "text" {
+		handler = slog.NewTextHandler(os.Stderr, options)
+	}
+	slog.SetDefault(slog.New(contextHandler{handler}))
+}
+
+// Log an error and exit
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+const maxRequestIDLength = 128
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]+$`)
+
+// RequestID keeps the caller's X-Request-ID when it is sane, or generates one.
+// The ID is echoed in the response, stored in Locals("requestid") for error
+// bodies and carried by the user context for logging.
+func RequestID(context *fiber.Ctx) error {
+	requestID := context.Get(fiber.HeaderXRequestID)
+	if len(requestID) > maxRequestIDLength || !requestIDPattern.MatchString(requestID) {
+		requestID = utils.UUIDv4()
+	}
+
+	context.Set(fiber.HeaderXRequestID, requestID)
+	context.Locals("requestid", requestID)
+	context.SetUserContext(withRequestID(context.UserContext(), requestID))
+	return context.Next()
+}
+
+func withRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// AccessLog logs every request once it has been answered. Errors are written
+// here, not by Fiber afterwards, so the logged status is the one sent.
+func AccessLog(context *fiber.Ctx) error {
+	start := time.Now()
+
+	if err := context.Next(); err != nil {
+		if err := context.App().ErrorHandler(context, err); err != nil {
+			context.Status(fiber.StatusInternalServerError)
+		}
+	}
+
+	status := context.Response().StatusCode()
+	level := slog.LevelInfo
+	if status >= fiber.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	slog.LogAttrs(context.UserContext(), level, "request",
+		slog.String("method", context.Method()),
+		slog.String("route", context.Route().Path),
+		slog.String("path", context.Path()),
+		slog.Int("status", status),
+		slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+		slog.Int("bytes", len(context.Response().Body())),
+		slog.String("ip", context.IP()),
+		slog.String("user_agent", context.Get(fiber.HeaderUserAgent)),
+	)
+	return nil
+}
@@ -1,30 +1,56 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	// "io/ioutil"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/joho/godotenv"
-	"golang.org/x/crypto/bcrypt"
+	"go.opentelemetry.io/otel"
 
 	// "gorm.io/gorm"
-	"github.com/jinzhu/gorm"
 	// _ "github.com/jinzhu/gorm/dialects/postgres"
 
+	"m/v2/config"
+	"m/v2/migrate"
+	"m/v2/passwords"
 	"m/v2/storage"
 	// "m/v2/models"
 )
 
 // Struct Repository
 type Repository struct {
-	DB      *gorm.DB
-	CartMap map[uint]int
+	Stores     storage.Stores
+	Database   Database
+	WebAuthn   *webauthn.WebAuthn
+	Ceremonies *CeremonyStore
+
+	OIDCProviders map[string]*OIDCProvider
+	OIDCStates    *OIDCStateStore
+
+	PasswordPolicy passwords.Policy
+	Hasher         passwords.Hasher
+
+	SessionTTL    time.Duration
+	MaxImageBytes int
+	// Deleted accounts and products are purged after this; zero keeps them
+	TrashRetention time.Duration
+
+	// Generated from the registered routes by buildOpenAPI
+	OpenAPISpec []byte
 }
 
 // Struct Message
@@ -34,63 +60,65 @@ type Message struct {
 
 // Struct Register & Log_In
 type (
-	Account struct {
-		Fullname         string `json:"fullname"`
-		Email            string `json:"email"`
-		Username         string `json:"username"`
-		Password         string `json:"password"`
-		Confirm_Password string `json:"confirm_password"`
+	RegisterRequest struct {
+		Fullname         string `json:"fullname" validate:"max=100"`
+		Email            string `json:"email" validate:"required,email,max=254"`
+		Username         string `json:"username" validate:"required,min=3,max=32,username"`
+		Password         string `json:"password" validate:"required,max=256"`
+		Confirm_Password string `json:"confirm_password" validate:"required"`
 	}
 
 	LoginRequest struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
+		Username string `json:"username" validate:"required"`
+		Password string `json:"password" validate:"required"`
 	}
 )
 type CartItem struct {
-	gorm.Model
-	ProductID uint
-	Quantity  int
+	ProductID uint `json:"product_id" validate:"required"`
+	Quantity  int  `json:"quantity" validate:"gte=1,lte=1000"`
 }
 
 // Struct UpdateAccountRequest
 type UpdateAccountRequest struct {
-	Fullname string `json:"fullname"`
-	Age      int    `json:"age"`
-	Address  string `json:"address"`
-	Email    string `json:"email"`
+	Fullname string `json:"fullname" validate:"max=100"`
+	Age      int    `json:"age" validate:"gte=0,lte=150"`
+	Address  string `json:"address" validate:"max=500"`
+	Email    string `json:"email" validate:"omitempty,email,max=254"`
 	Username string `json:"username"`
 }
 
 // Struct UpdateUserRequest (by Admin)
 type UpdateUserRequest struct {
-	Username string `json:"username"`
-	Fullname string `json:"fullname"`
-	Age      int    `json:"age"`
-	Address  string `json:"address"`
-	Email    string `json:"email"`
+	Username string `json:"username" validate:"required"`
+	Fullname string `json:"fullname" validate:"max=100"`
+	Age      int    `json:"age" validate:"gte=0,lte=150"`
+	Address  string `json:"address" validate:"max=500"`
+	Email    string `json:"email" validate:"omitempty,email,max=254"`
 }
 
 // Struct Change password
 type UpdatePasswordRequest struct {
-	Username        string `json:"username"`
-	CurrentPassword string `json:"current_password"`
-	NewPassword     string `json:"new_password"`
+	Username        string `json:"username" validate:"required"`
+	CurrentPassword string `json:"current_password" validate:"required"`
+	NewPassword     string `json:"new_password" validate:"required,max=256"`
 }
 
-// Struct Product
-type Product struct {
-	Title       string  `json:"title"`
-	Description string  `json:"description"`
-	Price       float64 `json:"price"`
-	Quantity    int     `json:"quantity"`
+// Struct ProductRequest
+type ProductRequest struct {
+	Title       string  `json:"title" form:"title" validate:"required,max=200"`
+	Description string  `json:"description" form:"description" validate:"max=5000"`
+	Price       float64 `json:"price" form:"price" validate:"gte=0"`
+	Quantity    int     `json:"quantity" form:"quantity" validate:"gte=0"`
 	ImageData   []byte  `json:"image_data"`
 }
 
-type CartItems struct {
-	ID       uint `json:"id" gorm:"primaryKey"`
-	Product  uint `json:"product"`
-	Quantity int  `json:"quantity"`
+// Struct UpdateProductRequest; zero fields are left unchanged
+type UpdateProductRequest struct {
+	Title       string  `json:"title" validate:"max=200"`
+	Description string  `json:"description" validate:"max=5000"`
+	Price       float64 `json:"price" validate:"gte=0"`
+	Quantity    int     `json:"quantity" validate:"gte=0"`
+	ImageData   []byte  `json:"image_data"`
 }
 
 // Struct GetUserDataResponse
@@ -101,116 +129,158 @@ type GetUserDataResponse struct {
 	Email    string `json:"email"`
 }
 
-// Struct Order
-type Order struct {
-	Fullname   string `json:"fullname"`
-	Mobile     string `json:"mobile"`
-	Address    string `json:"address"`
-	ItemTitle  string `json:"itemTitle"`
-	Quantity   int    `json:"quantity"`
-	PurchaseID uint   `json:"-"`
+// Struct LegacyUserDataResponse, returned by GetUserData
+type LegacyUserDataResponse struct {
+	Fullname string `json:"full_name"`
+	Email    string `json:"email"`
+	Address  string `json:"address"`
 }
 
-// HASH
-func hashPassword(password string) (string, error) {
-	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return "", err
+// Struct OrderRequest
+type OrderRequest struct {
+	Fullname  string `json:"fullname" validate:"required,max=100"`
+	Mobile    string `json:"mobile" validate:"required,mobile"`
+	Address   string `json:"address" validate:"required,max=500"`
+	ItemTitle string `json:"itemTitle" validate:"required,max=200"`
+	Quantity  int    `json:"quantity" validate:"gte=1"`
+}
+
+func (request *RegisterRequest) normalize() {
+	request.Fullname = strings.TrimSpace(request.Fullname)
+	request.Username = normalizeUsername(request.Username)
+	request.Email = normalizeEmail(request.Email)
+}
+
+func (request *UpdateAccountRequest) normalize() {
+	request.Email = normalizeEmail(request.Email)
+}
+
+func (request *UpdateUserRequest) normalize() {
+	request.Email = normalizeEmail(request.Email)
+}
+
+func (request UpdateAccountRequest) patch() storage.AccountPatch {
+	return profilePatch(request.Fullname, request.Email, request.Address, request.Age)
+}
+
+func (request UpdateUserRequest) patch() storage.AccountPatch {
+	return profilePatch(request.Fullname, request.Email, request.Address, request.Age)
+}
+
+// The patch of a PUT-style profile update, leaving zero fields unchanged
+func profilePatch(fullname, email, address string, age int) storage.AccountPatch {
+	patch := storage.AccountPatch{
+		Fullname: setIfNonZero(fullname),
+		Email:    setIfNonZero(email),
+		Address:  setIfNonZero(address),
 	}
-	return string(hashedBytes), nil
+	if age != 0 {
+		patch.Age = storage.SetTo(&age)
+	}
+	return patch
+}
+
+func (request UpdateProductRequest) patch() storage.ProductPatch {
+	return storage.ProductPatch{
+		Title:       setIfNonZero(request.Title),
+		Description: setIfNonZero(request.Description),
+		Price:       setIfNonZero(request.Price),
+		Quantity:    setIfNonZero(request.Quantity),
+		ImageData:   storage.Field[[]byte]{Set: len(request.ImageData) > 0, Value: request.ImageData},
+	}
+}
+
+func (request *OrderRequest) normalize() {
+	request.Fullname = strings.TrimSpace(request.Fullname)
+	request.Mobile = strings.TrimSpace(request.Mobile)
+	request.Address = strings.TrimSpace(request.Address)
 }
 
 // Create Account
 func (r *Repository) CreateAccount(context *fiber.Ctx) error {
-	account := Account{}
-	err := context.BodyParser(&account)
-	if err != nil {
-		context.Status(http.StatusUnprocessableEntity).JSON(
-			&fiber.Map{"message": "invalid request"})
+	account := RegisterRequest{}
+	if err := bindBody(context, &account); err != nil {
 		return err
 	}
 
 	if account.Password != account.Confirm_Password {
-		context.Status(http.StatusBadRequest).JSON(
-			&fiber.Map{"message": "passwords do not match"})
-		return nil
+		return badRequest(CodePasswordMismatch, "passwords do not match")
 	}
 
-	//if the username or email already exists
-	var existingAccount Account
-	err = r.DB.Table("account").Where("username = ? OR email = ?", account.Username, account.Email).First(&existingAccount).Error
-	if err == nil {
-		context.Status(http.StatusConflict).JSON(
-			&fiber.Map{"message": "username or email already exists"})
-		return nil
+	if err := r.checkPasswordPolicy(account.Password, account.Username); err != nil {
+		return err
 	}
 
 	// Hash the password
-	hashedPassword, err := hashPassword(account.Password)
+	hashedPassword, err := r.hashPassword(context.UserContext(), account.Password)
 	if err != nil {
-		context.Status(http.StatusInternalServerError).JSON(
-			&fiber.Map{"message": "error hashing password"})
-		return err
+		return internalError(err)
 	}
 
-	// Create the new account
-	newAccount := Account{
+	// Create the new account; the store rejects taken usernames and emails
+	newAccount := storage.Account{
 		Fullname: account.Fullname,
 		Email:    account.Email,
 		Username: account.Username,
 		Password: hashedPassword,
+		Role:     RoleUser,
 	}
 
-	err = r.DB.Table("account").Create(&newAccount).Error
+	err = r.Stores.Accounts.Create(context.UserContext(), &newAccount)
 	if err != nil {
-		context.Status(http.StatusBadRequest).JSON(
-			&fiber.Map{"message": "could not create account"})
-		return err
+		return storeError(err, "", "username or email already exists")
 	}
+	registrations.Inc()
 
-	context.Status(http.StatusOK).JSON(
+	return context.Status(http.StatusOK).JSON(
 		&fiber.Map{"message": "Successfully Registered!!!"})
-	return nil
 }
 
 // Add Product with Image Upload
 func (r *Repository) AddProduct(context *fiber.Ctx) error {
-	product := Product{}
-	err := context.BodyParser(&product)
-	if err != nil {
-		// Handle parsing error
+	request := ProductRequest{}
+	if err := bindBody(context, &request); err != nil {
 		return err
 	}
 
 	// Handle image upload
 	file, err := context.FormFile("image")
 	if err != nil {
-		// Handle image upload error
-		return err
+		return badRequest(CodeInvalidRequest, "An image file is required")
+	}
+
+	if file.Size > int64(r.MaxImageBytes) {
+		return newAPIError(http.StatusRequestEntityTooLarge, CodePayloadTooLarge, "Image is too large")
 	}
 
 	// Open the uploaded file
 	src, err := file.Open()
 	if err != nil {
-		// Handle file open error
-		return err
+		return internalError(err)
 	}
 	defer src.Close()
 
 	// Read the file data into a byte slice
 	imageData, err := ioutil.ReadAll(src)
 	if err != nil {
-		// Handle read error
-		return err
+		return internalError(err)
 	}
 
-	// Store the image data in the product object
-	product.ImageData = imageData
+	product := storage.Product{
+		Title:       request.Title,
+		Description: request.Description,
+		Price:       request.Price,
+		Quantity:    request.Quantity,
+		ImageData:   imageData,
+	}
 
-	// Insert the product (including image data) into the database
-	if err := r.DB.Table("product").Create(&product).Error; err != nil {
-		// Handle database insert error
-		return err
+	// Insert the product (including image data)
+	err = r.audited(context, AuditProductCreate, "product", func(tx storage.Stores) (auditChange, error) {
+		err := tx.Products.Create(context.UserContext(), &product)
+		return auditChange{TargetID: product.ID, After: productAuditFields(product)}, err
+	})
+	if err != nil {
+		return storeError(err, "", "product already exists")
 	}
 
 	// Return a success response
@@ -220,112 +290,146 @@ func (r *Repository) AddProduct(context *fiber.Ctx) error {
 
 // Handle purchase submission
 func (r *Repository) SubmitPurchase(context *fiber.Ctx) error {
-	purchase := Order{}
-	err := context.BodyParser(&purchase)
-	if err != nil {
-		context.Status(http.StatusUnprocessableEntity).JSON(
-			&fiber.Map{"message": "Invalid request"})
+	purchase := OrderRequest{}
+	if err := bindBody(context, &purchase); err != nil {
 		return err
 	}
 
-	// Store the purchase in the database
-	err = r.DB.Table("orders").Create(&purchase).Error
+	// Take the stock and store the purchase together. Anonymous purchases
+	// belong to account 0.
+	ctx := context.UserContext()
+	var accountID uint
+	if principal := r.authenticate(context); principal != nil && principal.Account != nil {
+		accountID = principal.Account.ID
+	}
+	err := r.Stores.Tx.Run(ctx, func(tx storage.Stores) error {
+		product, err := tx.Products.FindByTitle(ctx, purchase.ItemTitle)
+		if err != nil {
+			return err
+		}
+		if err := tx.Products.TakeStock(ctx, product.ID, purchase.Quantity); err != nil {
+			return err
+		}
+		return tx.Orders.Create(ctx, &storage.Order{
+			AccountID: accountID,
+			Fullname:  purchase.Fullname,
+			Mobile:    purchase.Mobile,
+			Address:   purchase.Address,
+			ItemTitle: purchase.ItemTitle,
+			Quantity:  purchase.Quantity,
+		})
+	})
 	if err != nil {
-		context.Status(http.StatusBadRequest).JSON(
-			&fiber.Map{"message": "Could not create purchase"})
-		return err
+		return storeError(err, "Product not found", "")
 	}
+	ordersSubmitted.Inc()
 
-	context.Status(http.StatusOK).JSON(
+	return context.Status(http.StatusOK).JSON(
 		&fiber.Map{"message": "Purchase saved successfully"})
-	return nil
 }
 
+var errInvalidLogin = unauthorized(CodeInvalidCredentials, "Invalid Username or Password")
+
 // log in
 func (r *Repository) Login(context *fiber.Ctx) error {
 	loginRequest := LoginRequest{}
-	Clientrespones := Account{}
-
-	err := context.BodyParser(&loginRequest)
-	if err != nil {
-		context.Status(http.StatusUnprocessableEntity).JSON(
-			&fiber.Map{"message": "invalid request"})
+	if err := bindBody(context, &loginRequest); err != nil {
 		return err
 	}
 
-	err = r.DB.Table("account").Where("username = ?", loginRequest.Username).First(&Clientrespones).Error
+	// Either the username or the email can be used to log in
+	Clientrespones, err := r.Stores.Accounts.FindByLogin(context.UserContext(), loginRequest.Username)
+	if errors.Is(err, storage.ErrNotFound) {
+		return errInvalidLogin
+	}
 	if err != nil {
-		context.Status(http.StatusUnauthorized).JSON(
-			&fiber.Map{"message": "Invalid Username or Password"})
-		return nil
+		return internalError(err)
 	}
 
-	// Check if the provided password matches the hashed password in the database
-	err = bcrypt.CompareHashAndPassword([]byte(Clientrespones.Password), []byte(loginRequest.Password))
-	if err != nil {
-		context.Status(http.StatusUnauthorized).JSON(
-			&fiber.Map{"message": "Invalid Username or Password"})
-		return nil
+	// Check if the provided password matches the hashed password
+	if !r.checkPassword(context.UserContext(), Clientrespones, loginRequest.Password) {
+		return errInvalidLogin
 	}
 
-	textMessage := Message{}
-	textMessage.Message = "Welcome! " + loginRequest.Username
-	return context.JSON(textMessage)
+	return r.completeLogin(context, Clientrespones)
 }
 
-// Update user account
+// Update the signed-in account
 func (r *Repository) UpdateAccount(context *fiber.Ctx) error {
 	var updateRequest UpdateAccountRequest
-	if err := context.BodyParser(&updateRequest); err != nil {
-		context.Status(http.StatusUnprocessableEntity).JSON(
-			&fiber.Map{"message": "Invalid request"})
+	if err := bindBody(context, &updateRequest); err != nil {
 		return err
 	}
 
-	// Update the user's account details in the database based on the username
-	err := r.DB.Table("account").
-		Where("username = ?", updateRequest.Username).
-		Updates(&Account{
-			Email: updateRequest.Email,
-		}).Error
+	// Only the signed-in account; username is kept for old clients and must
+	// name it
+	principal := principalFrom(context)
+	if principal.Account == nil {
+		return forbidden("API keys have no account")
+	}
+	account := *principal.Account
+	if updateRequest.Username != "" && !strings.EqualFold(normalizeUsername(updateRequest.Username), account.Username) {
+		return forbidden("You can only update your own account")
+	}
+
+	return r.updateAccount(context, account, updateRequest.patch(), "Account updated successfully")
+}
 
+// Update an account's details. With If-Match the update only applies to the
+// version of account given.
+func (r *Repository) updateAccount(context *fiber.Ctx, account storage.Account, patch storage.AccountPatch, message string) error {
+	version, err := ifMatch(context).version(account.Version)
+	if err == nil {
+		err = r.Stores.Accounts.Update(context.UserContext(), account.ID, version, patch)
+	}
 	if err != nil {
-		context.Status(http.StatusInternalServerError).JSON(
-			&fiber.Map{"message": "Failed to update account"})
-		return err
+		return storeError(err, "User not found", "email already exists")
 	}
 
-	context.Status(http.StatusOK).JSON(
-		&fiber.Map{"message": "Account updated successfully"})
-	return nil
+	return context.Status(http.StatusOK).JSON(
+		&fiber.Map{"message": message})
 }
 
 // Update user account by Admin
 func (r *Repository) UpdateUser(context *fiber.Ctx) error {
 	var updateRequest UpdateUserRequest
-	if err := context.BodyParser(&updateRequest); err != nil {
-		context.Status(http.StatusUnprocessableEntity).JSON(
-			&fiber.Map{"message": "Invalid request"})
+	if err := bindBody(context, &updateRequest); err != nil {
 		return err
 	}
 
-	// Update the user's account details in the database based on the username
-	err := r.DB.Table("account").
-		Where("username = ?", updateRequest.Username).
-		Updates(&Account{
-			Fullname: updateRequest.Fullname,
-			Email:    updateRequest.Email,
-		}).Error
+	account, err := r.Stores.Accounts.FindByUsername(context.UserContext(), updateRequest.Username)
+	if err != nil {
+		return storeError(err, "User not found", "")
+	}
+
+	return r.updateUser(context, account.ID, updateRequest.patch())
+}
 
+// Update someone's account as an Admin, recording it in the audit log
+func (r *Repository) updateUser(context *fiber.Ctx, accountID uint, patch storage.AccountPatch) error {
+	ctx := context.UserContext()
+	match := ifMatch(context)
+	err := r.audited(context, AuditUserUpdate, "user", func(tx storage.Stores) (auditChange, error) {
+		before, err := tx.Accounts.Get(ctx, accountID)
+		if err != nil {
+			return auditChange{}, err
+		}
+		version, err := match.version(before.Version)
+		if err != nil {
+			return auditChange{}, err
+		}
+		if err := tx.Accounts.Update(ctx, accountID, version, patch); err != nil {
+			return auditChange{}, err
+		}
+		after, err := tx.Accounts.Get(ctx, accountID)
+		return auditChange{accountID, accountAuditFields(before), accountAuditFields(after)}, err
+	})
 	if err != nil {
-		context.Status(http.StatusInternalServerError).JSON(
-			&fiber.Map{"message": "Failed to update user"})
-		return err
+		return storeError(err, "User not found", "email already exists")
 	}
 
-	context.Status(http.StatusOK).JSON(
+	return context.Status(http.StatusOK).JSON(
 		&fiber.Map{"message": "User updated successfully"})
-	return nil
 }
 
 // Update Product by Admin
@@ -333,172 +437,160 @@ func (r *Repository) UpdateProductByTitle(context *fiber.Ctx) error {
 	title := context.Query("title")
 
 	// Check if the product exists
-	var existingProduct Product
-	err := r.DB.Table("product").
-		Where("title = ?", title).
-		First(&existingProduct).Error
-
+	existingProduct, err := r.Stores.Products.FindByTitle(context.UserContext(), title)
 	if err != nil {
-		context.Status(http.StatusNotFound).JSON(
-			&fiber.Map{"message": "Product not found"})
-		return err
+		return storeError(err, "Product not found", "")
 	}
 
-	// Parse the updated product data from the request body
-	var updatedProduct Product
-	if err := context.BodyParser(&updatedProduct); err != nil {
-		context.Status(http.StatusUnprocessableEntity).JSON(
-			&fiber.Map{"message": "Invalid request"})
+	var updatedProduct UpdateProductRequest
+	if err := bindBody(context, &updatedProduct); err != nil {
 		return err
 	}
 
-	// Update the product in the database
-	err = r.DB.Table("product").
-		Where("title = ?", title).
-		Updates(&Product{
-			Title:       updatedProduct.Title,
-			Description: updatedProduct.Description,
-			Price:       updatedProduct.Price,
-			Quantity:    updatedProduct.Quantity,
-			ImageData:   updatedProduct.ImageData,
-		}).Error
+	return r.updateProduct(context, existingProduct.ID, updatedProduct.patch())
+}
 
+// Update a product, recording it in the audit log. With If-Match the update
+// only applies to the version named.
+func (r *Repository) updateProduct(context *fiber.Ctx, productID uint, patch storage.ProductPatch) error {
+	ctx := context.UserContext()
+	match := ifMatch(context)
+	err := r.audited(context, AuditProductUpdate, "product", func(tx storage.Stores) (auditChange, error) {
+		before, err := tx.Products.Get(ctx, productID)
+		if err != nil {
+			return auditChange{}, err
+		}
+		version, err := match.version(before.Version)
+		if err != nil {
+			return auditChange{}, err
+		}
+		if err := tx.Products.Update(ctx, productID, version, patch); err != nil {
+			return auditChange{}, err
+		}
+		after, err := tx.Products.Get(ctx, productID)
+		return auditChange{productID, productAuditFields(before), productAuditFields(after)}, err
+	})
 	if err != nil {
-		context.Status(http.StatusInternalServerError).JSON(
-			&fiber.Map{"message": "Failed to update product"})
-		return err
+		return storeError(err, "Product not found", "product already exists")
 	}
 
-	context.Status(http.StatusOK).JSON(
+	return context.Status(http.StatusOK).JSON(
 		&fiber.Map{"message": "Product updated successfully"})
-	return nil
 }
 
 // Change password
 func (r *Repository) UpdatePassword(context *fiber.Ctx) error {
 	var updateRequest UpdatePasswordRequest
-	if err := context.BodyParser(&updateRequest); err != nil {
-		context.Status(http.StatusUnprocessableEntity).JSON(
-			&fiber.Map{"message": "Invalid request"})
+	if err := bindBody(context, &updateRequest); err != nil {
 		return err
 	}
 
-	var existingAccount Account
-	err := r.DB.Table("account").
-		Where("username = ?", updateRequest.Username).
-		First(&existingAccount).Error
-
+	existingAccount, err := r.Stores.Accounts.FindByUsername(context.UserContext(), updateRequest.Username)
 	if err != nil {
-		context.Status(http.StatusNotFound).JSON(
-			&fiber.Map{"message": "User not found"})
-		return err
+		return storeError(err, "User not found", "")
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(existingAccount.Password), []byte(updateRequest.CurrentPassword))
-	if err != nil {
-		context.Status(http.StatusUnauthorized).JSON(
-			&fiber.Map{"message": "Invalid current password"})
-		return nil
+	return r.changePassword(context, existingAccount, updateRequest.CurrentPassword, updateRequest.NewPassword)
+}
+
+// Replace an account's password once the current one is confirmed
+func (r *Repository) changePassword(context *fiber.Ctx, account storage.Account, currentPassword, newPassword string) error {
+	if !r.checkPassword(context.UserContext(), account, currentPassword) {
+		return unauthorized(CodeInvalidCredentials, "Invalid current password")
 	}
 
-	// Hash the new password
-	hashedPassword, err := hashPassword(updateRequest.NewPassword)
-	if err != nil {
-		context.Status(http.StatusInternalServerError).JSON(
-			&fiber.Map{"message": "Error Hasing new password"})
+	if err := r.checkPasswordPolicy(newPassword, account.Username); err != nil {
 		return err
 	}
 
-	// Update the user's password in the database
-	err = r.DB.Table("account").
-		Where("username = ?", updateRequest.Username).
-		Update("password", hashedPassword).Error
+	// Hash the new password
+	hashedPassword, err := r.hashPassword(context.UserContext(), newPassword)
+	if err != nil {
+		return internalError(err)
+	}
 
+	// Update the user's password
+	err = r.Stores.Accounts.SetPassword(context.UserContext(), account.ID, hashedPassword)
 	if err != nil {
-		context.Status(http.StatusInternalServerError).JSON(
-			&fiber.Map{"message": "Failed to update password"})
-		return err
+		return storeError(err, "User not found", "")
 	}
 
-	context.Status(http.StatusOK).JSON(
+	return context.Status(http.StatusOK).JSON(
 		&fiber.Map{"message": "Password updated successfully"})
-	return nil
 }
 
-// Get fullname & email by username
+// Get fullname & email by username; an adapter over the account profile of
+// GET /api/v1/me that keeps the old keys
 func (r *Repository) GetUserData(context *fiber.Ctx) error {
-	username := context.Query("username")
-
-	var userData struct {
-		Fullname string `json:"full_name"`
-		Email    string `json:"email"`
-		Address  string `json:"address"`
-	}
-
-	err := r.DB.Table("account").
-		Select("fullname, email, address").
-		Where("username = ?", username).
-		First(&userData).Error
-
+	profile, err := r.profileByUsername(context)
 	if err != nil {
-		context.Status(http.StatusNotFound).JSON(
-			&fiber.Map{"message": "User not found"})
 		return err
 	}
 
-	return context.JSON(userData)
+	return context.JSON(LegacyUserDataResponse{
+		Fullname: profile.Fullname,
+		Email:    profile.Email,
+		Address:  profile.Address,
+	})
 }
 
-// GetUserData by username
+// GetUserData by username, in the GetUserDataResponse shape; an unknown age
+// is reported as 0
 func (r *Repository) GetUserData2(context *fiber.Ctx) error {
-	username := context.Query("username")
+	profile, err := r.profileByUsername(context)
+	if err != nil {
+		return err
+	}
 
-	var userData struct {
-		Fullname string `json:"fullname"`
-		Age      int    `json:"age"`
-		Address  string `json:"address"`
-		Email    string `json:"email"`
+	response := GetUserDataResponse{
+		Fullname: profile.Fullname,
+		Address:  profile.Address,
+		Email:    profile.Email,
+	}
+	if profile.Age != nil {
+		response.Age = *profile.Age
 	}
+	return context.JSON(response)
+}
 
-	err := r.DB.Table("account").
-		Select("fullname, age, address, email").
-		Where("username = ?", username).
-		First(&userData).Error
+// The profile of the account named by the username query parameter. Users
+// may only read their own; reading others takes the users:read scope.
+func (r *Repository) profileByUsername(context *fiber.Ctx) (AccountResponse, error) {
+	username := normalizeUsername(context.Query("username"))
+	principal := principalFrom(context)
+	if !principal.HasScope(ScopeUsersRead) {
+		if principal.Account == nil {
+			return AccountResponse{}, forbidden("API keys have no account")
+		}
+		if !strings.EqualFold(username, normalizeUsername(principal.Account.Username)) {
+			return AccountResponse{}, forbidden("You may only read your own user data")
+		}
+	}
 
+	account, err := r.Stores.Accounts.FindByUsername(context.UserContext(), username)
 	if err != nil {
-		context.Status(http.StatusNotFound).JSON(
-			&fiber.Map{"message": "User not found"})
-		return err
+		return AccountResponse{}, storeError(err, "User not found", "")
 	}
-
-	return context.JSON(userData)
+	return newAccountResponse(account), nil
 }
 
 // Get all user accounts
 func (r *Repository) GetAllAccounts(context *fiber.Ctx) error {
-	var accounts []Account
-
-	// Retrieve all user accounts from the database
-	err := r.DB.Table("account").Find(&accounts).Error
+	// Retrieve all user accounts
+	accounts, err := r.Stores.Accounts.List(context.UserContext())
 	if err != nil {
-		context.Status(http.StatusInternalServerError).JSON(
-			&fiber.Map{"message": "Failed to retrieve user accounts"})
-		return err
+		return internalError(err)
 	}
 
-	return context.JSON(accounts)
+	return context.JSON(newAccountResponses(accounts))
 }
 
 // Get all usernames
 func (r *Repository) GetAllUsernames(context *fiber.Ctx) error {
-	var usernames []string
-
-	// Retrieve all usernames from the database
-	err := r.DB.Table("account").Pluck("username", &usernames).Error
+	// Retrieve all usernames
+	usernames, err := r.Stores.Accounts.Usernames(context.UserContext())
 	if err != nil {
-		context.Status(http.StatusInternalServerError).JSON(
-			&fiber.Map{"message": "Failed to retrieve usernames"})
-		return err
+		return internalError(err)
 	}
 
 	return context.JSON(usernames)
@@ -506,62 +598,89 @@ func (r *Repository) GetAllUsernames(context *fiber.Ctx) error {
 
 // Get all products
 func (r *Repository) GetAllProducts(context *fiber.Ctx) error {
-	var products []Product
+	// Retrieve all products
+	products, err := r.Stores.Products.List(context.UserContext())
+	if err != nil {
+		return internalError(err)
+	}
+
+	return context.JSON(newProductResponses(products))
+}
 
-	// Retrieve all products from the database
-	err := r.DB.Table("product").Find(&products).Error
+// Get a product's image by title
+func (r *Repository) GetProductImage(context *fiber.Ctx) error {
+	title := context.Query("title")
+
+	product, err := r.Stores.Products.FindByTitle(context.UserContext(), title)
 	if err != nil {
-		context.Status(http.StatusInternalServerError).JSON(
-			&fiber.Map{"message": "Failed to retrieve products"})
-		return err
+		return storeError(err, "Image not found", "")
+	}
+
+	return r.sendProductImage(context, product.ID)
+}
+
+func (r *Repository) sendProductImage(context *fiber.Ctx, productID uint) error {
+	imageData, err := r.Stores.Products.Image(context.UserContext(), productID)
+	if err != nil {
+		return storeError(err, "Image not found", "")
+	}
+	if len(imageData) == 0 {
+		return notFound("Image not found")
 	}
 
-	return context.JSON(products)
+	context.Set(fiber.HeaderContentType, http.DetectContentType(imageData))
+	return context.Send(imageData)
 }
 
 // Get all Products Titles
 func (r *Repository) GetAllProductTitles(context *fiber.Ctx) error {
-	var productTitles []string
-
-	// Retrieve all product titles from the database
-	err := r.DB.Table("product").Pluck("title", &productTitles).Error
+	// Retrieve all product titles
+	productTitles, err := r.Stores.Products.Titles(context.UserContext())
 	if err != nil {
-		context.Status(http.StatusInternalServerError).JSON(
-			&fiber.Map{"message": "Failed to retrieve product titles"})
-		return err
+		return internalError(err)
 	}
 
 	return context.JSON(productTitles)
 }
 
+// Get all orders
+func (r *Repository) GetAllOrders(context *fiber.Ctx) error {
+	// Retrieve all orders
+	orders, err := r.Stores.Orders.List(context.UserContext())
+	if err != nil {
+		return internalError(err)
+	}
+
+	return context.JSON(newOrderResponses(orders))
+}
+
 // Delete user account by Admin
 func (r *Repository) DeleteAccount(context *fiber.Ctx) error {
 	username := context.Query("username")
 
-	var existingAccount Account
-	err := r.DB.Table("account").
-		Where("username = ?", username).
-		First(&existingAccount).Error
-
+	existingAccount, err := r.Stores.Accounts.FindByUsername(context.UserContext(), username)
 	if err != nil {
-		context.Status(http.StatusNotFound).JSON(
-			&fiber.Map{"message": "User not found"})
-		return err
+		return storeError(err, "User not found", "")
 	}
 
-	err = r.DB.Table("account").
-		Where("username = ?", username).
-		Delete(&Account{}).Error
+	return r.deleteAccount(context, existingAccount.ID)
+}
 
+func (r *Repository) deleteAccount(context *fiber.Ctx, accountID uint) error {
+	ctx := context.UserContext()
+	err := r.audited(context, AuditUserDelete, "user", func(tx storage.Stores) (auditChange, error) {
+		account, err := tx.Accounts.Get(ctx, accountID)
+		if err != nil {
+			return auditChange{}, err
+		}
+		return auditChange{TargetID: accountID, Before: accountAuditFields(account)}, tx.Accounts.Delete(ctx, accountID)
+	})
 	if err != nil {
-		context.Status(http.StatusInternalServerError).JSON(
-			&fiber.Map{"message": "Failed to delete user account"})
-		return err
+		return storeError(err, "User not found", "")
 	}
 
-	context.Status(http.StatusOK).JSON(
+	return context.Status(http.StatusOK).JSON(
 		&fiber.Map{"message": "User account deleted successfully"})
-	return nil
 }
 
 // Deletes a product by Admin
@@ -570,31 +689,39 @@ func (r *Repository) DeleteProduct(context *fiber.Ctx) error {
 	title := context.Query("title")
 
 	// Check if the product exists
-	var existingProduct Product
-	err := r.DB.Table("product").
-		Where("title = ?", title).
-		First(&existingProduct).Error
-
+	existingProduct, err := r.Stores.Products.FindByTitle(context.UserContext(), title)
 	if err != nil {
-		context.Status(http.StatusNotFound).JSON(
-			&fiber.Map{"message": "Product not found"})
-		return err
+		return storeError(err, "Product not found", "")
 	}
 
-	// Delete the product from the database
-	err = r.DB.Table("product").
-		Where("title = ?", title).
-		Delete(&Product{}).Error
+	return r.deleteProduct(context, existingProduct.ID)
+}
 
+func (r *Repository) deleteProduct(context *fiber.Ctx, productID uint) error {
+	ctx := context.UserContext()
+	err := r.audited(context, AuditProductDelete, "product", func(tx storage.Stores) (auditChange, error) {
+		product, err := tx.Products.Get(ctx, productID)
+		if err != nil {
+			return auditChange{}, err
+		}
+		return auditChange{TargetID: productID, Before: productAuditFields(product)}, tx.Products.Delete(ctx, productID)
+	})
 	if err != nil {
-		context.Status(http.StatusInternalServerError).JSON(
-			&fiber.Map{"message": "Failed to delete product"})
-		return err
+		return storeError(err, "Product not found", "")
 	}
 
-	context.Status(http.StatusOK).JSON(
+	return context.Status(http.StatusOK).JSON(
 		&fiber.Map{"message": "Product deleted successfully"})
-	return nil
+}
+
+// Carts belong to the signed-in account; the cart routes require one, so
+// visitors never share a cart
+func cartOwner(ctx *fiber.Ctx) (uint, error) {
+	principal := principalFrom(ctx)
+	if principal.Account == nil {
+		return 0, forbidden("API keys have no account")
+	}
+	return principal.Account.ID, nil
 }
 
 // add product to cart
@@ -602,114 +729,284 @@ func (r *Repository) AddToCart(ctx *fiber.Ctx) error {
 
 	item := CartItem{}
 
-	if err := ctx.BodyParser(&item); err != nil {
-		ctx.Status(http.StatusUnprocessableEntity).JSON(&fiber.Map{
-			"message": "Request failed",
-		})
+	if err := bindBody(ctx, &item); err != nil {
 		return err
 	}
 
-	r.CartMap[item.ProductID] += item.Quantity
+	accountID, err := cartOwner(ctx)
+	if err != nil {
+		return err
+	}
 
-	ctx.Status(http.StatusOK).JSON(&fiber.Map{
+	if _, err := r.Stores.Products.Get(ctx.UserContext(), item.ProductID); err != nil {
+		return storeError(err, "Product not found", "")
+	}
+
+	cart, err := r.Stores.Carts.Add(ctx.UserContext(), accountID, item.ProductID, item.Quantity)
+	if err != nil {
+		return internalError(err)
+	}
+	cartAdds.Inc()
+
+	return ctx.Status(http.StatusOK).JSON(&fiber.Map{
 		"message": "Product added to cart successfully",
-		"data":    r.CartMap,
+		"data":    cart,
 	})
-	return nil
 }
 
 // remove product from the cart
 func (r *Repository) RemoveFromCart(ctx *fiber.Ctx) error {
-	productIDStr := ctx.Params("product_id")
+	productID, err := paramID(ctx, "product_id", "product")
+	if err != nil {
+		return err
+	}
+
+	return r.removeFromCart(ctx, productID)
+}
 
-	productID, err := strconv.ParseUint(productIDStr, 10, 64)
+func (r *Repository) removeFromCart(ctx *fiber.Ctx, productID uint) error {
+	accountID, err := cartOwner(ctx)
 	if err != nil {
-		ctx.Status(http.StatusUnprocessableEntity).JSON(&fiber.Map{
-			"message": "Invalid product ID",
-		})
 		return err
 	}
 
-	delete(r.CartMap, uint(productID))
+	cart, err := r.Stores.Carts.Remove(ctx.UserContext(), accountID, productID)
+	if err != nil {
+		return internalError(err)
+	}
 
-	ctx.Status(http.StatusOK).JSON(&fiber.Map{
+	return ctx.Status(http.StatusOK).JSON(&fiber.Map{
 		"message": "Product removed from cart successfully",
-		"data":    r.CartMap,
+		"data":    cart,
 	})
-	return nil
 }
 
 // Routes
 func (r *Repository) SetupRoutes(app *fiber.App) {
 	api := app.Group("/api")
+	r.setupV1Routes(api.Group("/v1"))
+
+	// Probes & metrics
+	app.Get("/healthz", r.Healthz)
+	app.Get("/readyz", r.Readyz)
+	app.Get("/metrics", GetMetrics)
+
+	// Documentation
+	api.Get("/openapi.json", r.GetOpenAPI)
+	api.Get("/docs", r.GetAPIDocs)
+
+	// External identity providers; the callback URL is registered with each
+	// provider, so these stay outside the versioned API
+	api.Get("/oidc/:provider/login", r.OIDCLogin)
+	api.Get("/oidc/:provider/callback", countLogins("oidc", r.OIDCCallback))
+
+	// Legacy routes, kept for existing clients. Each points at its /api/v1
+	// successor.
 
 	// Log In
-	api.Post("/login", r.Login)
+	api.Post("/login", deprecated("/api/v1/sessions"), countLogins("password", r.Login))
+	api.Post("/logout", deprecated("/api/v1/sessions/current"), r.Logout)
+	// Passkeys
+	api.Post("/passkey/register/begin", deprecated("/api/v1/passkeys/registrations"), r.BeginPasskeyRegistration)
+	api.Post("/passkey/register/finish", deprecated("/api/v1/passkeys/registrations/finish"), r.FinishPasskeyRegistration)
+	api.Post("/passkey/login/begin", deprecated("/api/v1/passkeys/logins"), r.BeginPasskeyLogin)
+	api.Post("/passkey/login/finish", deprecated("/api/v1/passkeys/logins/finish"), countLogins("passkey", r.FinishPasskeyLogin))
+	api.Get("/passkeys", deprecated("/api/v1/passkeys"), r.RequireAuth, r.GetPasskeys)
+	api.Delete("/passkeys/:id", deprecated("/api/v1/passkeys/{id}"), r.RequireAuth, r.DeletePasskey)
 	// Create & Add
-	api.Post("/create_account", r.CreateAccount)
-	api.Post("/add_product", r.AddProduct)
-	api.Post("/submit_purchase", r.SubmitPurchase)
+	api.Post("/create_account", deprecated("/api/v1/accounts"), r.CreateAccount)
+	api.Post("/add_product", deprecated("/api/v1/products"), r.RequireScope(ScopeProductsWrite), r.AddProduct)
+	api.Post("/submit_purchase", deprecated("/api/v1/orders"), r.SubmitPurchase)
 
 	// Update
-	api.Put("/update_account", r.UpdateAccount)
-	api.Put("/update_password", r.UpdatePassword)
-	api.Put("/update_user", r.UpdateUser)
-	api.Put("/update_product_by_title", r.UpdateProductByTitle)
+	api.Put("/update_account", deprecated("/api/v1/me"), r.RequireAuth, r.UpdateAccount)
+	api.Put("/update_password", deprecated("/api/v1/me/password"), r.UpdatePassword)
+	api.Put("/update_user", deprecated("/api/v1/users/{id}"), r.RequireScope(ScopeUsersWrite), r.UpdateUser)
+	api.Put("/update_product_by_title", deprecated("/api/v1/products/{id}"), r.RequireScope(ScopeProductsWrite), r.UpdateProductByTitle)
 	// Get
-	api.Get("/get_user_data", r.GetUserData)
-	api.Get("/get_userdata", r.GetUserData2)
-	api.Get("/get_all_accounts", r.GetAllAccounts)
-	api.Get("/get_all_usernames", r.GetAllUsernames)
-	api.Get("/get_all_products", r.GetAllProducts)
-	api.Get("/get_all_product_titles", r.GetAllProductTitles)
+	api.Get("/get_user_data", deprecated("/api/v1/me"), r.RequireAuth, r.GetUserData)
+	api.Get("/get_userdata", deprecated("/api/v1/me"), r.RequireAuth, r.GetUserData2)
+	api.Get("/get_all_accounts", deprecated("/api/v1/users"), r.RequireScope(ScopeUsersRead), r.GetAllAccounts)
+	api.Get("/get_all_usernames", deprecated("/api/v1/users"), r.RequireScope(ScopeUsersRead), r.GetAllUsernames)
+	api.Get("/get_all_products", deprecated("/api/v1/products"), r.GetAllProducts)
+	api.Get("/get_all_product_titles", deprecated("/api/v1/products"), r.GetAllProductTitles)
+	api.Get("/get_product_image", deprecated("/api/v1/products/{id}/image"), r.GetProductImage)
+	api.Get("/get_all_orders", deprecated("/api/v1/orders"), r.RequireScope(ScopeOrdersRead), r.GetAllOrders)
 
 	//Delete
-	api.Delete("/delete_account", r.DeleteAccount)
-	api.Delete("/delete_product", r.DeleteProduct)
+	api.Delete("/delete_account", deprecated("/api/v1/users/{id}"), r.RequireScope(ScopeUsersWrite), r.DeleteAccount)
+	api.Delete("/delete_product", deprecated("/api/v1/products/{id}"), r.RequireScope(ScopeProductsWrite), r.DeleteProduct)
+
+	// API keys (admin sessions only)
+	api.Post("/api_keys", deprecated("/api/v1/api-keys"), r.RequireAdmin, r.CreateAPIKey)
+	api.Get("/api_keys", deprecated("/api/v1/api-keys"), r.RequireAdmin, r.GetAllAPIKeys)
+	api.Delete("/api_keys/:id", deprecated("/api/v1/api-keys/{id}"), r.RequireAdmin, r.DeleteAPIKey)
+
+	api.Post("/add_to_cart", deprecated("/api/v1/cart/items"), r.RequireAuth, r.AddToCart)
+	api.Post("/remove_from_cart/:product_id", deprecated("/api/v1/cart/items/{id}"), r.RequireAuth, r.RemoveFromCart)
+}
+
+// Database is the open storage backend. DB and Migrator are nil for the
+// memory driver.
+type Database struct {
+	Stores   storage.Stores
+	DB       *sql.DB
+	Migrator *migrate.Migrator
+	// SlowQueries is nil when the slow-query log is off or storage is in memory
+	SlowQueries *storage.SlowQueryLog
+}
+
+// Close releases the database connections
+func (d Database) Close() error {
+	if d.DB == nil {
+		return nil
+	}
+	return d.DB.Close()
+}
 
-	api.Post("/add_to_cart", r.AddToCart)
-	api.Post("/remove_from_cart/product_id", r.RemoveFromCart)
+// Open the configured storage backend, bringing the database schema up to date
+func openStores(cfg config.Database) (Database, error) {
+	if cfg.Driver == "memory" {
+		slog.Warn("using in-memory storage; data is lost on restart")
+		return Database{Stores: storage.NewMemory()}, nil
+	}
+
+	db, err := openDatabase(cfg)
+	if err != nil {
+		return Database{}, fmt.Errorf("could not load the database: %w", err)
+	}
+	storage.InstrumentQueries(db, observeQuery)
+	registerDBStats(db.DB(), cfg.Driver)
+	var slowQueries *storage.SlowQueryLog
+	if cfg.SlowQueryThreshold > 0 {
+		slowQueries = storage.NewSlowQueryLog(cfg.SlowQueryThreshold)
+		slowQueries.Attach(db)
+	}
+
+	migrator, err := migrate.New(db.DB(), cfg.Driver)
+	if err != nil {
+		db.Close()
+		return Database{}, err
+	}
+	if cfg.MigrateOnStart {
+		applied, err := migrator.Up(context.Background())
+		if err != nil {
+			db.Close()
+			return Database{}, fmt.Errorf("could not migrate the database: %w", err)
+		}
+		for _, m := range applied {
+			slog.Info("applied migration", "version", m.Version, "name", m.Name)
+		}
+	} else if pending, err := migrator.Pending(context.Background()); err != nil || pending > 0 {
+		db.Close()
+		return Database{}, fmt.Errorf("database schema is not up to date (pending=%d, err=%v); run: server migrate up", pending, err)
+	}
+	return Database{Stores: storage.NewSQL(db), DB: db.DB(), Migrator: migrator, SlowQueries: slowQueries}, nil
 }
 
 // .env
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	err := godotenv.Load(".env")
+	cfg, err := config.Load(os.Args[1:])
 	if err != nil {
 		log.Fatal(err)
 	}
+	setupLogging(cfg.Log)
+	slog.Info("starting", "config", cfg.String())
 
-	config := &storage.Config{
-		Host:     os.Getenv("DB_HOST"),
-		Port:     os.Getenv("DB_PORT"),
-		Password: os.Getenv("DB_PASS"),
-		User:     os.Getenv("DB_USER"),
-		DBName:   os.Getenv("DB_NAME"),
-		SSLMode:  os.Getenv("DB_SLLMODE"),
+	shutdownTracing, err := setupTracing(cfg.Tracing)
+	if err != nil {
+		fatal("could not set up tracing", err)
 	}
 
-	db, err := storage.NewConnection(config)
+	database, err := openStores(cfg.Database)
+	if err != nil {
+		fatal("could not open storage", err)
+	}
 
+	webAuthn, err := NewWebAuthn(cfg.WebAuthn.RPID, cfg.WebAuthn.RPName, cfg.WebAuthn.Origins)
 	if err != nil {
-		log.Fatal("Could not load the database")
+		fatal("could not set up WebAuthn", err)
 	}
-	// Auto-migrate your database tables here
-	db.AutoMigrate(
-		&Account{},
-		&Product{},
-		&Order{},
-		&CartItem{},
-	)
 
 	r := Repository{
-		DB: db,
+		Stores:     storage.Traced(database.Stores, otel.Tracer("m/v2/storage")),
+		Database:   database,
+		WebAuthn:   webAuthn,
+		Ceremonies: NewCeremonyStore(),
+
+		OIDCProviders: NewOIDCProviders(cfg.OIDC),
+		OIDCStates:    NewOIDCStateStore(),
+
+		PasswordPolicy: cfg.Password.Policy,
+		Hasher:         cfg.Password.Hasher,
+
+		SessionTTL:     cfg.Session.TTL,
+		MaxImageBytes:  cfg.HTTP.MaxImageBytes,
+		TrashRetention: time.Duration(cfg.Database.TrashRetentionDays) * 24 * time.Hour,
 	}
-	app := fiber.New()
+	app := fiber.New(fiber.Config{
+		BodyLimit:    cfg.HTTP.BodyLimit,
+		ErrorHandler: ErrorHandler,
+		// Startup is logged as JSON like everything else
+		DisableStartupMessage: true,
+	})
+	// Every response carries an X-Request-ID, echoed in error bodies and logs
+	app.Use(RequestID)
+	app.Use(Tracing)
+	app.Use(Metrics())
+	app.Use(AccessLog)
 	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
+		AllowOrigins: strings.Join(cfg.HTTP.CORSOrigins, ","),
 	}))
 	r.SetupRoutes(app)
-	app.Listen(":8080")
+	r.OpenAPISpec, err = buildOpenAPI(app)
+	if err != nil {
+		fatal("could not build the OpenAPI document", err)
+	}
+
+	workers := NewWorkers()
+	workers.Every("session-sweep", sessionSweepInterval, r.sweepSessions)
+	if r.TrashRetention > 0 {
+		workers.Every("trash-purge", trashPurgeInterval, r.purgeTrash)
+	}
+
+	// Stop accepting connections on SIGINT/SIGTERM and give in-flight
+	// requests up to the shutdown timeout to finish
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	drained := make(chan struct{})
+	go func() {
+		sig := <-signals
+		slog.Info("shutting down", "signal", sig.String(), "timeout", cfg.HTTP.ShutdownTimeout.String())
+		if err := app.ShutdownWithTimeout(cfg.HTTP.ShutdownTimeout); err != nil {
+			slog.Error("shutdown", "err", err)
+		}
+		close(drained)
+	}()
+
+	slog.Info("listening", "addr", cfg.HTTP.Addr)
+	if err := app.Listen(cfg.HTTP.Addr); err != nil {
+		fatal("could not serve", err)
+	}
+	<-drained
+
+	workers.Stop()
+	if err := database.Close(); err != nil {
+		slog.Error("closing the database", "err", err)
+	}
+	flushCtx, cancel := context.WithTimeout(context.Background(), cfg.HTTP.ShutdownTimeout)
+	defer cancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		slog.Error("flushing traces", "err", err)
+	}
+	slog.Info("server stopped")
 }
 
 // package main
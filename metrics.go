@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics are registered with the default Prometheus registry, which also
+// carries the Go runtime and process collectors. Labels only take values from
+// small fixed sets: route templates rather than paths, status codes, table
+// names; requests matching no route share the route label "unmatched".
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by method, route template and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by method, route template and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_query_duration_seconds",
+		Help:    "Database query latency by operation and table.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"operation", "table"})
+
+	dbQueryErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_query_errors_total",
+		Help: "Failed database queries by operation and table; missing rows are not failures.",
+	}, []string{"operation", "table"})
+
+	registrations = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "app_registrations_total",
+		Help: "Accounts registered.",
+	})
+
+	logins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "app_logins_total",
+		Help: "Login attempts by method (password, passkey, oidc) and result (success, failure, error).",
+	}, []string{"method", "result"})
+
+	ordersSubmitted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "app_orders_submitted_total",
+		Help: "Orders submitted.",
+	})
+
+	cartAdds = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "app_cart_adds_total",
+		Help: "Products added to carts.",
+	})
+)
+
+// Record query timings from the storage layer
+func observeQuery(operation, table string, duration time.Duration, failed bool) {
+	dbQueryDuration.WithLabelValues(operation, table).Observe(duration.Seconds())
+	if failed {
+		dbQueryErrors.WithLabelValues(operation, table).Inc()
+	}
+}
+
+// Export connection pool statistics for db
+func registerDBStats(db *sql.DB, name string) {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, name))
+}
+
+// Metrics counts and times every request. It sits outside AccessLog, which
+// has already turned errors into responses, so the status is final.
+func Metrics() fiber.Handler {
+	var once sync.Once
+	routes := map[string]bool{}
+
+	return func(context *fiber.Ctx) error {
+		start := time.Now()
+		err := context.Next()
+
+		// Routes are all registered by the first request
+		once.Do(func() {
+			for _, route := range context.App().GetRoutes(true) {
+				routes[route.Method+" "+route.Path] = true
+			}
+		})
+		// Fiber reuses the buffer behind Method; labels outlive the request
+		method := utils.CopyString(context.Method())
+		route := context.Route().Path
+		if !routes[method+" "+route] {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(context.Response().StatusCode())
+
+		httpRequests.WithLabelValues(method, route, status).Inc()
+		httpDuration.WithLabelValues(method, route, status).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+// Serve the metrics in the Prometheus text format
+var GetMetrics = adaptor.HTTPHandler(promhttp.Handler())
+
+// countLogins wraps a login handler, counting its outcome: success, failure
+// for bad credentials, or error for anything else
+func countLogins(method string, handler fiber.Handler) fiber.Handler {
+	return func(context *fiber.Ctx) error {
+		err := handler(context)
+
+		result := "success"
+		var apiErr *APIError
+		switch {
+		case err == nil:
+		case errors.As(err, &apiErr) && apiErr.Code == CodeInvalidCredentials:
+			result = "failure"
+		default:
+			result = "error"
+		}
+		logins.WithLabelValues(method, result).Inc()
+		return err
+	}
+}
@@ -0,0 +1,104 @@
+-- Baseline schema. Installs that used to run gorm AutoMigrate already have
+-- some of these tables, so everything is created only when missing.
+
+CREATE TABLE IF NOT EXISTS account (
+    id       BIGSERIAL PRIMARY KEY,
+    fullname TEXT NOT NULL DEFAULT '',
+    email    TEXT NOT NULL DEFAULT '',
+    username TEXT NOT NULL,
+    password TEXT NOT NULL DEFAULT '',
+    role     TEXT NOT NULL DEFAULT 'user'
+);
+ALTER TABLE account ADD COLUMN IF NOT EXISTS id BIGSERIAL PRIMARY KEY;
+ALTER TABLE account ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'user';
+
+-- Usernames and emails are unique ignoring case and surrounding spaces. Rows
+-- from before may break that, so first trim them, then let the oldest account
+-- (lowest id) keep a contested username or email; later ones get #dup<id>
+-- appended, which no signup can produce, for an admin to sort out.
+UPDATE account SET username = trim(username), email = trim(email)
+WHERE username <> trim(username) OR email <> trim(email);
+UPDATE account SET username = username || '#dup' || id
+WHERE EXISTS (SELECT 1 FROM account older WHERE lower(older.username) = lower(account.username) AND older.id < account.id);
+UPDATE account SET email = email || '#dup' || id
+WHERE email <> '' AND EXISTS (SELECT 1 FROM account older WHERE lower(older.email) = lower(account.email) AND older.id < account.id);
+
+CREATE UNIQUE INDEX IF NOT EXISTS account_username_lower_key ON account (lower(trim(username)));
+CREATE UNIQUE INDEX IF NOT EXISTS account_email_lower_key ON account (lower(trim(email))) WHERE email <> '';
+
+CREATE TABLE IF NOT EXISTS product (
+    id          BIGSERIAL PRIMARY KEY,
+    title       TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    price       DOUBLE PRECISION NOT NULL DEFAULT 0,
+    quantity    INTEGER NOT NULL DEFAULT 0,
+    image_data  BYTEA
+);
+ALTER TABLE product ADD COLUMN IF NOT EXISTS id BIGSERIAL PRIMARY KEY;
+
+CREATE TABLE IF NOT EXISTS orders (
+    id          BIGSERIAL PRIMARY KEY,
+    fullname    TEXT NOT NULL DEFAULT '',
+    mobile      TEXT NOT NULL DEFAULT '',
+    address     TEXT NOT NULL DEFAULT '',
+    item_title  TEXT NOT NULL DEFAULT '',
+    quantity    INTEGER NOT NULL DEFAULT 0,
+    purchase_id BIGINT
+);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS id BIGSERIAL PRIMARY KEY;
+
+CREATE TABLE IF NOT EXISTS cart_items (
+    id         BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ,
+    deleted_at TIMESTAMPTZ,
+    product_id BIGINT,
+    quantity   INTEGER
+);
+CREATE INDEX IF NOT EXISTS idx_cart_items_deleted_at ON cart_items (deleted_at);
+
+CREATE TABLE IF NOT EXISTS passkey_credential (
+    id            BIGSERIAL PRIMARY KEY,
+    account_id    BIGINT NOT NULL REFERENCES account (id) ON DELETE CASCADE,
+    name          TEXT NOT NULL DEFAULT '',
+    credential_id BYTEA NOT NULL UNIQUE,
+    public_key    BYTEA NOT NULL,
+    sign_count    BIGINT NOT NULL DEFAULT 0,
+    aaguid        BYTEA,
+    transports    TEXT NOT NULL DEFAULT '',
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_used_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_passkey_credential_account_id ON passkey_credential (account_id);
+
+CREATE TABLE IF NOT EXISTS external_identity (
+    id         BIGSERIAL PRIMARY KEY,
+    account_id BIGINT NOT NULL REFERENCES account (id) ON DELETE CASCADE,
+    provider   TEXT NOT NULL,
+    subject    TEXT NOT NULL,
+    email      TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_external_identity_subject ON external_identity (provider, subject);
+CREATE INDEX IF NOT EXISTS idx_external_identity_account_id ON external_identity (account_id);
+
+CREATE TABLE IF NOT EXISTS session (
+    id         BIGSERIAL PRIMARY KEY,
+    account_id BIGINT NOT NULL REFERENCES account (id) ON DELETE CASCADE,
+    token_hash TEXT NOT NULL UNIQUE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_session_account_id ON session (account_id);
+
+CREATE TABLE IF NOT EXISTS api_key (
+    id           BIGSERIAL PRIMARY KEY,
+    name         TEXT NOT NULL,
+    prefix       TEXT NOT NULL UNIQUE,
+    key_hash     TEXT NOT NULL,
+    scopes       TEXT NOT NULL DEFAULT '',
+    created_by   BIGINT,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at   TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ
+);
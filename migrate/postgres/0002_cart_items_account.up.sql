@@ -0,0 +1,8 @@
+-- Carts used to live in process memory; they are now stored per account.
+-- Account 0 is the shared cart of anonymous visitors, so there is no FK.
+DELETE FROM cart_items WHERE deleted_at IS NOT NULL;
+DROP INDEX IF EXISTS idx_cart_items_deleted_at;
+ALTER TABLE cart_items DROP COLUMN IF EXISTS deleted_at;
+
+ALTER TABLE cart_items ADD COLUMN IF NOT EXISTS account_id BIGINT NOT NULL DEFAULT 0;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_cart_items_account_product ON cart_items (account_id, product_id);
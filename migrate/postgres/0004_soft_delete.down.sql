@@ -0,0 +1,12 @@
+DELETE FROM account WHERE deleted_at IS NOT NULL;
+DELETE FROM product WHERE deleted_at IS NOT NULL;
+
+DROP INDEX IF EXISTS account_username_lower_key;
+DROP INDEX IF EXISTS account_email_lower_key;
+CREATE UNIQUE INDEX account_username_lower_key ON account (lower(trim(username)));
+CREATE UNIQUE INDEX account_email_lower_key ON account (lower(trim(email))) WHERE email <> '';
+
+DROP INDEX IF EXISTS idx_account_deleted_at;
+DROP INDEX IF EXISTS idx_product_deleted_at;
+ALTER TABLE account DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE product DROP COLUMN IF EXISTS deleted_at;
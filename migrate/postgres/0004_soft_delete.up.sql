@@ -0,0 +1,11 @@
+-- Deleted accounts and products stay in the trash until restored or purged.
+-- Only live rows keep their username and email reserved.
+ALTER TABLE account ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+ALTER TABLE product ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS idx_account_deleted_at ON account (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_product_deleted_at ON product (deleted_at);
+
+DROP INDEX IF EXISTS account_username_lower_key;
+DROP INDEX IF EXISTS account_email_lower_key;
+CREATE UNIQUE INDEX account_username_lower_key ON account (lower(trim(username))) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX account_email_lower_key ON account (lower(trim(email))) WHERE email <> '' AND deleted_at IS NULL;
@@ -0,0 +1,2 @@
+ALTER TABLE account DROP COLUMN IF EXISTS version;
+ALTER TABLE product DROP COLUMN IF EXISTS version;
@@ -0,0 +1,2 @@
+ALTER TABLE account DROP COLUMN IF EXISTS age;
+ALTER TABLE account DROP COLUMN IF EXISTS address;
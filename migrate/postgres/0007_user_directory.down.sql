@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS idx_orders_account_id;
+ALTER TABLE orders DROP COLUMN IF EXISTS account_id;
+
+DROP INDEX IF EXISTS idx_account_created_at;
+ALTER TABLE account DROP COLUMN IF EXISTS created_at;
+ALTER TABLE account DROP COLUMN IF EXISTS last_login_at;
+ALTER TABLE account DROP COLUMN IF EXISTS email_verified_at;
@@ -0,0 +1,9 @@
+-- Stats for the admin user directory. Accounts created before this have no
+-- signup time, and earlier orders belong to no account (0, as for carts).
+ALTER TABLE account ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ;
+ALTER TABLE account ADD COLUMN IF NOT EXISTS last_login_at TIMESTAMPTZ;
+ALTER TABLE account ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS idx_account_created_at ON account (created_at);
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS account_id BIGINT NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS idx_orders_account_id ON orders (account_id);
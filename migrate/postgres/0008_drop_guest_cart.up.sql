@@ -0,0 +1,3 @@
+-- Carts now need a signed-in account. Cart 0, shared by every anonymous
+-- visitor, can't be reached any more.
+DELETE FROM cart_items WHERE account_id = 0;
@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS api_key;
+DROP TABLE IF EXISTS session;
+DROP TABLE IF EXISTS external_identity;
+DROP TABLE IF EXISTS passkey_credential;
+DROP TABLE IF EXISTS cart_items;
+DROP TABLE IF EXISTS orders;
+DROP TABLE IF EXISTS product;
+DROP TABLE IF EXISTS account;
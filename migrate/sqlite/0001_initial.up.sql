@@ -0,0 +1,96 @@
+-- Baseline schema, matching migrate/postgres/0001_initial.up.sql
+
+CREATE TABLE IF NOT EXISTS account (
+    id       INTEGER PRIMARY KEY AUTOINCREMENT,
+    fullname TEXT NOT NULL DEFAULT '',
+    email    TEXT NOT NULL DEFAULT '',
+    username TEXT NOT NULL,
+    password TEXT NOT NULL DEFAULT '',
+    role     TEXT NOT NULL DEFAULT 'user'
+);
+
+-- Trim and dedupe existing rows before indexing them, as for Postgres
+UPDATE account SET username = trim(username), email = trim(email)
+WHERE username <> trim(username) OR email <> trim(email);
+UPDATE account SET username = username || '#dup' || id
+WHERE EXISTS (SELECT 1 FROM account older WHERE lower(older.username) = lower(account.username) AND older.id < account.id);
+UPDATE account SET email = email || '#dup' || id
+WHERE email <> '' AND EXISTS (SELECT 1 FROM account older WHERE lower(older.email) = lower(account.email) AND older.id < account.id);
+
+CREATE UNIQUE INDEX IF NOT EXISTS account_username_lower_key ON account (lower(trim(username)));
+CREATE UNIQUE INDEX IF NOT EXISTS account_email_lower_key ON account (lower(trim(email))) WHERE email <> '';
+
+CREATE TABLE IF NOT EXISTS product (
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    title       TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    price       REAL NOT NULL DEFAULT 0,
+    quantity    INTEGER NOT NULL DEFAULT 0,
+    image_data  BLOB
+);
+
+CREATE TABLE IF NOT EXISTS orders (
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    fullname    TEXT NOT NULL DEFAULT '',
+    mobile      TEXT NOT NULL DEFAULT '',
+    address     TEXT NOT NULL DEFAULT '',
+    item_title  TEXT NOT NULL DEFAULT '',
+    quantity    INTEGER NOT NULL DEFAULT 0,
+    purchase_id INTEGER
+);
+
+CREATE TABLE IF NOT EXISTS cart_items (
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at DATETIME,
+    updated_at DATETIME,
+    deleted_at DATETIME,
+    product_id INTEGER,
+    quantity   INTEGER
+);
+CREATE INDEX IF NOT EXISTS idx_cart_items_deleted_at ON cart_items (deleted_at);
+
+CREATE TABLE IF NOT EXISTS passkey_credential (
+    id            INTEGER PRIMARY KEY AUTOINCREMENT,
+    account_id    INTEGER NOT NULL REFERENCES account (id) ON DELETE CASCADE,
+    name          TEXT NOT NULL DEFAULT '',
+    credential_id BLOB NOT NULL UNIQUE,
+    public_key    BLOB NOT NULL,
+    sign_count    INTEGER NOT NULL DEFAULT 0,
+    aaguid        BLOB,
+    transports    TEXT NOT NULL DEFAULT '',
+    created_at    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used_at  DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_passkey_credential_account_id ON passkey_credential (account_id);
+
+CREATE TABLE IF NOT EXISTS external_identity (
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    account_id INTEGER NOT NULL REFERENCES account (id) ON DELETE CASCADE,
+    provider   TEXT NOT NULL,
+    subject    TEXT NOT NULL,
+    email      TEXT NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_external_identity_subject ON external_identity (provider, subject);
+CREATE INDEX IF NOT EXISTS idx_external_identity_account_id ON external_identity (account_id);
+
+CREATE TABLE IF NOT EXISTS session (
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    account_id INTEGER NOT NULL REFERENCES account (id) ON DELETE CASCADE,
+    token_hash TEXT NOT NULL UNIQUE,
+    expires_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_session_account_id ON session (account_id);
+
+CREATE TABLE IF NOT EXISTS api_key (
+    id           INTEGER PRIMARY KEY AUTOINCREMENT,
+    name         TEXT NOT NULL,
+    prefix       TEXT NOT NULL UNIQUE,
+    key_hash     TEXT NOT NULL,
+    scopes       TEXT NOT NULL DEFAULT '',
+    created_by   INTEGER,
+    created_at   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at   DATETIME,
+    last_used_at DATETIME
+);
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_cart_items_account_product;
+ALTER TABLE cart_items DROP COLUMN account_id;
+
+ALTER TABLE cart_items ADD COLUMN deleted_at DATETIME;
+CREATE INDEX IF NOT EXISTS idx_cart_items_deleted_at ON cart_items (deleted_at);
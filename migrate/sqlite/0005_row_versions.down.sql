@@ -0,0 +1,2 @@
+ALTER TABLE account DROP COLUMN version;
+ALTER TABLE product DROP COLUMN version;
@@ -0,0 +1,4 @@
+-- Every write to an account or product bumps its version, which clients see
+-- as the ETag and send back in If-Match to detect concurrent edits.
+ALTER TABLE account ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE product ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
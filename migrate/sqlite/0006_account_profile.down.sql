@@ -0,0 +1,2 @@
+ALTER TABLE account DROP COLUMN age;
+ALTER TABLE account DROP COLUMN address;
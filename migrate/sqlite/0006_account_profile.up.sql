@@ -0,0 +1,4 @@
+-- Profile fields clients have been sending all along. Age stays NULL until
+-- the user gives it.
+ALTER TABLE account ADD COLUMN age INTEGER;
+ALTER TABLE account ADD COLUMN address TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS idx_orders_account_id;
+ALTER TABLE orders DROP COLUMN account_id;
+
+DROP INDEX IF EXISTS idx_account_created_at;
+ALTER TABLE account DROP COLUMN created_at;
+ALTER TABLE account DROP COLUMN last_login_at;
+ALTER TABLE account DROP COLUMN email_verified_at;
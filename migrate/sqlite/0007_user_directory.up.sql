@@ -0,0 +1,9 @@
+-- Stats for the admin user directory. Accounts created before this have no
+-- signup time, and earlier orders belong to no account (0, as for carts).
+ALTER TABLE account ADD COLUMN created_at DATETIME;
+ALTER TABLE account ADD COLUMN last_login_at DATETIME;
+ALTER TABLE account ADD COLUMN email_verified_at DATETIME;
+CREATE INDEX IF NOT EXISTS idx_account_created_at ON account (created_at);
+
+ALTER TABLE orders ADD COLUMN account_id INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS idx_orders_account_id ON orders (account_id);
@@ -0,0 +1,3 @@
+-- The shared cart's contents are gone; anonymous visitors start from an
+-- empty cart 0 again.
+SELECT 1;
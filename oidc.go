@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/oauth2"
+
+	"m/v2/config"
+	"m/v2/storage"
+)
+
+// How long discovery may take. It runs on first use but outlives the request
+// that triggered it: the provider is cached and refetches its keys later.
+const oidcDiscoveryTimeout = 10 * time.Second
+
+// OIDCProvider is a configured relying party; discovery runs on first use
+type OIDCProvider struct {
+	Config config.OIDCProvider
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+}
+
+func (p *OIDCProvider) discover() (*oidc.Provider, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.provider != nil {
+		return p.provider, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), oidcDiscoveryTimeout)
+	defer cancel()
+	provider, err := oidc.NewProvider(ctx, p.Config.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	p.provider = provider
+	return provider, nil
+}
+
+func (p *OIDCProvider) oauth2Config(provider *oidc.Provider) *oauth2.Config {
+	scopes := p.Config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"profile", "email"}
+	}
+	return &oauth2.Config{
+		ClientID:     p.Config.ClientID,
+		ClientSecret: p.Config.ClientSecret,
+		RedirectURL:  p.Config.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       append([]string{oidc.ScopeOpenID}, scopes...),
+	}
+}
+
+// OIDCStateStore keeps state, nonce and PKCE verifier between redirect and callback
+type OIDCStateStore struct {
+	mu      sync.Mutex
+	pending map[string]oidcPending
+}
+
+type oidcPending struct {
+	provider string
+	nonce    string
+	verifier string
+	expires  time.Time
+}
+
+const oidcStateTTL = 10 * time.Minute
+
+func NewOIDCStateStore() *OIDCStateStore {
+	return &OIDCStateStore{pending: map[string]oidcPending{}}
+}
+
+func (s *OIDCStateStore) put(state string, p oidcPending) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for key, existing := range s.pending {
+		if now.After(existing.expires) {
+			delete(s.pending, key)
+		}
+	}
+	s.pending[state] = p
+}
+
+// take returns the pending login once; states can't be replayed
+func (s *OIDCStateStore) take(state string) (oidcPending, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.pending[state]
+	delete(s.pending, state)
+	if !ok || time.Now().After(p.expires) {
+		return oidcPending{}, false
+	}
+	return p, true
+}
+
+func randomToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// S256 code challenge for PKCE (RFC 7636)
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// NewOIDCProviders sets up a relying party per configured provider
+func NewOIDCProviders(configs []config.OIDCProvider) map[string]*OIDCProvider {
+	providers := map[string]*OIDCProvider{}
+	for _, c := range configs {
+		providers[c.Name] = &OIDCProvider{Config: c}
+	}
+	return providers
+}
+
+// Start an OIDC login by redirecting to the provider
+func (r *Repository) OIDCLogin(context *fiber.Ctx) error {
+	p, ok := r.OIDCProviders[context.Params("provider")]
+	if !ok {
+		return notFound("Unknown identity provider")
+	}
+
+	provider, err := p.discover()
+	if err != nil {
+		return &APIError{Status: http.StatusBadGateway, Code: CodeUpstreamError, Message: "Identity provider unavailable", Err: err}
+	}
+
+	state, err := randomToken()
+	if err != nil {
+		return internalError(err)
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		return internalError(err)
+	}
+	verifier, err := randomToken()
+	if err != nil {
+		return internalError(err)
+	}
+
+	r.OIDCStates.put(state, oidcPending{
+		provider: p.Config.Name,
+		nonce:    nonce,
+		verifier: verifier,
+		expires:  time.Now().Add(oidcStateTTL),
+	})
+
+	authURL := p.oauth2Config(provider).AuthCodeURL(state,
+		oidc.Nonce(nonce),
+		oauth2.SetAuthURLParam("code_challenge", pkceChallenge(verifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	)
+	return context.Redirect(authURL, http.StatusFound)
+}
+
+// Finish an OIDC login: exchange the code, verify the ID token and sign in the linked account
+func (r *Repository) OIDCCallback(context *fiber.Ctx) error {
+	if errorCode := context.Query("error"); errorCode != "" {
+		return unauthorized(CodeInvalidCredentials, "Identity provider login failed").WithDetails(&fiber.Map{"error": errorCode})
+	}
+
+	pending, ok := r.OIDCStates.take(context.Query("state"))
+	if !ok || pending.provider != context.Params("provider") {
+		return badRequest(CodeInvalidRequest, "Unknown or expired login state")
+	}
+
+	p, ok := r.OIDCProviders[pending.provider]
+	if !ok {
+		return notFound("Unknown identity provider")
+	}
+
+	provider, err := p.discover()
+	if err != nil {
+		return &APIError{Status: http.StatusBadGateway, Code: CodeUpstreamError, Message: "Identity provider unavailable", Err: err}
+	}
+
+	token, err := p.oauth2Config(provider).Exchange(context.UserContext(), context.Query("code"),
+		oauth2.SetAuthURLParam("code_verifier", pending.verifier))
+	if err != nil {
+		return unauthorized(CodeInvalidCredentials, "Identity provider login failed")
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return unauthorized(CodeInvalidCredentials, "Identity provider login failed")
+	}
+
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: p.Config.ClientID}).Verify(context.UserContext(), rawIDToken)
+	if err != nil || idToken.Nonce != pending.nonce {
+		return unauthorized(CodeInvalidCredentials, "Identity provider login failed")
+	}
+
+	var claims struct {
+		Email             string `json:"email"`
+		EmailVerified     bool   `json:"email_verified"`
+		Name              string `json:"name"`
+		PreferredUsername string `json:"preferred_username"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return unauthorized(CodeInvalidCredentials, "Identity provider login failed")
+	}
+
+	account, err := r.linkExternalIdentity(context.UserContext(), pending.provider, idToken.Subject, claims.Email, claims.EmailVerified, claims.Name, claims.PreferredUsername)
+	if errors.Is(err, errEmailNotVerified) {
+		return &APIError{Status: http.StatusForbidden, Code: CodeEmailNotVerified, Message: "Identity provider did not verify the email address"}
+	}
+	if errors.Is(err, storage.ErrUnverified) {
+		return &APIError{Status: http.StatusConflict, Code: CodeEmailNotVerified, Message: "An account with this email exists but has not verified it"}
+	}
+	if err != nil {
+		return internalError(err)
+	}
+
+	return r.completeLogin(context, account)
+}
+
+var errEmailNotVerified = errors.New("email not verified by identity provider")
+
+// Find the account for an external identity, linking by verified email or creating one
+func (r *Repository) linkExternalIdentity(ctx context.Context, provider, subject, email string, emailVerified bool, fullname, preferredUsername string) (storage.Account, error) {
+	identity, err := r.Stores.Identities.Find(ctx, provider, subject)
+	if err == nil {
+		return r.Stores.Accounts.Get(ctx, identity.AccountID)
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return storage.Account{}, err
+	}
+
+	// Only a verified email may be used to take over or create an account
+	email = normalizeEmail(email)
+	if email == "" || !emailVerified {
+		return storage.Account{}, errEmailNotVerified
+	}
+
+	// Prefer the IdP's preferred username, else the email local part; the
+	// store appends a number when it is taken
+	username := normalizeUsername(preferredUsername)
+	if username == "" {
+		username = strings.SplitN(email, "@", 2)[0]
+	}
+
+	// No usable password: a new account signs in through the provider only.
+	// Its email counts as verified, since the provider verified it.
+	now := time.Now()
+	return r.Stores.Identities.Link(ctx, storage.ExternalIdentity{
+		Provider:  provider,
+		Subject:   subject,
+		Email:     email,
+		CreatedAt: now,
+	}, storage.Account{
+		Fullname:        fullname,
+		Email:           email,
+		Username:        username,
+		Role:            RoleUser,
+		EmailVerifiedAt: &now,
+	})
+}
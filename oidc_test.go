@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"m/v2/config"
+	"m/v2/storage"
+)
+
+// mockIssuer is an OpenID provider serving discovery, JWKS and a token
+// endpoint that checks PKCE. Tests play the browser: they authorize a code
+// for the redirect the app sent and hand it to the callback.
+type mockIssuer struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu          sync.Mutex
+	codes       map[string]issuedCode
+	discoveries int
+}
+
+// What a code was authorized for
+type issuedCode struct {
+	challenge string
+	claims    map[string]interface{}
+}
+
+const testClientID = "test-client"
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &mockIssuer{t: t, key: key, codes: map[string]issuedCode{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, _ *http.Request) {
+		issuer.mu.Lock()
+		issuer.discoveries++
+		issuer.mu.Unlock()
+		writeJSON(w, map[string]interface{}{
+			"issuer":                                issuer.server.URL,
+			"authorization_endpoint":                issuer.server.URL + "/authorize",
+			"token_endpoint":                        issuer.server.URL + "/token",
+			"jwks_uri":                              issuer.server.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   b64.EncodeToString(key.N.Bytes()),
+			"e":   b64.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", issuer.token)
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+func writeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// Exchange a code for an ID token, only with the PKCE verifier it was
+// authorized for
+func (m *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m.mu.Lock()
+	code, ok := m.codes[r.PostForm.Get("code")]
+	delete(m.codes, r.PostForm.Get("code"))
+	m.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || b64.EncodeToString(sum[:]) != code.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     m.sign(code.claims),
+	})
+}
+
+// An RS256 JWT of claims
+func (m *mockIssuer) sign(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, digest[:])
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	return signed + "." + b64.EncodeToString(signature)
+}
+
+// Authorize the login the app redirected to: a code for the request's PKCE
+// challenge and an ID token for subject, carrying the request's nonce
+func (m *mockIssuer) authorize(authURL *url.URL, subject string, claims map[string]interface{}) string {
+	query := authURL.Query()
+	all := map[string]interface{}{
+		"iss":   m.server.URL,
+		"sub":   subject,
+		"aud":   testClientID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": query.Get("nonce"),
+	}
+	for name, value := range claims {
+		all[name] = value
+	}
+
+	code, err := randomToken()
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	m.mu.Lock()
+	m.codes[code] = issuedCode{challenge: query.Get("code_challenge"), claims: all}
+	m.mu.Unlock()
+	return code
+}
+
+// A test server with the mock issuer configured as provider "mock"
+func newOIDCTestServer(t *testing.T) (*Repository, *fiber.App, *mockIssuer) {
+	r, app := newTestServer(t)
+	issuer := newMockIssuer(t)
+	r.OIDCProviders = NewOIDCProviders([]config.OIDCProvider{{
+		Name:        "mock",
+		Issuer:      issuer.server.URL,
+		ClientID:    testClientID,
+		RedirectURL: testOrigin + "/api/oidc/mock/callback",
+		Scopes:      []string{"email", "profile"},
+	}})
+	return r, app, issuer
+}
+
+// Start a login and return where the app redirected to
+func startOIDCLogin(t *testing.T, app *fiber.App) *url.URL {
+	t.Helper()
+	response, err := app.Test(httptest.NewRequest(http.MethodGet, "/api/oidc/mock/login", nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusFound {
+		t.Fatalf("starting the login: %d", response.StatusCode)
+	}
+	authURL, err := url.Parse(response.Header.Get(fiber.HeaderLocation))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return authURL
+}
+
+func callback(t *testing.T, app *fiber.App, state, code string) (int, []byte) {
+	t.Helper()
+	return call(t, app, http.MethodGet,
+		"/api/oidc/mock/callback?"+url.Values{"state": {state}, "code": {code}}.Encode(), "", nil)
+}
+
+func verifiedEmail(email string) map[string]interface{} {
+	return map[string]interface{}{"email": email, "email_verified": true, "name": "Carol C", "preferred_username": "carol"}
+}
+
+func TestOIDCLoginCreatesAccount(t *testing.T) {
+	_, app, issuer := newOIDCTestServer(t)
+
+	authURL := startOIDCLogin(t, app)
+	query := authURL.Query()
+	if authURL.Scheme+"://"+authURL.Host != issuer.server.URL || authURL.Path != "/authorize" {
+		t.Fatalf("redirected to %s, not the discovered authorization endpoint", authURL)
+	}
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" || query.Get("nonce") == "" {
+		t.Fatalf("authorization request without PKCE or nonce: %s", authURL)
+	}
+
+	code := issuer.authorize(authURL, "subject-1", verifiedEmail("carol@example.com"))
+	status, data := callback(t, app, query.Get("state"), code)
+	var login LoginResponse
+	decode(t, data, &login)
+	if status != http.StatusOK || login.Token == "" {
+		t.Fatalf("callback: %d %s", status, data)
+	}
+
+	status, data = call(t, app, http.MethodGet, "/api/v1/me", login.Token, nil)
+	var me AccountResponse
+	decode(t, data, &me)
+	if status != http.StatusOK || me.Email != "carol@example.com" || me.Username != "carol" || !me.EmailVerified {
+		t.Fatalf("account of the login: %d %s", status, data)
+	}
+
+	// The same subject signs in to the same account
+	authURL = startOIDCLogin(t, app)
+	code = issuer.authorize(authURL, "subject-1", verifiedEmail("carol@example.com"))
+	status, data = callback(t, app, authURL.Query().Get("state"), code)
+	decode(t, data, &login)
+	if status != http.StatusOK {
+		t.Fatalf("second callback: %d %s", status, data)
+	}
+	status, data = call(t, app, http.MethodGet, "/api/v1/me", login.Token, nil)
+	var again AccountResponse
+	decode(t, data, &again)
+	if status != http.StatusOK || again.ID != me.ID {
+		t.Fatalf("second login: %d %s", status, data)
+	}
+
+	// Discovery ran once, outliving the request that triggered it
+	issuer.mu.Lock()
+	defer issuer.mu.Unlock()
+	if issuer.discoveries != 1 {
+		t.Fatalf("discovery ran %d times", issuer.discoveries)
+	}
+}
+
+func TestOIDCStateAndPKCE(t *testing.T) {
+	_, app, issuer := newOIDCTestServer(t)
+
+	t.Run("unknown state", func(t *testing.T) {
+		authURL := startOIDCLogin(t, app)
+		code := issuer.authorize(authURL, "subject-1", verifiedEmail("carol@example.com"))
+		if status, data := callback(t, app, "forged", code); status != http.StatusBadRequest {
+			t.Fatalf("callback: %d %s", status, data)
+		}
+	})
+
+	t.Run("replayed state", func(t *testing.T) {
+		authURL := startOIDCLogin(t, app)
+		state := authURL.Query().Get("state")
+		code := issuer.authorize(authURL, "subject-1", verifiedEmail("carol@example.com"))
+		if status, data := callback(t, app, state, code); status != http.StatusOK {
+			t.Fatalf("callback: %d %s", status, data)
+		}
+		code = issuer.authorize(authURL, "subject-1", verifiedEmail("carol@example.com"))
+		if status, data := callback(t, app, state, code); status != http.StatusBadRequest {
+			t.Fatalf("replayed callback: %d %s", status, data)
+		}
+	})
+
+	t.Run("code for another login", func(t *testing.T) {
+		// A code authorized for one login's PKCE challenge is refused when
+		// redeemed with another login's verifier
+		stolen := startOIDCLogin(t, app)
+		code := issuer.authorize(stolen, "subject-1", verifiedEmail("carol@example.com"))
+		victim := startOIDCLogin(t, app)
+		if status, data := callback(t, app, victim.Query().Get("state"), code); status != http.StatusUnauthorized {
+			t.Fatalf("callback: %d %s", status, data)
+		}
+	})
+
+	t.Run("wrong nonce", func(t *testing.T) {
+		authURL := startOIDCLogin(t, app)
+		claims := verifiedEmail("carol@example.com")
+		claims["nonce"] = "other"
+		code := issuer.authorize(authURL, "subject-1", claims)
+		if status, data := callback(t, app, authURL.Query().Get("state"), code); status != http.StatusUnauthorized {
+			t.Fatalf("callback: %d %s", status, data)
+		}
+	})
+}
+
+func TestOIDCRefusesUnverifiedEmail(t *testing.T) {
+	r, app, issuer := newOIDCTestServer(t)
+
+	authURL := startOIDCLogin(t, app)
+	claims := verifiedEmail("dave@example.com")
+	claims["email_verified"] = false
+	code := issuer.authorize(authURL, "subject-2", claims)
+	status, data := callback(t, app, authURL.Query().Get("state"), code)
+	if status != http.StatusForbidden {
+		t.Fatalf("callback: %d %s", status, data)
+	}
+	if _, err := r.Stores.Accounts.FindByEmail(context.Background(), "dave@example.com"); err != storage.ErrNotFound {
+		t.Fatalf("an account was created: %v", err)
+	}
+}
+
+func TestOIDCLinksExistingAccount(t *testing.T) {
+	r, app, issuer := newOIDCTestServer(t)
+	ctx := context.Background()
+
+	t.Run("verified email", func(t *testing.T) {
+		// A password account, verified by an admin before its owner signs in
+		// with the provider
+		account := createAccount(t, r, "erin", RoleUser)
+		admin := signIn(t, r, createAccount(t, r, "root", RoleAdmin))
+		status, data := call(t, app, http.MethodPost, "/api/v1/users/"+strconv.Itoa(int(account.ID))+"/email-verification", admin, nil)
+		if status != http.StatusOK {
+			t.Fatalf("verifying the email: %d %s", status, data)
+		}
+
+		authURL := startOIDCLogin(t, app)
+		code := issuer.authorize(authURL, "subject-3", verifiedEmail("ERIN@example.com"))
+		status, data = callback(t, app, authURL.Query().Get("state"), code)
+		var login LoginResponse
+		decode(t, data, &login)
+		if status != http.StatusOK {
+			t.Fatalf("callback: %d %s", status, data)
+		}
+		session, err := r.Stores.Sessions.FindValid(ctx, hashToken(login.Token), time.Now())
+		if err != nil || session.AccountID != account.ID {
+			t.Fatalf("signed in to account %d, not %d (%v)", session.AccountID, account.ID, err)
+		}
+	})
+
+	t.Run("unverified email", func(t *testing.T) {
+		account := createAccount(t, r, "frank", RoleUser)
+
+		authURL := startOIDCLogin(t, app)
+		code := issuer.authorize(authURL, "subject-4", verifiedEmail("frank@example.com"))
+		status, data := callback(t, app, authURL.Query().Get("state"), code)
+		if status != http.StatusConflict {
+			t.Fatalf("callback: %d %s", status, data)
+		}
+		after, err := r.Stores.Accounts.Get(ctx, account.ID)
+		if err != nil || after.EmailVerifiedAt != nil {
+			t.Fatalf("linking marked the email verified: %+v %v", after, err)
+		}
+	})
+}
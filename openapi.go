@@ -0,0 +1,591 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// The OpenAPI document is generated at startup from the routes registered on
+// the app and the operations table below; request and response schemas are
+// reflected from the Go types, including their `validate` rules. Every
+// registered route must have an entry, or the server refuses to start.
+
+//go:embed apidocs.html
+var apiDocsPage []byte
+
+// Auth requirements of an operation
+const (
+	authNone     = ""
+	authOptional = "optional" // signed in or anonymous
+	authSession  = "session"  // bearer session token
+	authAdmin    = "admin"    // bearer session token of an admin
+)
+
+// queryParam is a query string parameter of an operation
+type queryParam struct {
+	Name        string
+	Description string
+	Required    bool
+	// Type is the JSON schema type; empty means string
+	Type string
+}
+
+// operation describes one route for the OpenAPI document
+type operation struct {
+	Summary string
+	Tag     string
+	// authNone, authOptional, authSession, authAdmin or a scope
+	Auth  string
+	Query []queryParam
+	// Request is a value of the body type; Multipart sends it as a form
+	// with an "image" file
+	Request   interface{}
+	Multipart bool
+	// Response is a value of the success body type; nil for no body
+	Response    interface{}
+	Status      int
+	ContentType string
+	// Versioned GETs send an ETag and honour If-None-Match; versioned
+	// updates honour If-Match, and require it when IfMatchRequired
+	Versioned       bool
+	IfMatchRequired bool
+	// Paged lists send the number of matches on all pages in X-Total-Count
+	Paged bool
+}
+
+// Bodies of responses built with fiber.Map
+type (
+	CartResponse struct {
+		Message string       `json:"message,omitempty"`
+		Data    map[uint]int `json:"data"`
+	}
+
+	CreatedAPIKeyResponse struct {
+		Message string         `json:"message"`
+		Key     string         `json:"key"`
+		Data    APIKeyResponse `json:"data"`
+	}
+
+	PasskeyCeremonyResponse struct {
+		CeremonyID string                 `json:"ceremony_id"`
+		Options    map[string]interface{} `json:"options"`
+	}
+)
+
+var (
+	usernameQuery   = queryParam{Name: "username", Required: true}
+	titleQuery      = queryParam{Name: "title", Description: "Product title", Required: true}
+	ceremonyIDQuery = queryParam{Name: "ceremony_id", Description: "From the matching begin call", Required: true}
+	fieldsQuery     = queryParam{Name: "fields", Description: "Comma-separated members to send, such as fullname,email; all when absent"}
+)
+
+// Operations by "METHOD path", using Fiber's path syntax
+var operations = map[string]operation{
+	"GET /healthz": {Summary: "Liveness probe", Tag: "Probes", Response: HealthResponse{}},
+	"GET /metrics": {Summary: "Prometheus metrics", Tag: "Probes", ContentType: "text/plain; version=0.0.4"},
+	"GET /readyz":  {Summary: "Readiness probe: database reachable and migrated; 503 otherwise", Tag: "Probes", Response: HealthResponse{}},
+
+	"GET /api/openapi.json": {Summary: "This OpenAPI document", Tag: "Docs", Response: map[string]interface{}{}},
+	"GET /api/docs":         {Summary: "API documentation page", Tag: "Docs", ContentType: fiber.MIMETextHTMLCharsetUTF8},
+
+	// Accounts & sessions
+	"POST /api/v1/accounts":           {Summary: "Register an account", Tag: "Accounts", Request: RegisterRequest{}, Response: Message{}},
+	"POST /api/v1/sessions":           {Summary: "Log in with username or email", Tag: "Accounts", Request: LoginRequest{}, Response: LoginResponse{}},
+	"DELETE /api/v1/sessions/current": {Summary: "Log out", Tag: "Accounts", Auth: authSession, Response: Message{}},
+	"GET /api/v1/me":                  {Summary: "Get the signed-in account", Tag: "Accounts", Auth: authSession, Query: []queryParam{fieldsQuery}, Response: AccountResponse{}, Versioned: true},
+	"PUT /api/v1/me":                  {Summary: "Update the signed-in account", Tag: "Accounts", Auth: authSession, Request: UpdateProfileRequest{}, Response: Message{}, Versioned: true, IfMatchRequired: true},
+	"PATCH /api/v1/me":                {Summary: "Update some fields of the signed-in account", Tag: "Accounts", Auth: authSession, Request: PatchProfileRequest{}, Response: Message{}, Versioned: true, IfMatchRequired: true},
+	"PUT /api/v1/me/password":         {Summary: "Change the signed-in account's password", Tag: "Accounts", Auth: authSession, Request: ChangePasswordRequest{}, Response: Message{}},
+
+	// Passkeys
+	"POST /api/v1/passkeys/registrations":        {Summary: "Begin passkey registration", Tag: "Passkeys", Request: PasskeyBeginRequest{}, Response: PasskeyCeremonyResponse{}},
+	"POST /api/v1/passkeys/registrations/finish": {Summary: "Finish passkey registration", Tag: "Passkeys", Query: []queryParam{ceremonyIDQuery}, Request: map[string]interface{}{}, Response: Message{}},
+	"POST /api/v1/passkeys/logins":               {Summary: "Begin passkey login", Tag: "Passkeys", Request: PasskeyBeginRequest{}, Response: PasskeyCeremonyResponse{}},
+	"POST /api/v1/passkeys/logins/finish":        {Summary: "Finish passkey login", Tag: "Passkeys", Query: []queryParam{ceremonyIDQuery}, Request: map[string]interface{}{}, Response: LoginResponse{}},
+	"GET /api/v1/passkeys":                       {Summary: "List your passkeys", Tag: "Passkeys", Auth: authSession, Response: []PasskeyResponse{}},
+	"DELETE /api/v1/passkeys/:id":                {Summary: "Remove one of your passkeys", Tag: "Passkeys", Auth: authSession, Request: DeletePasskeyRequest{}, Response: Message{}},
+
+	// Users
+	"GET /api/v1/users": {Summary: "Search the user directory", Tag: "Users", Auth: ScopeUsersRead, Query: []queryParam{
+		{Name: "search", Description: "Part of the full name, email or username, ignoring case"},
+		{Name: "role", Description: "user or admin"},
+		{Name: "status", Description: "active (default), deleted or all"},
+		{Name: "verified", Description: "true or false: whether the email is verified, by an identity provider or an admin", Type: "boolean"},
+		{Name: "signed_up_from", Description: "RFC 3339 time, inclusive"},
+		{Name: "signed_up_to", Description: "RFC 3339 time, exclusive"},
+		{Name: "sort", Description: "username, fullname, email, created_at, last_login_at or order_count, prefixed with - for descending (default by ID)"},
+		{Name: "limit", Description: "1 to 500 (default 50)", Type: "integer"},
+		{Name: "offset", Type: "integer"},
+	}, Response: []UserSummaryResponse{}, Paged: true},
+	"GET /api/v1/users/:id":                     {Summary: "Get a user account", Tag: "Users", Auth: ScopeUsersRead, Query: []queryParam{fieldsQuery}, Response: AccountResponse{}, Versioned: true},
+	"PUT /api/v1/users/:id":                     {Summary: "Update a user account", Tag: "Users", Auth: ScopeUsersWrite, Request: UpdateProfileRequest{}, Response: Message{}, Versioned: true, IfMatchRequired: true},
+	"PATCH /api/v1/users/:id":                   {Summary: "Update some fields of a user account", Tag: "Users", Auth: ScopeUsersWrite, Request: PatchProfileRequest{}, Response: Message{}, Versioned: true, IfMatchRequired: true},
+	"DELETE /api/v1/users/:id":                  {Summary: "Delete a user account", Tag: "Users", Auth: ScopeUsersWrite, Response: Message{}},
+	"POST /api/v1/users/:id/email-verification": {Summary: "Mark a user's email verified, so identity providers can sign in to the account", Tag: "Users", Auth: ScopeUsersWrite, Response: Message{}, Versioned: true},
+
+	// Products
+	"GET /api/v1/products":           {Summary: "List products", Tag: "Products", Response: []ProductResponse{}},
+	"POST /api/v1/products":          {Summary: "Add a product with its image", Tag: "Products", Auth: ScopeProductsWrite, Request: ProductRequest{}, Multipart: true, Response: Message{}},
+	"GET /api/v1/products/:id":       {Summary: "Get a product", Tag: "Products", Response: ProductResponse{}, Versioned: true},
+	"PUT /api/v1/products/:id":       {Summary: "Update a product", Tag: "Products", Auth: ScopeProductsWrite, Request: UpdateProductRequest{}, Response: Message{}, Versioned: true, IfMatchRequired: true},
+	"PATCH /api/v1/products/:id":     {Summary: "Update some fields of a product", Tag: "Products", Auth: ScopeProductsWrite, Request: PatchProductRequest{}, Response: Message{}, Versioned: true, IfMatchRequired: true},
+	"DELETE /api/v1/products/:id":    {Summary: "Delete a product", Tag: "Products", Auth: ScopeProductsWrite, Response: Message{}},
+	"GET /api/v1/products/:id/image": {Summary: "Get a product's image", Tag: "Products", ContentType: "image/*"},
+
+	// Trash
+	"GET /api/v1/trash/users":                 {Summary: "List deleted user accounts", Tag: "Trash", Auth: ScopeUsersRead, Response: []AccountResponse{}},
+	"POST /api/v1/trash/users/:id/restore":    {Summary: "Restore a deleted user account", Tag: "Trash", Auth: ScopeUsersWrite, Response: Message{}},
+	"GET /api/v1/trash/products":              {Summary: "List deleted products", Tag: "Trash", Auth: ScopeProductsRead, Response: []ProductResponse{}},
+	"POST /api/v1/trash/products/:id/restore": {Summary: "Restore a deleted product", Tag: "Trash", Auth: ScopeProductsWrite, Response: Message{}},
+
+	// Cart
+	"GET /api/v1/cart":              {Summary: "Get the cart", Tag: "Cart", Auth: authSession, Response: CartResponse{}},
+	"POST /api/v1/cart/items":       {Summary: "Add a product to the cart", Tag: "Cart", Auth: authSession, Request: CartItem{}, Response: CartResponse{}},
+	"DELETE /api/v1/cart/items/:id": {Summary: "Remove a product from the cart", Tag: "Cart", Auth: authSession, Response: CartResponse{}},
+
+	// Orders
+	"GET /api/v1/orders":  {Summary: "List orders", Tag: "Orders", Auth: ScopeOrdersRead, Response: []OrderResponse{}},
+	"POST /api/v1/orders": {Summary: "Submit a purchase", Tag: "Orders", Request: OrderRequest{}, Response: Message{}},
+
+	// API keys
+	"GET /api/v1/api-keys":        {Summary: "List API keys", Tag: "API keys", Auth: authAdmin, Response: []APIKeyResponse{}},
+	"POST /api/v1/api-keys":       {Summary: "Create an API key", Tag: "API keys", Auth: authAdmin, Request: CreateAPIKeyRequest{}, Response: CreatedAPIKeyResponse{}, Status: http.StatusCreated},
+	"DELETE /api/v1/api-keys/:id": {Summary: "Revoke an API key", Tag: "API keys", Auth: authAdmin, Response: Message{}},
+
+	// Operations
+	"GET /api/v1/admin/audit": {Summary: "Query the audit log of privileged changes", Tag: "Operations", Auth: authAdmin, Query: []queryParam{
+		{Name: "actor_type", Description: "account or api_key"},
+		{Name: "actor_id", Type: "integer"},
+		{Name: "action", Description: "Such as user.update or product.delete"},
+		{Name: "target_type", Description: "user, product or api_key"},
+		{Name: "target_id", Type: "integer"},
+		{Name: "from", Description: "RFC 3339 time, inclusive"},
+		{Name: "to", Description: "RFC 3339 time, exclusive"},
+		{Name: "limit", Description: "1 to 1000 (default 100; a CSV export defaults to 10000)", Type: "integer"},
+		{Name: "offset", Type: "integer"},
+		{Name: "format", Description: "json (default) or csv"},
+	}, Response: []AuditEntryResponse{}},
+	"GET /api/v1/admin/slow-queries": {Summary: "List the slowest queries since startup", Tag: "Operations", Auth: authAdmin, Query: []queryParam{{Name: "limit", Description: "At most this many statements, 1 to 100 (default 20)", Type: "integer"}}, Response: SlowQueriesResponse{}},
+
+	// External identity providers
+	"GET /api/oidc/:provider/login":    {Summary: "Redirect to an identity provider", Tag: "Accounts", Status: http.StatusFound},
+	"GET /api/oidc/:provider/callback": {Summary: "Return from an identity provider", Tag: "Accounts", Query: []queryParam{{Name: "state", Required: true}, {Name: "code", Required: true}, {Name: "error"}}, Response: LoginResponse{}},
+
+	// Legacy routes
+	"POST /api/login":                        {Summary: "Log in", Tag: "Legacy", Request: LoginRequest{}, Response: LoginResponse{}},
+	"POST /api/logout":                       {Summary: "Log out", Tag: "Legacy", Auth: authSession, Response: Message{}},
+	"POST /api/passkey/register/begin":       {Summary: "Begin passkey registration", Tag: "Legacy", Request: PasskeyBeginRequest{}, Response: PasskeyCeremonyResponse{}},
+	"POST /api/passkey/register/finish":      {Summary: "Finish passkey registration", Tag: "Legacy", Query: []queryParam{ceremonyIDQuery}, Request: map[string]interface{}{}, Response: Message{}},
+	"POST /api/passkey/login/begin":          {Summary: "Begin passkey login", Tag: "Legacy", Request: PasskeyBeginRequest{}, Response: PasskeyCeremonyResponse{}},
+	"POST /api/passkey/login/finish":         {Summary: "Finish passkey login", Tag: "Legacy", Query: []queryParam{ceremonyIDQuery}, Request: map[string]interface{}{}, Response: LoginResponse{}},
+	"GET /api/passkeys":                      {Summary: "List your passkeys", Tag: "Legacy", Auth: authSession, Response: []PasskeyResponse{}},
+	"DELETE /api/passkeys/:id":               {Summary: "Remove one of your passkeys", Tag: "Legacy", Auth: authSession, Request: DeletePasskeyRequest{}, Response: Message{}},
+	"POST /api/create_account":               {Summary: "Register an account", Tag: "Legacy", Request: RegisterRequest{}, Response: Message{}},
+	"POST /api/add_product":                  {Summary: "Add a product with its image", Tag: "Legacy", Auth: ScopeProductsWrite, Request: ProductRequest{}, Multipart: true, Response: Message{}},
+	"POST /api/submit_purchase":              {Summary: "Submit a purchase", Tag: "Legacy", Request: OrderRequest{}, Response: Message{}},
+	"PUT /api/update_account":                {Summary: "Update the signed-in account", Tag: "Legacy", Auth: authSession, Request: UpdateAccountRequest{}, Response: Message{}, Versioned: true},
+	"PUT /api/update_password":               {Summary: "Change a password", Tag: "Legacy", Request: UpdatePasswordRequest{}, Response: Message{}},
+	"PUT /api/update_user":                   {Summary: "Update a user account", Tag: "Legacy", Auth: ScopeUsersWrite, Request: UpdateUserRequest{}, Response: Message{}, Versioned: true},
+	"PUT /api/update_product_by_title":       {Summary: "Update a product", Tag: "Legacy", Auth: ScopeProductsWrite, Query: []queryParam{titleQuery}, Request: UpdateProductRequest{}, Response: Message{}, Versioned: true},
+	"GET /api/get_user_data":                 {Summary: "Get a user's name and email", Tag: "Legacy", Auth: authSession, Query: []queryParam{usernameQuery}, Response: LegacyUserDataResponse{}},
+	"GET /api/get_userdata":                  {Summary: "Get a user's name and email", Tag: "Legacy", Auth: authSession, Query: []queryParam{usernameQuery}, Response: GetUserDataResponse{}},
+	"GET /api/get_all_accounts":              {Summary: "List user accounts", Tag: "Legacy", Auth: ScopeUsersRead, Response: []AccountResponse{}},
+	"GET /api/get_all_usernames":             {Summary: "List usernames", Tag: "Legacy", Auth: ScopeUsersRead, Response: []string{}},
+	"GET /api/get_all_products":              {Summary: "List products", Tag: "Legacy", Response: []ProductResponse{}},
+	"GET /api/get_all_product_titles":        {Summary: "List product titles", Tag: "Legacy", Response: []string{}},
+	"GET /api/get_product_image":             {Summary: "Get a product's image", Tag: "Legacy", Query: []queryParam{titleQuery}, ContentType: "image/*"},
+	"GET /api/get_all_orders":                {Summary: "List orders", Tag: "Legacy", Auth: ScopeOrdersRead, Response: []OrderResponse{}},
+	"DELETE /api/delete_account":             {Summary: "Delete a user account", Tag: "Legacy", Auth: ScopeUsersWrite, Query: []queryParam{usernameQuery}, Response: Message{}},
+	"DELETE /api/delete_product":             {Summary: "Delete a product", Tag: "Legacy", Auth: ScopeProductsWrite, Query: []queryParam{titleQuery}, Response: Message{}},
+	"POST /api/api_keys":                     {Summary: "Create an API key", Tag: "Legacy", Auth: authAdmin, Request: CreateAPIKeyRequest{}, Response: CreatedAPIKeyResponse{}, Status: http.StatusCreated},
+	"GET /api/api_keys":                      {Summary: "List API keys", Tag: "Legacy", Auth: authAdmin, Response: []APIKeyResponse{}},
+	"DELETE /api/api_keys/:id":               {Summary: "Revoke an API key", Tag: "Legacy", Auth: authAdmin, Response: Message{}},
+	"POST /api/add_to_cart":                  {Summary: "Add a product to the cart", Tag: "Legacy", Auth: authSession, Request: CartItem{}, Response: CartResponse{}},
+	"POST /api/remove_from_cart/:product_id": {Summary: "Remove a product from the cart", Tag: "Legacy", Auth: authSession, Response: CartResponse{}},
+}
+
+// Serve the OpenAPI document
+func (r *Repository) GetOpenAPI(context *fiber.Ctx) error {
+	context.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSONCharsetUTF8)
+	return context.Send(r.OpenAPISpec)
+}
+
+// Serve the API documentation page; it renders /api/openapi.json
+func (r *Repository) GetAPIDocs(context *fiber.Ctx) error {
+	context.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+	return context.Send(apiDocsPage)
+}
+
+// Build the OpenAPI document for the routes registered on app. It fails when
+// a route has no entry in operations, or an entry matches no route.
+func buildOpenAPI(app *fiber.App) ([]byte, error) {
+	builder := &schemaBuilder{components: map[string]interface{}{}}
+	paths := map[string]map[string]interface{}{}
+
+	seen := map[string]bool{}
+	var missing []string
+	for _, route := range app.GetRoutes(true) {
+		// Fiber answers HEAD for every GET route
+		if route.Method == fiber.MethodHead || route.Method == fiber.MethodConnect {
+			continue
+		}
+		key := route.Method + " " + route.Path
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		op, ok := operations[key]
+		if !ok {
+			missing = append(missing, key)
+			continue
+		}
+
+		path, params := openAPIPath(route.Path)
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		paths[path][strings.ToLower(route.Method)] = builder.operation(route, op, params)
+	}
+
+	var stale []string
+	for key := range operations {
+		if !seen[key] {
+			stale = append(stale, key)
+		}
+	}
+	if len(missing) > 0 || len(stale) > 0 {
+		sort.Strings(missing)
+		sort.Strings(stale)
+		return nil, fmt.Errorf("openapi: routes without an operation: %v; operations without a route: %v", missing, stale)
+	}
+
+	builder.components[schemaName(reflect.TypeOf(ErrorResponse{}))] = builder.object(reflect.TypeOf(ErrorResponse{}))
+
+	return json.MarshalIndent(map[string]interface{}{
+		"openapi": "3.1.0",
+		"info": map[string]interface{}{
+			"title":   "log-reg API",
+			"version": "1.0.0",
+			"description": "Routes outside /api/v1 are deprecated and go away after " + legacySunset.Format(time.DateOnly) +
+				" (the Sunset header); each names its successor in a Link header. " +
+				"Failed requests return the Error schema.",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": builder.components,
+			"securitySchemes": map[string]interface{}{
+				"session": map[string]interface{}{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "Session token from logging in",
+				},
+				"apiKey": map[string]interface{}{
+					"type":        "apiKey",
+					"in":          "header",
+					"name":        "Authorization",
+					"description": "ApiKey lr_<prefix>_<secret>",
+				},
+			},
+		},
+	}, "", "  ")
+}
+
+// Convert a Fiber path to OpenAPI form, returning its parameter names
+func openAPIPath(path string) (string, []string) {
+	var params []string
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			name := strings.TrimSuffix(segment[1:], "?")
+			params = append(params, name)
+			segments[i] = "{" + name + "}"
+		}
+	}
+	return strings.Join(segments, "/"), params
+}
+
+var errorRef = map[string]interface{}{"$ref": "#/components/schemas/Error"}
+
+func (b *schemaBuilder) operation(route fiber.Route, op operation, pathParams []string) map[string]interface{} {
+	result := map[string]interface{}{
+		"summary":     op.Summary,
+		"tags":        []string{op.Tag},
+		"operationId": route.Method + strings.NewReplacer("/", "_", ":", "", ".", "_", "-", "_").Replace(route.Path),
+	}
+	if op.Tag == "Legacy" {
+		result["deprecated"] = true
+	}
+
+	var parameters []interface{}
+	for _, name := range pathParams {
+		schema := map[string]interface{}{"type": "string"}
+		if name == "id" || strings.HasSuffix(name, "_id") {
+			schema = map[string]interface{}{"type": "integer", "minimum": 1}
+		}
+		parameters = append(parameters, map[string]interface{}{
+			"name": name, "in": "path", "required": true, "schema": schema,
+		})
+	}
+	for _, query := range op.Query {
+		schemaType := query.Type
+		if schemaType == "" {
+			schemaType = "string"
+		}
+		parameter := map[string]interface{}{
+			"name": query.Name, "in": "query", "required": query.Required,
+			"schema": map[string]interface{}{"type": schemaType},
+		}
+		if query.Description != "" {
+			parameter["description"] = query.Description
+		}
+		parameters = append(parameters, parameter)
+	}
+	if op.Versioned {
+		header, description := fiber.HeaderIfMatch, "Only update if the ETag is still current"
+		if route.Method == fiber.MethodGet {
+			header, description = fiber.HeaderIfNoneMatch, "Answer 304 if the ETag is still current"
+		}
+		if op.IfMatchRequired {
+			description += "; * updates any version"
+		}
+		parameters = append(parameters, map[string]interface{}{
+			"name": header, "in": "header", "required": op.IfMatchRequired, "description": description,
+			"schema": map[string]interface{}{"type": "string"},
+		})
+	}
+	if parameters != nil {
+		result["parameters"] = parameters
+	}
+
+	responses := map[string]interface{}{
+		"default": map[string]interface{}{
+			"description": "Error",
+			"content":     map[string]interface{}{fiber.MIMEApplicationJSON: map[string]interface{}{"schema": errorRef}},
+		},
+	}
+
+	if op.Request != nil {
+		body := b.schema(reflect.TypeOf(op.Request))
+		mediaType := fiber.MIMEApplicationJSON
+		if op.Multipart {
+			body = b.object(reflect.TypeOf(op.Request))
+			properties := body["properties"].(map[string]interface{})
+			// The image is uploaded as a file rather than inline
+			delete(properties, "image_data")
+			properties["image"] = map[string]interface{}{"type": "string", "contentMediaType": "application/octet-stream"}
+			body["required"] = append(body["required"].([]string), "image")
+			mediaType = fiber.MIMEMultipartForm
+		}
+		result["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  map[string]interface{}{mediaType: map[string]interface{}{"schema": body}},
+		}
+		responses["422"] = map[string]interface{}{
+			"description": "Invalid fields, listed in details",
+			"content":     map[string]interface{}{fiber.MIMEApplicationJSON: map[string]interface{}{"schema": errorRef}},
+		}
+	}
+
+	status := op.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]interface{}{"description": http.StatusText(status)}
+	switch {
+	case op.Response != nil:
+		success["content"] = map[string]interface{}{
+			fiber.MIMEApplicationJSON: map[string]interface{}{"schema": b.schema(reflect.TypeOf(op.Response))},
+		}
+	case op.ContentType != "":
+		success["content"] = map[string]interface{}{op.ContentType: map[string]interface{}{}}
+	}
+	if op.Paged {
+		success["headers"] = map[string]interface{}{
+			headerTotalCount: map[string]interface{}{"schema": map[string]interface{}{"type": "integer"}},
+		}
+	}
+	if op.Versioned {
+		if route.Method == fiber.MethodGet {
+			success["headers"] = map[string]interface{}{
+				fiber.HeaderETag: map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+			}
+			responses["304"] = map[string]interface{}{"description": "Not Modified"}
+		} else {
+			responses["412"] = map[string]interface{}{
+				"description": "If-Match names an outdated version",
+				"content":     map[string]interface{}{fiber.MIMEApplicationJSON: map[string]interface{}{"schema": errorRef}},
+			}
+			if op.IfMatchRequired {
+				responses["428"] = map[string]interface{}{
+					"description": "If-Match is missing",
+					"content":     map[string]interface{}{fiber.MIMEApplicationJSON: map[string]interface{}{"schema": errorRef}},
+				}
+			}
+		}
+	}
+	responses[fmt.Sprint(status)] = success
+	result["responses"] = responses
+
+	switch op.Auth {
+	case authNone:
+	case authOptional:
+		result["security"] = []interface{}{map[string]interface{}{}, map[string][]string{"session": {}}}
+	case authSession:
+		result["security"] = []interface{}{map[string][]string{"session": {}}}
+	case authAdmin:
+		result["security"] = []interface{}{map[string][]string{"session": {}}}
+		result["description"] = "Requires an admin session; API keys are refused."
+	default:
+		result["security"] = []interface{}{map[string][]string{"session": {}}, map[string][]string{"apiKey": {}}}
+		result["description"] = "Requires an admin session or an API key with scope " + op.Auth + "."
+	}
+	return result
+}
+
+// schemaBuilder reflects JSON schemas from Go types, collecting named structs
+// as components
+type schemaBuilder struct {
+	components map[string]interface{}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Component name of a struct; Response suffixes are dropped
+func schemaName(t reflect.Type) string {
+	return strings.TrimSuffix(t.Name(), "Response")
+}
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	// An Optional is documented as its value; absent is the default
+	if field, ok := reflect.Zero(t).Interface().(optional); ok {
+		return b.schema(field.valueType())
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		inner := b.schema(t.Elem())
+		if typ, ok := inner["type"].(string); ok {
+			inner["type"] = []string{typ, "null"}
+			return inner
+		}
+		return map[string]interface{}{"oneOf": []interface{}{inner, map[string]interface{}{"type": "null"}}}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		name := schemaName(t)
+		if _, ok := b.components[name]; !ok {
+			// Reserve the name first so recursive types terminate
+			b.components[name] = nil
+			b.components[name] = b.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	// interface{}: any value
+	return map[string]interface{}{}
+}
+
+func (b *schemaBuilder) object(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		property := b.schema(field.Type)
+		if applyRules(property, field.Tag.Get("validate")) {
+			required = append(required, name)
+		}
+		properties[name] = property
+	}
+	return map[string]interface{}{"type": "object", "properties": properties, "required": required}
+}
+
+// Copy validate rules onto a property schema; reports whether it is required
+func applyRules(property map[string]interface{}, rules string) bool {
+	if rules == "" {
+		return false
+	}
+	lengthKeys := map[string]string{"min": "minimum", "max": "maximum"}
+	switch property["type"] {
+	case "string":
+		lengthKeys = map[string]string{"min": "minLength", "max": "maxLength"}
+	case "array":
+		lengthKeys = map[string]string{"min": "minItems", "max": "maxItems"}
+	}
+
+	required := false
+	for _, rule := range strings.Split(rules, ",") {
+		if rule == "dive" {
+			// The remaining rules apply to the elements
+			if items, ok := property["items"].(map[string]interface{}); ok {
+				applyRules(items, strings.SplitN(rules, "dive,", 2)[1])
+			}
+			break
+		}
+		tag, param, _ := strings.Cut(rule, "=")
+		var number interface{}
+		if param != "" {
+			json.Unmarshal([]byte(param), &number)
+		}
+		switch tag {
+		case "required":
+			required = true
+		case "email":
+			property["format"] = "email"
+		case "username":
+			property["pattern"] = usernamePattern.String()
+		case "mobile":
+			property["pattern"] = mobilePattern.String()
+		case "scope":
+			property["enum"] = allScopes
+		case "min", "max":
+			property[lengthKeys[tag]] = number
+		case "gte":
+			property["minimum"] = number
+		case "lte":
+			property["maximum"] = number
+		case "gt":
+			property["exclusiveMinimum"] = number
+		}
+	}
+	return required
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Every route needs an entry in operations; the server refuses to start
+// otherwise, so catch the drift here first
+func TestOpenAPICoversEveryRoute(t *testing.T) {
+	_, app := newTestServer(t)
+	spec, err := buildOpenAPI(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var document struct {
+		Paths map[string]interface{} `json:"paths"`
+	}
+	if err := json.Unmarshal(spec, &document); err != nil {
+		t.Fatal(err)
+	}
+	if len(document.Paths) == 0 {
+		t.Fatal("the document has no paths")
+	}
+}
+
+func TestOpenAPIRejectsUndocumentedRoutes(t *testing.T) {
+	_, app := newTestServer(t)
+	app.Get("/api/v1/undocumented", func(context *fiber.Ctx) error { return nil })
+
+	_, err := buildOpenAPI(app)
+	if err == nil || !strings.Contains(err.Error(), "/api/v1/undocumented") {
+		t.Fatalf("building the document: %v", err)
+	}
+}
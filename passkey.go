@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gofiber/fiber/v2"
+
+	"m/v2/storage"
+)
+
+// Struct PasskeyBeginRequest
+type PasskeyBeginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Name     string `json:"name" validate:"max=100"`
+}
+
+// passkeyUser adapts an account and its stored passkeys to webauthn.User
+type passkeyUser struct {
+	account     storage.Account
+	credentials []storage.PasskeyCredential
+}
+
+func (u *passkeyUser) WebAuthnID() []byte {
+	return passkeyUserHandle(u.account.ID)
+}
+
+func (u *passkeyUser) WebAuthnName() string {
+	return u.account.Username
+}
+
+func (u *passkeyUser) WebAuthnDisplayName() string {
+	if u.account.Fullname != "" {
+		return u.account.Fullname
+	}
+	return u.account.Username
+}
+
+func (u *passkeyUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u *passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, 0, len(u.credentials))
+	for _, stored := range u.credentials {
+		credentials = append(credentials, webauthn.Credential{
+			ID:        stored.CredentialID,
+			PublicKey: stored.PublicKey,
+			Transport: splitTransports(stored.Transports),
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    stored.AAGUID,
+				SignCount: stored.SignCount,
+			},
+		})
+	}
+	return credentials
+}
+
+// The user handle is the account ID, so discoverable logins can find the account
+func passkeyUserHandle(accountID uint) []byte {
+	return []byte(strconv.FormatUint(uint64(accountID), 10))
+}
+
+func joinTransports(transports []protocol.AuthenticatorTransport) string {
+	var buf bytes.Buffer
+	for i, transport := range transports {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(string(transport))
+	}
+	return buf.String()
+}
+
+func splitTransports(transports string) []protocol.AuthenticatorTransport {
+	if transports == "" {
+		return nil
+	}
+	var result []protocol.AuthenticatorTransport
+	for _, transport := range bytes.Split([]byte(transports), []byte(",")) {
+		result = append(result, protocol.AuthenticatorTransport(transport))
+	}
+	return result
+}
+
+// CeremonyStore keeps in-flight WebAuthn session data between begin and finish
+type CeremonyStore struct {
+	mu       sync.Mutex
+	sessions map[string]ceremony
+}
+
+type ceremony struct {
+	session      webauthn.SessionData
+	registration bool
+	accountID    uint
+	name         string
+}
+
+func NewCeremonyStore() *CeremonyStore {
+	return &CeremonyStore{sessions: map[string]ceremony{}}
+}
+
+func (s *CeremonyStore) put(c ceremony) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	id := base64.RawURLEncoding.EncodeToString(raw)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Drop expired ceremonies so abandoned flows don't pile up
+	now := time.Now()
+	for key, existing := range s.sessions {
+		if !existing.session.Expires.IsZero() && now.After(existing.session.Expires) {
+			delete(s.sessions, key)
+		}
+	}
+	s.sessions[id] = c
+	return id, nil
+}
+
+// take returns the ceremony once; a second finish with the same ID fails
+func (s *CeremonyStore) take(id string) (ceremony, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.sessions[id]
+	delete(s.sessions, id)
+	return c, ok
+}
+
+// Load an account and its passkeys
+func (r *Repository) loadPasskeyUser(ctx context.Context, account storage.Account) (*passkeyUser, error) {
+	credentials, err := r.Stores.Passkeys.ListByAccount(ctx, account.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &passkeyUser{account: account, credentials: credentials}, nil
+}
+
+// Begin passkey registration; the account password is required to add a passkey
+func (r *Repository) BeginPasskeyRegistration(context *fiber.Ctx) error {
+	request := PasskeyBeginRequest{}
+	if err := bindBody(context, &request); err != nil {
+		return err
+	}
+
+	account, err := r.Stores.Accounts.FindByUsername(context.UserContext(), request.Username)
+	if errors.Is(err, storage.ErrNotFound) {
+		return errInvalidLogin
+	}
+	if err != nil {
+		return internalError(err)
+	}
+
+	if !r.checkPassword(context.UserContext(), account, request.Password) {
+		return errInvalidLogin
+	}
+
+	user, err := r.loadPasskeyUser(context.UserContext(), account)
+	if err != nil {
+		return internalError(err)
+	}
+
+	// Exclude passkeys the user already has so the same authenticator isn't registered twice
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(user.credentials))
+	for _, credential := range user.WebAuthnCredentials() {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+
+	options, session, err := r.WebAuthn.BeginRegistration(user,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+	)
+	if err != nil {
+		return internalError(err)
+	}
+
+	ceremonyID, err := r.Ceremonies.put(ceremony{session: *session, registration: true, accountID: account.ID, name: request.Name})
+	if err != nil {
+		return internalError(err)
+	}
+
+	return context.JSON(&fiber.Map{
+		"ceremony_id": ceremonyID,
+		"options":     options,
+	})
+}
+
+// Finish passkey registration and store the new credential
+func (r *Repository) FinishPasskeyRegistration(context *fiber.Ctx) error {
+	pending, ok := r.Ceremonies.take(context.Query("ceremony_id"))
+	if !ok || !pending.registration {
+		return badRequest(CodeInvalidRequest, "Unknown or expired passkey ceremony")
+	}
+
+	account, err := r.Stores.Accounts.Get(context.UserContext(), pending.accountID)
+	if err != nil {
+		return storeError(err, "User not found", "")
+	}
+
+	user, err := r.loadPasskeyUser(context.UserContext(), account)
+	if err != nil {
+		return internalError(err)
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(context.Body()))
+	if err != nil {
+		return badRequest(CodeInvalidRequest, "Invalid passkey response")
+	}
+
+	credential, err := r.WebAuthn.CreateCredential(user, pending.session, parsed)
+	if err != nil {
+		return badRequest(CodeInvalidRequest, "Passkey registration failed")
+	}
+
+	name := pending.name
+	if name == "" {
+		name = "Passkey " + strconv.Itoa(len(user.credentials)+1)
+	}
+
+	now := time.Now()
+	stored := storage.PasskeyCredential{
+		AccountID:    account.ID,
+		Name:         name,
+		CredentialID: credential.ID,
+		PublicKey:    credential.PublicKey,
+		SignCount:    credential.Authenticator.SignCount,
+		AAGUID:       credential.Authenticator.AAGUID,
+		Transports:   joinTransports(credential.Transport),
+		CreatedAt:    now,
+		LastUsedAt:   now,
+	}
+
+	err = r.Stores.Passkeys.Create(context.UserContext(), &stored)
+	if err != nil {
+		return storeError(err, "", "Passkey is already registered")
+	}
+
+	return context.Status(http.StatusOK).JSON(
+		&fiber.Map{"message": "Passkey registered successfully", "data": newPasskeyResponse(stored)})
+}
+
+var errPasskeyLogin = unauthorized(CodeInvalidCredentials, "Passkey login failed")
+
+// Begin passkey login; without a username the browser offers any discoverable passkey
+func (r *Repository) BeginPasskeyLogin(context *fiber.Ctx) error {
+	request := PasskeyBeginRequest{}
+	if len(context.Body()) > 0 {
+		if err := bindBody(context, &request); err != nil {
+			return err
+		}
+	}
+
+	var (
+		options   *protocol.CredentialAssertion
+		session   *webauthn.SessionData
+		accountID uint
+		err       error
+	)
+
+	if request.Username == "" {
+		options, session, err = r.WebAuthn.BeginDiscoverableLogin()
+	} else {
+		account, findErr := r.Stores.Accounts.FindByUsername(context.UserContext(), request.Username)
+		if errors.Is(findErr, storage.ErrNotFound) {
+			return errPasskeyLogin
+		}
+		if findErr != nil {
+			return internalError(findErr)
+		}
+
+		user, loadErr := r.loadPasskeyUser(context.UserContext(), account)
+		if loadErr != nil {
+			return internalError(loadErr)
+		}
+		if len(user.credentials) == 0 {
+			return errPasskeyLogin
+		}
+
+		accountID = account.ID
+		options, session, err = r.WebAuthn.BeginLogin(user)
+	}
+
+	if err != nil {
+		return internalError(err)
+	}
+
+	ceremonyID, err := r.Ceremonies.put(ceremony{session: *session, accountID: accountID})
+	if err != nil {
+		return internalError(err)
+	}
+
+	return context.JSON(&fiber.Map{
+		"ceremony_id": ceremonyID,
+		"options":     options,
+	})
+}
+
+// Finish passkey login and update the stored sign count
+func (r *Repository) FinishPasskeyLogin(context *fiber.Ctx) error {
+	pending, ok := r.Ceremonies.take(context.Query("ceremony_id"))
+	if !ok || pending.registration {
+		return badRequest(CodeInvalidRequest, "Unknown or expired passkey ceremony")
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(context.Body()))
+	if err != nil {
+		return badRequest(CodeInvalidRequest, "Invalid passkey response")
+	}
+
+	var user *passkeyUser
+	var credential *webauthn.Credential
+
+	if pending.session.UserID == nil {
+		credential, err = r.WebAuthn.ValidateDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+			accountID, handleErr := strconv.ParseUint(string(userHandle), 10, 64)
+			if handleErr != nil {
+				return nil, handleErr
+			}
+			account, handleErr := r.Stores.Accounts.Get(context.UserContext(), uint(accountID))
+			if handleErr != nil {
+				return nil, handleErr
+			}
+			user, handleErr = r.loadPasskeyUser(context.UserContext(), account)
+			return user, handleErr
+		}, pending.session, parsed)
+	} else {
+		var account storage.Account
+		account, err = r.Stores.Accounts.Get(context.UserContext(), pending.accountID)
+		if err == nil {
+			user, err = r.loadPasskeyUser(context.UserContext(), account)
+		}
+		if err == nil {
+			credential, err = r.WebAuthn.ValidateLogin(user, pending.session, parsed)
+		}
+	}
+
+	if err != nil || user == nil {
+		return errPasskeyLogin
+	}
+
+	// A sign count that didn't move forward means the credential may have been cloned
+	if credential.Authenticator.CloneWarning {
+		return errPasskeyLogin
+	}
+
+	err = r.Stores.Passkeys.RecordUse(context.UserContext(), credential.ID, credential.Authenticator.SignCount, time.Now())
+	if err != nil {
+		return internalError(err)
+	}
+
+	return r.completeLogin(context, user.account)
+}
+
+// List the passkeys of the signed-in account
+func (r *Repository) GetPasskeys(context *fiber.Ctx) error {
+	principal := principalFrom(context)
+	if principal.Account == nil {
+		return forbidden("API keys have no account")
+	}
+
+	user, err := r.loadPasskeyUser(context.UserContext(), *principal.Account)
+	if err != nil {
+		return internalError(err)
+	}
+
+	return context.JSON(newPasskeyResponses(user.credentials))
+}
+
+// Struct DeletePasskeyRequest confirms the removal with the account password
+type DeletePasskeyRequest struct {
+	Password string `json:"password" validate:"required"`
+}
+
+// Remove one of the caller's passkeys; the account password is required
+func (r *Repository) DeletePasskey(context *fiber.Ctx) error {
+	principal := principalFrom(context)
+	if principal.Account == nil {
+		return forbidden("API keys have no account")
+	}
+
+	request := DeletePasskeyRequest{}
+	if err := bindBody(context, &request); err != nil {
+		return err
+	}
+
+	passkeyID, err := strconv.ParseUint(context.Params("id"), 10, 64)
+	if err != nil {
+		return badRequest(CodeInvalidRequest, "Invalid passkey ID")
+	}
+
+	account := *principal.Account
+	if !r.checkPassword(context.UserContext(), account, request.Password) {
+		return errInvalidLogin
+	}
+
+	err = r.Stores.Passkeys.Delete(context.UserContext(), uint(passkeyID), account.ID)
+	if err != nil {
+		return storeError(err, "Passkey not found", "")
+	}
+
+	return context.Status(http.StatusOK).JSON(
+		&fiber.Map{"message": "Passkey deleted successfully"})
+}
+
+// NewWebAuthn builds the relying party from the environment
+func NewWebAuthn(rpID, rpName string, origins []string) (*webauthn.WebAuthn, error) {
+	return webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: rpName,
+		RPOrigins:     origins,
+	})
+}
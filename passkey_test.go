@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/gofiber/fiber/v2"
+)
+
+// softAuthenticator is a software passkey: one P-256 credential answering
+// WebAuthn ceremonies the way a browser and platform authenticator would
+type softAuthenticator struct {
+	t            *testing.T
+	origin       string
+	rpID         string
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialID := make([]byte, 16)
+	if _, err := rand.Read(credentialID); err != nil {
+		t.Fatal(err)
+	}
+	return &softAuthenticator{t: t, origin: testOrigin, rpID: "localhost", key: key, credentialID: credentialID}
+}
+
+// The options of a begin response
+type ceremonyOptions struct {
+	CeremonyID string `json:"ceremony_id"`
+	Options    struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+			User      struct {
+				ID string `json:"id"`
+			} `json:"user"`
+		} `json:"publicKey"`
+	} `json:"options"`
+}
+
+var b64 = base64.RawURLEncoding
+
+func (a *softAuthenticator) clientData(kind, challenge string) []byte {
+	data, err := json.Marshal(map[string]string{"type": kind, "challenge": challenge, "origin": a.origin})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return data
+}
+
+// Authenticator data: RP ID hash, flags (user present and verified, plus
+// attested credential data when given) and the sign count
+func (a *softAuthenticator) authenticatorData(attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	flags := byte(0x01 | 0x04)
+	if attested != nil {
+		flags |= 0x40
+	}
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	return append(data, attested...)
+}
+
+// The body of a registration finish: a "none" attestation of the credential
+func (a *softAuthenticator) create(options ceremonyOptions) map[string]interface{} {
+	a.userHandle, _ = b64.DecodeString(options.Options.PublicKey.User.ID)
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  1, // P-256
+		XCoord: a.key.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	attested := make([]byte, 16) // zero AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialID)))
+	attested = append(attested, a.credentialID...)
+	attested = append(attested, publicKey...)
+
+	attestation, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": a.authenticatorData(attested),
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return map[string]interface{}{
+		"id":    b64.EncodeToString(a.credentialID),
+		"rawId": b64.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64.EncodeToString(a.clientData("webauthn.create", options.Options.PublicKey.Challenge)),
+			"attestationObject": b64.EncodeToString(attestation),
+		},
+	}
+}
+
+// The body of a login finish: an assertion signed by the credential
+func (a *softAuthenticator) get(options ceremonyOptions) map[string]interface{} {
+	a.signCount++
+	authData := a.authenticatorData(nil)
+	clientData := a.clientData("webauthn.get", options.Options.PublicKey.Challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return map[string]interface{}{
+		"id":    b64.EncodeToString(a.credentialID),
+		"rawId": b64.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64.EncodeToString(clientData),
+			"authenticatorData": b64.EncodeToString(authData),
+			"signature":         b64.EncodeToString(signature),
+			"userHandle":        b64.EncodeToString(a.userHandle),
+		},
+	}
+}
+
+// Begin a ceremony, failing the test unless it starts
+func beginCeremony(t *testing.T, app *fiber.App, path string, body interface{}) ceremonyOptions {
+	t.Helper()
+	status, data := call(t, app, http.MethodPost, path, "", body)
+	if status != http.StatusOK {
+		t.Fatalf("POST %s: %d %s", path, status, data)
+	}
+	var options ceremonyOptions
+	decode(t, data, &options)
+	return options
+}
+
+// Register a software passkey for username
+func registerPasskey(t *testing.T, app *fiber.App, username string) *softAuthenticator {
+	t.Helper()
+	authenticator := newSoftAuthenticator(t)
+	options := beginCeremony(t, app, "/api/v1/passkeys/registrations",
+		PasskeyBeginRequest{Username: username, Password: testPassword, Name: "Laptop"})
+	status, data := call(t, app, http.MethodPost,
+		"/api/v1/passkeys/registrations/finish?ceremony_id="+options.CeremonyID, "", authenticator.create(options))
+	if status != http.StatusOK {
+		t.Fatalf("finishing registration: %d %s", status, data)
+	}
+	return authenticator
+}
+
+func TestPasskeyRegisterThenLogin(t *testing.T) {
+	r, app := newTestServer(t)
+	account := createAccount(t, r, "alice", RoleUser)
+	authenticator := registerPasskey(t, app, "alice")
+
+	if status, data := call(t, app, http.MethodGet, "/api/v1/passkeys?username=alice", "", nil); status != http.StatusUnauthorized {
+		t.Fatalf("listing passkeys without a session: %d %s", status, data)
+	}
+	status, data := call(t, app, http.MethodGet, "/api/v1/passkeys", signIn(t, r, account), nil)
+	var passkeys []PasskeyResponse
+	decode(t, data, &passkeys)
+	if status != http.StatusOK || len(passkeys) != 1 || passkeys[0].Name != "Laptop" {
+		t.Fatalf("listing passkeys: %d %s", status, data)
+	}
+
+	for name, body := range map[string]interface{}{
+		"by username":  PasskeyBeginRequest{Username: "alice"},
+		"discoverable": nil,
+	} {
+		t.Run(name, func(t *testing.T) {
+			options := beginCeremony(t, app, "/api/v1/passkeys/logins", body)
+			status, data := call(t, app, http.MethodPost,
+				"/api/v1/passkeys/logins/finish?ceremony_id="+options.CeremonyID, "", authenticator.get(options))
+			var login LoginResponse
+			decode(t, data, &login)
+			if status != http.StatusOK || login.Token == "" {
+				t.Fatalf("finishing login: %d %s", status, data)
+			}
+
+			status, data = call(t, app, http.MethodGet, "/api/v1/me", login.Token, nil)
+			var me AccountResponse
+			decode(t, data, &me)
+			if status != http.StatusOK || me.ID != account.ID {
+				t.Fatalf("session of the passkey login: %d %s", status, data)
+			}
+		})
+	}
+}
+
+func TestPasskeyCeremonyCannotBeReplayed(t *testing.T) {
+	r, app := newTestServer(t)
+	createAccount(t, r, "bob", RoleUser)
+
+	// Registration
+	authenticator := newSoftAuthenticator(t)
+	options := beginCeremony(t, app, "/api/v1/passkeys/registrations",
+		PasskeyBeginRequest{Username: "bob", Password: testPassword})
+	finish := "/api/v1/passkeys/registrations/finish?ceremony_id=" + options.CeremonyID
+	response := authenticator.create(options)
+	if status, data := call(t, app, http.MethodPost, finish, "", response); status != http.StatusOK {
+		t.Fatalf("finishing registration: %d %s", status, data)
+	}
+	if status, data := call(t, app, http.MethodPost, finish, "", response); status != http.StatusBadRequest {
+		t.Fatalf("replayed registration: %d %s", status, data)
+	}
+
+	// Login: the same ceremony twice, then the captured assertion against a
+	// fresh challenge
+	options = beginCeremony(t, app, "/api/v1/passkeys/logins", PasskeyBeginRequest{Username: "bob"})
+	finish = "/api/v1/passkeys/logins/finish?ceremony_id=" + options.CeremonyID
+	assertion := authenticator.get(options)
+	if status, data := call(t, app, http.MethodPost, finish, "", assertion); status != http.StatusOK {
+		t.Fatalf("finishing login: %d %s", status, data)
+	}
+	if status, data := call(t, app, http.MethodPost, finish, "", assertion); status != http.StatusBadRequest {
+		t.Fatalf("replayed login ceremony: %d %s", status, data)
+	}
+
+	fresh := beginCeremony(t, app, "/api/v1/passkeys/logins", PasskeyBeginRequest{Username: "bob"})
+	status, data := call(t, app, http.MethodPost,
+		"/api/v1/passkeys/logins/finish?ceremony_id="+fresh.CeremonyID, "", assertion)
+	if status != http.StatusUnauthorized {
+		t.Fatalf("replayed assertion: %d %s", status, data)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"m/v2/passwords"
+	"m/v2/storage"
+)
+
+// HASH
+func (r *Repository) hashPassword(ctx context.Context, password string) (string, error) {
+	_, span := tracer.Start(ctx, "password.hash", trace.WithAttributes(attribute.String("password.algorithm", r.Hasher.Algorithm)))
+	defer span.End()
+	return r.Hasher.Hash(password)
+}
+
+// Check a password against the account's stored hash. When the hash uses an
+// outdated algorithm or cost it is replaced; a failed rehash doesn't fail the login.
+func (r *Repository) checkPassword(ctx context.Context, account storage.Account, password string) bool {
+	_, span := tracer.Start(ctx, "password.verify")
+	ok, needsRehash, err := r.Hasher.Verify(account.Password, password)
+	span.SetAttributes(attribute.Bool("password.match", ok), attribute.Bool("password.rehash", needsRehash))
+	span.End()
+	if err != nil || !ok {
+		return false
+	}
+
+	if needsRehash {
+		hashed, err := r.hashPassword(ctx, password)
+		if err == nil {
+			err = r.Stores.Accounts.ReplacePassword(ctx, account.ID, account.Password, hashed)
+		}
+		// ErrNotFound: the password changed meanwhile, so there is nothing to upgrade
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			slog.ErrorContext(ctx, "rehashing password", "account_id", account.ID, "err", err)
+		}
+	}
+	return true
+}
+
+// Check a new password against the policy, listing every rule it breaks
+func (r *Repository) checkPasswordPolicy(password, username string) error {
+	err := r.PasswordPolicy.Check(password, username)
+	if err == nil {
+		return nil
+	}
+	var policyErr *passwords.PolicyError
+	if errors.As(err, &policyErr) {
+		return badRequest(CodeWeakPassword, "password does not meet policy").WithDetails(policyErr.Violations)
+	}
+	return internalError(err)
+}
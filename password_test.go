@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"m/v2/passwords"
+)
+
+func TestLoginRehashesPassword(t *testing.T) {
+	r, app := newTestServer(t)
+	account := createAccount(t, r, "bob", RoleUser)
+	if !strings.HasPrefix(account.Password, "$2") {
+		t.Fatalf("stored %q, want a bcrypt hash", account.Password)
+	}
+	stored := func() string {
+		t.Helper()
+		current, err := r.Stores.Accounts.Get(context.Background(), account.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return current.Password
+	}
+	login := func(password string) int {
+		t.Helper()
+		status, _ := call(t, app, http.MethodPost, "/api/v1/sessions", "", LoginRequest{Username: "bob", Password: password})
+		return status
+	}
+
+	// A higher bcrypt cost upgrades the hash on the next login
+	r.Hasher.BcryptCost = bcrypt.MinCost + 1
+	if status := login("wrong-password-1"); status != http.StatusUnauthorized {
+		t.Fatalf("wrong password: %d", status)
+	}
+	if stored() != account.Password {
+		t.Fatal("a failed login rehashed the password")
+	}
+	if status := login(testPassword); status != http.StatusOK {
+		t.Fatalf("login: %d", status)
+	}
+	if cost, err := bcrypt.Cost([]byte(stored())); err != nil || cost != bcrypt.MinCost+1 {
+		t.Fatalf("hash has cost %d (%v) after login, want %d", cost, err, bcrypt.MinCost+1)
+	}
+
+	// Switching to argon2id replaces the bcrypt hash
+	r.Hasher.Algorithm = passwords.Argon2id
+	r.Hasher.Argon2 = passwords.Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+	if status := login(testPassword); status != http.StatusOK {
+		t.Fatalf("login: %d", status)
+	}
+	upgraded := stored()
+	if !strings.HasPrefix(upgraded, "$argon2id$") {
+		t.Fatalf("stored %q after login, want an argon2id hash", upgraded)
+	}
+
+	// The new hash works and is left alone
+	if status := login(testPassword); status != http.StatusOK {
+		t.Fatalf("login with the upgraded hash: %d", status)
+	}
+	if stored() != upgraded {
+		t.Fatal("an up-to-date hash was replaced")
+	}
+}
@@ -0,0 +1,137 @@
+package passwords
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Cheap parameters keep the tests fast
+var (
+	testBcrypt = Hasher{Algorithm: Bcrypt, BcryptCost: bcrypt.MinCost}
+	testArgon2 = Hasher{Algorithm: Argon2id, Argon2: Argon2Params{
+		Memory:      64,
+		Iterations:  1,
+		Parallelism: 1,
+		SaltLength:  16,
+		KeyLength:   32,
+	}}
+)
+
+func TestHashRoundTrip(t *testing.T) {
+	phc := regexp.MustCompile(`^\$argon2id\$v=19\$m=64,t=1,p=1\$[A-Za-z0-9+/]{22}\$[A-Za-z0-9+/]{43}$`)
+
+	for name, hasher := range map[string]Hasher{Bcrypt: testBcrypt, Argon2id: testArgon2} {
+		t.Run(name, func(t *testing.T) {
+			encoded, err := hasher.Hash("correct-horse-42")
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch name {
+			case Bcrypt:
+				if cost, err := bcrypt.Cost([]byte(encoded)); err != nil || cost != bcrypt.MinCost {
+					t.Fatalf("bcrypt hash %q has cost %d (%v)", encoded, cost, err)
+				}
+			case Argon2id:
+				if !phc.MatchString(encoded) {
+					t.Fatalf("argon2id hash %q is not in PHC format", encoded)
+				}
+			}
+
+			if again, _ := hasher.Hash("correct-horse-42"); again == encoded {
+				t.Fatal("two hashes of a password are the same; the salt is not random")
+			}
+			if ok, needsRehash, err := hasher.Verify(encoded, "correct-horse-42"); !ok || needsRehash || err != nil {
+				t.Fatalf("Verify(right password) = %v, %v, %v", ok, needsRehash, err)
+			}
+			if ok, needsRehash, err := hasher.Verify(encoded, "correct-horse-43"); ok || needsRehash || err != nil {
+				t.Fatalf("Verify(wrong password) = %v, %v, %v", ok, needsRehash, err)
+			}
+		})
+	}
+}
+
+func TestVerifyNeedsRehash(t *testing.T) {
+	bcryptHash, err := testBcrypt.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	argon2Hash, err := testArgon2.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stronger := testArgon2
+	stronger.Argon2.Iterations = 2
+	longerKey := testArgon2
+	longerKey.Argon2.KeyLength = 64
+	costlier := testBcrypt
+	costlier.BcryptCost = bcrypt.MinCost + 1
+
+	tests := []struct {
+		name    string
+		hasher  Hasher
+		encoded string
+		rehash  bool
+	}{
+		{"bcrypt at the configured cost", testBcrypt, bcryptHash, false},
+		{"bcrypt below the configured cost", costlier, bcryptHash, true},
+		{"bcrypt when argon2id is configured", testArgon2, bcryptHash, true},
+		{"argon2id with the configured parameters", testArgon2, argon2Hash, false},
+		{"argon2id with fewer iterations", stronger, argon2Hash, true},
+		{"argon2id with a shorter key", longerKey, argon2Hash, true},
+		{"argon2id when bcrypt is configured", testBcrypt, argon2Hash, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ok, needsRehash, err := test.hasher.Verify(test.encoded, "secret")
+			if !ok || err != nil || needsRehash != test.rehash {
+				t.Fatalf("Verify = %v, %v, %v; want true, %v, nil", ok, needsRehash, err, test.rehash)
+			}
+		})
+	}
+}
+
+func TestVerifyMalformedHashes(t *testing.T) {
+	valid, err := testArgon2.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(valid, "$")
+
+	for name, encoded := range map[string]string{
+		"unknown algorithm":   "$scrypt$ln=15,r=8,p=1$c2FsdA$a2V5",
+		"plain text":          "secret",
+		"missing a part":      strings.Join(parts[:5], "$"),
+		"other version":       strings.Replace(valid, "v=19", "v=16", 1),
+		"bad parameters":      strings.Replace(valid, parts[3], "m=x,t=1,p=1", 1),
+		"salt not base64":     strings.Replace(valid, parts[4], "!!!", 1),
+		"empty key":           strings.Join(append(parts[:5:5], ""), "$"),
+		"truncated bcrypt":    "$2a$04$short",
+		"bcrypt cost too big": "$2a$99$" + strings.Repeat("a", 53),
+	} {
+		t.Run(name, func(t *testing.T) {
+			ok, needsRehash, err := testArgon2.Verify(encoded, "secret")
+			if ok || needsRehash || err == nil {
+				t.Fatalf("Verify(%q) = %v, %v, %v; want an error", encoded, ok, needsRehash, err)
+			}
+		})
+	}
+
+	// Accounts without a password never match, and that is not an error
+	if ok, _, err := testArgon2.Verify("", ""); ok || err != nil {
+		t.Fatalf(`Verify("", "") = %v, %v`, ok, err)
+	}
+	if _, _, err := testArgon2.Verify("$scrypt$", "secret"); !errors.Is(err, ErrUnknownHash) {
+		t.Fatalf("unknown format: %v, want ErrUnknownHash", err)
+	}
+}
+
+func TestHashUnknownAlgorithm(t *testing.T) {
+	if _, err := (Hasher{Algorithm: "md5"}).Hash("secret"); err == nil {
+		t.Fatal("hashed with an unsupported algorithm")
+	}
+}
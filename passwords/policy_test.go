@@ -0,0 +1,77 @@
+package passwords
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestPolicyRules(t *testing.T) {
+	strict := Policy{
+		MinLength:      10,
+		RequireUpper:   true,
+		RequireLower:   true,
+		RequireDigit:   true,
+		RequireSymbol:  true,
+		RejectCommon:   true,
+		RejectUsername: true,
+	}
+
+	tests := []struct {
+		name       string
+		policy     Policy
+		password   string
+		username   string
+		violations []string
+	}{
+		{"meets every rule", strict, "Tr0ub4dor&3x", "alice", nil},
+		{"too short", strict, "Sh0rt&x", "alice", []string{"must be at least 10 characters"}},
+		{"length counts characters, not bytes", Policy{MinLength: 4}, "ééé", "", []string{"must be at least 4 characters"}},
+		{"no uppercase", strict, "tr0ub4dor&3x", "alice", []string{"must contain an uppercase letter"}},
+		{"no lowercase", strict, "TR0UB4DOR&3X", "alice", []string{"must contain a lowercase letter"}},
+		{"no digit", strict, "Troubador&xx", "alice", []string{"must contain a digit"}},
+		{"no symbol", strict, "Tr0ub4dor3xy", "alice", []string{"must contain a symbol"}},
+		{"space counts as a symbol", strict, "Tr0ub4dor 3x", "alice", nil},
+		{"common password", Policy{RejectCommon: true}, "qwerty", "", []string{"is too common"}},
+		{"common password in other case", Policy{RejectCommon: true}, "PassWord", "", []string{"is too common"}},
+		{"contains the username", strict, "Alice&Tr0ub4", "alice", []string{"must not contain the username"}},
+		{"username is matched trimmed and ignoring case", strict, "xALICEx&Tr0ub4", " Alice ", []string{"must not contain the username"}},
+		{"no username given", strict, "Alice&Tr0ub4", "", nil},
+		{"rules that are off are not checked", Policy{}, "a", "a", nil},
+		{"every violation is listed", strict, "qwerty", "qwerty", []string{
+			"must be at least 10 characters",
+			"must contain an uppercase letter",
+			"must contain a digit",
+			"must contain a symbol",
+			"is too common",
+			"must not contain the username",
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.policy.Check(test.password, test.username)
+			if test.violations == nil {
+				if err != nil {
+					t.Fatalf("Check(%q) = %v, want nil", test.password, err)
+				}
+				return
+			}
+			var policyErr *PolicyError
+			if !errors.As(err, &policyErr) {
+				t.Fatalf("Check(%q) = %v, want a *PolicyError", test.password, err)
+			}
+			if !reflect.DeepEqual(policyErr.Violations, test.violations) {
+				t.Fatalf("Check(%q) violations = %q, want %q", test.password, policyErr.Violations, test.violations)
+			}
+		})
+	}
+}
+
+func TestDefaultPolicy(t *testing.T) {
+	if err := DefaultPolicy.Check("correct-horse-42", "alice"); err != nil {
+		t.Fatalf("a good password was refused: %v", err)
+	}
+	if err := DefaultPolicy.Check("password1", "alice"); err == nil {
+		t.Fatal("a common password was accepted")
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"m/v2/storage"
+)
+
+// PATCH bodies tell a field that is absent (left unchanged) from one set to
+// zero, empty or null. Their fields are Optional; rules in `validate` tags
+// apply to the value of fields that are present, so start them with
+// omitempty. Null is only accepted where the value is a pointer.
+
+// Optional is a field of a PATCH body
+type Optional[T any] struct {
+	Set   bool
+	Null  bool
+	Value T
+}
+
+func (o *Optional[T]) UnmarshalJSON(data []byte) error {
+	o.Set = true
+	o.Null = string(data) == "null"
+	if o.Null {
+		var zero T
+		o.Value = zero
+		return nil
+	}
+	return json.Unmarshal(data, &o.Value)
+}
+
+// Field is the storage patch field writing the value, if present
+func (o Optional[T]) Field() storage.Field[T] {
+	return storage.Field[T]{Set: o.Set, Value: o.Value}
+}
+
+// optional is implemented by every Optional, for the validator and the
+// OpenAPI builder
+type optional interface {
+	// The value to validate: nil when absent or null, otherwise a pointer to
+	// the value, so omitempty only skips absent fields
+	validationValue() interface{}
+	// Set to null although T can't hold it
+	invalidNull() bool
+	valueType() reflect.Type
+}
+
+func (o Optional[T]) validationValue() interface{} {
+	if !o.Set || o.Null {
+		return nil
+	}
+	return &o.Value
+}
+
+func (o Optional[T]) invalidNull() bool {
+	return o.Null && o.valueType().Kind() != reflect.Ptr
+}
+
+func (o Optional[T]) valueType() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
+
+// Every Optional used in a request, for the validator
+var optionalTypes = []interface{}{
+	Optional[string]{},
+	Optional[int]{},
+	Optional[*int]{},
+	Optional[float64]{},
+	Optional[[]byte]{},
+}
+
+// A field written only when value isn't zero, for PUT-style updates that
+// leave zero fields unchanged
+func setIfNonZero[T comparable](value T) storage.Field[T] {
+	var zero T
+	return storage.Field[T]{Set: value != zero, Value: value}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+
+	"m/v2/storage"
+)
+
+func TestPatchTellsAbsentFromZero(t *testing.T) {
+	servers := map[string]func(t *testing.T) (*Repository, *fiber.App){
+		"memory": newTestServer,
+		"sqlite": func(t *testing.T) (*Repository, *fiber.App) { return newSQLiteTestServer(t) },
+	}
+	for name, newServer := range servers {
+		t.Run(name, func(t *testing.T) {
+			r, app := newServer(t)
+			admin := signIn(t, r, createAccount(t, r, "admin", RoleAdmin))
+			bob := signIn(t, r, createAccount(t, r, "bob", RoleUser))
+			product := storage.Product{Title: "Lamp", Description: "Bright", Price: 10, Quantity: 5}
+			if err := r.Stores.Products.Create(context.Background(), &product); err != nil {
+				t.Fatal(err)
+			}
+			productPath := "/api/v1/products/" + strconv.Itoa(int(product.ID))
+			anyVersion := map[string]string{fiber.HeaderIfMatch: "*"}
+
+			write := func(method, path, token string, body interface{}) {
+				t.Helper()
+				if response, data := send(t, app, method, path, token, anyVersion, body); response.StatusCode != http.StatusOK {
+					t.Fatalf("%s %s %v: %d %s", method, path, body, response.StatusCode, data)
+				}
+			}
+			me := func() AccountResponse {
+				t.Helper()
+				var account AccountResponse
+				_, data := call(t, app, http.MethodGet, "/api/v1/me", bob, nil)
+				decode(t, data, &account)
+				return account
+			}
+			lamp := func() ProductResponse {
+				t.Helper()
+				var response ProductResponse
+				_, data := call(t, app, http.MethodGet, productPath, "", nil)
+				decode(t, data, &response)
+				return response
+			}
+			age := func(account AccountResponse) string {
+				if account.Age == nil {
+					return "null"
+				}
+				return strconv.Itoa(*account.Age)
+			}
+			checkMe := func(step, fullname, address, wantAge string) {
+				t.Helper()
+				account := me()
+				if account.Fullname != fullname || account.Address != address || age(account) != wantAge {
+					t.Errorf("%s: %q %q age %s, want %q %q age %s", step, account.Fullname, account.Address, age(account), fullname, address, wantAge)
+				}
+			}
+
+			write(http.MethodPut, "/api/v1/me", bob, map[string]interface{}{"fullname": "Bob B", "age": 30, "address": "1 Main St"})
+			checkMe("PUT", "Bob B", "1 Main St", "30")
+
+			// Absent fields are left alone
+			write(http.MethodPatch, "/api/v1/me", bob, map[string]interface{}{})
+			checkMe("empty PATCH", "Bob B", "1 Main St", "30")
+
+			// Zero and empty values are written
+			write(http.MethodPatch, "/api/v1/me", bob, map[string]interface{}{"age": 0})
+			checkMe("age 0", "Bob B", "1 Main St", "0")
+			write(http.MethodPatch, "/api/v1/me", bob, map[string]interface{}{"address": ""})
+			checkMe("empty address", "Bob B", "", "0")
+
+			// null clears the age, and is refused where there is nothing to clear
+			write(http.MethodPatch, "/api/v1/me", bob, map[string]interface{}{"age": nil})
+			checkMe("null age", "Bob B", "", "null")
+			response, data := send(t, app, http.MethodPatch, "/api/v1/me", bob, anyVersion, map[string]interface{}{"fullname": nil})
+			checkErrorEnvelope(t, response, data, http.StatusUnprocessableEntity, CodeValidationFailed)
+			checkMe("null fullname", "Bob B", "", "null")
+
+			// PUT leaves zero values alone, so it can't do what PATCH just did
+			write(http.MethodPut, "/api/v1/me", bob, map[string]interface{}{"fullname": "", "age": 0})
+			checkMe("PUT with zero values", "Bob B", "", "null")
+
+			// The same for products, through the admin's PATCH
+			write(http.MethodPatch, productPath, admin, map[string]interface{}{"quantity": 0})
+			if got := lamp(); got.Quantity != 0 || got.Price != 10 || got.Description != "Bright" || got.Title != "Lamp" {
+				t.Errorf("quantity 0: %+v", got)
+			}
+			write(http.MethodPatch, productPath, admin, map[string]interface{}{"price": 0, "description": ""})
+			if got := lamp(); got.Quantity != 0 || got.Price != 0 || got.Description != "" || got.Title != "Lamp" {
+				t.Errorf("free and undescribed: %+v", got)
+			}
+			write(http.MethodPatch, productPath, admin, map[string]interface{}{"title": "Desk lamp"})
+			if got := lamp(); got.Quantity != 0 || got.Price != 0 || got.Description != "" || got.Title != "Desk lamp" {
+				t.Errorf("renamed: %+v", got)
+			}
+		})
+	}
+}
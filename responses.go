@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"m/v2/storage"
+)
+
+// Response types. Handlers return these instead of the storage structs so
+// password hashes, confirm_password and raw image bytes never reach clients.
+
+// Struct AccountResponse; DeletedAt is only set for accounts in the trash.
+// Version is what the ETag of the account carries.
+type AccountResponse struct {
+	ID            uint       `json:"id"`
+	Fullname      string     `json:"fullname"`
+	Email         string     `json:"email"`
+	Username      string     `json:"username"`
+	Role          string     `json:"role"`
+	EmailVerified bool       `json:"email_verified"`
+	Age           *int       `json:"age"`
+	Address       string     `json:"address"`
+	Version       int        `json:"version"`
+	DeletedAt     *time.Time `json:"deleted_at,omitempty"`
+}
+
+func newAccountResponse(account storage.Account) AccountResponse {
+	return AccountResponse{
+		ID:            account.ID,
+		Fullname:      account.Fullname,
+		Email:         account.Email,
+		Username:      account.Username,
+		Role:          account.Role,
+		EmailVerified: account.EmailVerifiedAt != nil,
+		Age:           account.Age,
+		Address:       account.Address,
+		Version:       account.Version,
+		DeletedAt:     account.DeletedAt,
+	}
+}
+
+func newAccountResponses(accounts []storage.Account) []AccountResponse {
+	responses := make([]AccountResponse, 0, len(accounts))
+	for _, account := range accounts {
+		responses = append(responses, newAccountResponse(account))
+	}
+	return responses
+}
+
+// Struct ProductResponse; the image is fetched separately from ImageURL.
+// DeletedAt is only set for products in the trash. Version is what the ETag
+// of the product carries.
+type ProductResponse struct {
+	ID          uint       `json:"id"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	Price       float64    `json:"price"`
+	Quantity    int        `json:"quantity"`
+	ImageURL    string     `json:"image_url,omitempty"`
+	Version     int        `json:"version"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+}
+
+func newProductResponse(product storage.Product) ProductResponse {
+	response := ProductResponse{
+		ID:          product.ID,
+		Title:       product.Title,
+		Description: product.Description,
+		Price:       product.Price,
+		Quantity:    product.Quantity,
+		Version:     product.Version,
+		DeletedAt:   product.DeletedAt,
+	}
+	// Product lists only flag images with a non-nil, empty slice
+	if product.ImageData != nil {
+		response.ImageURL = "/api/v1/products/" + strconv.FormatUint(uint64(product.ID), 10) + "/image"
+	}
+	return response
+}
+
+func newProductResponses(products []storage.Product) []ProductResponse {
+	responses := make([]ProductResponse, 0, len(products))
+	for _, product := range products {
+		responses = append(responses, newProductResponse(product))
+	}
+	return responses
+}
+
+// Struct OrderResponse
+type OrderResponse struct {
+	ID        uint   `json:"id"`
+	Fullname  string `json:"fullname"`
+	Mobile    string `json:"mobile"`
+	Address   string `json:"address"`
+	ItemTitle string `json:"itemTitle"`
+	Quantity  int    `json:"quantity"`
+}
+
+func newOrderResponse(order storage.Order) OrderResponse {
+	return OrderResponse{
+		ID:        order.ID,
+		Fullname:  order.Fullname,
+		Mobile:    order.Mobile,
+		Address:   order.Address,
+		ItemTitle: order.ItemTitle,
+		Quantity:  order.Quantity,
+	}
+}
+
+func newOrderResponses(orders []storage.Order) []OrderResponse {
+	responses := make([]OrderResponse, 0, len(orders))
+	for _, order := range orders {
+		responses = append(responses, newOrderResponse(order))
+	}
+	return responses
+}
+
+// Struct PasskeyResponse; key material stays on the server
+type PasskeyResponse struct {
+	ID         uint      `json:"id"`
+	AccountID  uint      `json:"account_id"`
+	Name       string    `json:"name"`
+	SignCount  uint32    `json:"sign_count"`
+	Transports string    `json:"transports"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+func newPasskeyResponse(credential storage.PasskeyCredential) PasskeyResponse {
+	return PasskeyResponse{
+		ID:         credential.ID,
+		AccountID:  credential.AccountID,
+		Name:       credential.Name,
+		SignCount:  credential.SignCount,
+		Transports: credential.Transports,
+		CreatedAt:  credential.CreatedAt,
+		LastUsedAt: credential.LastUsedAt,
+	}
+}
+
+func newPasskeyResponses(credentials []storage.PasskeyCredential) []PasskeyResponse {
+	responses := make([]PasskeyResponse, 0, len(credentials))
+	for _, credential := range credentials {
+		responses = append(responses, newPasskeyResponse(credential))
+	}
+	return responses
+}
+
+// Struct APIKeyResponse; the key hash is never returned
+type APIKeyResponse struct {
+	ID         uint       `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     string     `json:"scopes"`
+	CreatedBy  uint       `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+func newAPIKeyResponse(key storage.APIKey) APIKeyResponse {
+	return APIKeyResponse{
+		ID:         key.ID,
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		Scopes:     key.Scopes,
+		CreatedBy:  key.CreatedBy,
+		CreatedAt:  key.CreatedAt,
+		ExpiresAt:  key.ExpiresAt,
+		LastUsedAt: key.LastUsedAt,
+	}
+}
+
+func newAPIKeyResponses(keys []storage.APIKey) []APIKeyResponse {
+	responses := make([]APIKeyResponse, 0, len(keys))
+	for _, key := range keys {
+		responses = append(responses, newAPIKeyResponse(key))
+	}
+	return responses
+}
+
+// Sparse fieldsets: a fields=a,b query parameter picks which members of a
+// response are sent. Without it the whole response is.
+func sparse(context *fiber.Ctx, response interface{}) (interface{}, error) {
+	requested := context.Query("fields")
+	if requested == "" {
+		return response, nil
+	}
+
+	members := jsonMembers(reflect.TypeOf(response))
+	var fields []string
+	for _, field := range strings.Split(requested, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !slices.Contains(members, field) {
+			return nil, invalidField("fields", "has unknown field "+strconv.Quote(field)+"; use "+strings.Join(members, ", "))
+		}
+		fields = append(fields, field)
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, internalError(err)
+	}
+	// Members left out by omitempty stay out
+	selected := map[string]json.RawMessage{}
+	for _, field := range fields {
+		if value, ok := all[field]; ok {
+			selected[field] = value
+		}
+	}
+	return selected, nil
+}
+
+// The JSON member names of a struct type, in field order
+func jsonMembers(t reflect.Type) []string {
+	var members []string
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			members = append(members, name)
+		}
+	}
+	return members
+}
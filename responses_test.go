@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Keys no response may carry
+var secretKeys = []string{"password", "password_hash", "confirm_password"}
+
+// The path of the first secret key in a decoded JSON value, or ""
+func findSecretKey(value interface{}, path string) string {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, member := range value {
+			for _, secret := range secretKeys {
+				if key == secret {
+					return path + "." + key
+				}
+			}
+			if found := findSecretKey(member, path+"."+key); found != "" {
+				return found
+			}
+		}
+	case []interface{}:
+		for i, element := range value {
+			if found := findSecretKey(element, path+"["+strconv.Itoa(i)+"]"); found != "" {
+				return found
+			}
+		}
+	}
+	return ""
+}
+
+func TestAccountResponsesHaveNoPassword(t *testing.T) {
+	r, app := newTestServer(t)
+	admin := createAccount(t, r, "admin", RoleAdmin)
+	user := createAccount(t, r, "bob", RoleUser)
+	deleted := createAccount(t, r, "carl", RoleUser)
+	if err := r.Stores.Accounts.Delete(context.Background(), deleted.ID); err != nil {
+		t.Fatal(err)
+	}
+	token := signIn(t, r, admin)
+
+	// Writes whose responses and audit entries are checked too
+	writes := []struct {
+		method, path string
+		body         interface{}
+	}{
+		{http.MethodPost, "/api/v1/accounts", RegisterRequest{Username: "dora", Email: "dora@example.com", Password: testPassword, Confirm_Password: testPassword}},
+		{http.MethodPost, "/api/v1/sessions", LoginRequest{Username: "bob", Password: testPassword}},
+		{http.MethodPatch, "/api/v1/users/" + strconv.Itoa(int(user.ID)), map[string]string{"fullname": "Bob B"}},
+		{http.MethodPut, "/api/v1/me", map[string]string{"fullname": "Admin A"}},
+	}
+	for _, write := range writes {
+		response, data := send(t, app, write.method, write.path, token, map[string]string{fiber.HeaderIfMatch: "*"}, write.body)
+		if status := response.StatusCode; status != http.StatusOK {
+			t.Fatalf("%s %s: %d %s", write.method, write.path, status, data)
+		}
+		checkNoSecrets(t, write.method+" "+write.path, data)
+	}
+
+	reads := []string{
+		"/api/v1/me",
+		"/api/v1/users",
+		"/api/v1/users?status=all",
+		"/api/v1/users/" + strconv.Itoa(int(user.ID)),
+		"/api/v1/trash/users",
+		"/api/v1/admin/audit",
+		"/api/get_all_accounts",
+		"/api/get_user_data?username=bob",
+		"/api/get_userdata?username=bob",
+	}
+	for _, path := range reads {
+		status, data := call(t, app, http.MethodGet, path, token, nil)
+		if status != http.StatusOK {
+			t.Fatalf("GET %s: %d %s", path, status, data)
+		}
+		checkNoSecrets(t, "GET "+path, data)
+	}
+}
+
+func checkNoSecrets(t *testing.T, request string, data []byte) {
+	t.Helper()
+	var value interface{}
+	decode(t, data, &value)
+	if found := findSecretKey(value, ""); found != "" {
+		t.Errorf("%s responds with %s: %s", request, found, json.RawMessage(data))
+	}
+}
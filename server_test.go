@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"m/v2/migrate"
+	"m/v2/passwords"
+	"m/v2/storage"
+)
+
+// Test servers run the whole API against the memory stores
+
+const (
+	testOrigin   = "http://localhost"
+	testPassword = "correct-horse-42"
+)
+
+func newTestServer(t *testing.T) (*Repository, *fiber.App) {
+	t.Helper()
+	webAuthn, err := NewWebAuthn("localhost", "Test", []string{testOrigin})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The cheapest bcrypt cost keeps the tests fast
+	hasher := passwords.DefaultHasher
+	hasher.BcryptCost = 4
+
+	r := &Repository{
+		Stores:         storage.NewMemory(),
+		WebAuthn:       webAuthn,
+		Ceremonies:     NewCeremonyStore(),
+		OIDCProviders:  map[string]*OIDCProvider{},
+		OIDCStates:     NewOIDCStateStore(),
+		PasswordPolicy: passwords.DefaultPolicy,
+		Hasher:         hasher,
+		SessionTTL:     time.Hour,
+		MaxImageBytes:  1 << 20,
+	}
+	app := fiber.New(fiber.Config{ErrorHandler: ErrorHandler})
+	app.Use(RequestID)
+	r.SetupRoutes(app)
+	return r, app
+}
+
+// A test server on a new SQLite database, brought up to date by the
+// migrations after running the seed statements on the empty file
+func newSQLiteTestServer(t *testing.T, seed ...string) (*Repository, *fiber.App) {
+	t.Helper()
+	conn, err := storage.NewSQLiteConnection(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	for _, statement := range seed {
+		if err := conn.Exec(statement).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	migrator, err := migrate.New(conn.DB(), "sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	r, app := newTestServer(t)
+	r.Stores = storage.NewSQL(conn)
+	return r, app
+}
+
+// Store an account with testPassword
+func createAccount(t *testing.T, r *Repository, username, role string) storage.Account {
+	t.Helper()
+	return storeAccount(t, r, storage.Account{
+		Fullname: "User " + username,
+		Email:    username + "@example.com",
+		Username: username,
+		Role:     role,
+	})
+}
+
+// Store account as given, with testPassword
+func storeAccount(t *testing.T, r *Repository, account storage.Account) storage.Account {
+	t.Helper()
+	hash, err := r.Hasher.Hash(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account.Password = hash
+	if err := r.Stores.Accounts.Create(context.Background(), &account); err != nil {
+		t.Fatal(err)
+	}
+	return account
+}
+
+// A session token for account
+func signIn(t *testing.T, r *Repository, account storage.Account) string {
+	t.Helper()
+	response, err := r.issueSession(context.Background(), account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response.Token
+}
+
+// Send a request with an optional JSON body and bearer token, returning the
+// status and response body
+func call(t *testing.T, app *fiber.App, method, path, token string, body interface{}) (int, []byte) {
+	t.Helper()
+	response, data := send(t, app, method, path, token, nil, body)
+	return response.StatusCode, data
+}
+
+// Send a request like call, with extra headers, returning the whole response
+func send(t *testing.T, app *fiber.App, method, path, token string, headers map[string]string, body interface{}) (*http.Response, []byte) {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	request := httptest.NewRequest(method, path, reader)
+	if body != nil {
+		request.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	}
+	if token != "" {
+		request.Header.Set(fiber.HeaderAuthorization, "Bearer "+token)
+	}
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+
+	response, err := app.Test(request, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response, data
+}
+
+// Decode a response body into out
+func decode(t *testing.T, data []byte, out interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(data, out); err != nil {
+		t.Fatalf("decoding %s: %v", data, err)
+	}
+}
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// QueryObserver is told about every gorm query once it finishes. Operation is
+// create, query, row_query, update or delete; failed reports an error other
+// than a missing row.
+type QueryObserver func(operation, table string, duration time.Duration, failed bool)
+
+// InstrumentQueries times every query made through conn with observe. Raw
+// statements run with Exec bypass gorm's callbacks and are not seen.
+func InstrumentQueries(conn *gorm.DB, observe QueryObserver) {
+	timeQueries(conn, "instrument", func(scope *gorm.Scope, operation string, duration time.Duration) {
+		failed := scope.HasError() && !gorm.IsRecordNotFoundError(scope.DB().Error)
+		observe(operation, scope.TableName(), duration, failed)
+	})
+}
+
+// timeQueries registers callbacks, named after prefix, that call done with
+// the duration of every create, query, row query, update and delete
+func timeQueries(conn *gorm.DB, prefix string, done func(scope *gorm.Scope, operation string, duration time.Duration)) {
+	startKey := prefix + ":start"
+	start := func(scope *gorm.Scope) {
+		scope.Set(startKey, time.Now())
+	}
+	finish := func(operation string) func(scope *gorm.Scope) {
+		return func(scope *gorm.Scope) {
+			started, ok := scope.Get(startKey)
+			if !ok {
+				return
+			}
+			done(scope, operation, time.Since(started.(time.Time)))
+		}
+	}
+
+	callbacks := conn.Callback()
+	callbacks.Create().Before("gorm:begin_transaction").Register(prefix+":start_create", start)
+	callbacks.Create().After("gorm:commit_or_rollback_transaction").Register(prefix+":finish_create", finish("create"))
+	callbacks.Query().Before("gorm:query").Register(prefix+":start_query", start)
+	callbacks.Query().After("gorm:after_query").Register(prefix+":finish_query", finish("query"))
+	callbacks.RowQuery().Before("gorm:row_query").Register(prefix+":start_row_query", start)
+	callbacks.RowQuery().After("gorm:row_query").Register(prefix+":finish_row_query", finish("row_query"))
+	callbacks.Update().Before("gorm:begin_transaction").Register(prefix+":start_update", start)
+	callbacks.Update().After("gorm:commit_or_rollback_transaction").Register(prefix+":finish_update", finish("update"))
+	callbacks.Delete().Before("gorm:begin_transaction").Register(prefix+":start_delete", start)
+	callbacks.Delete().After("gorm:commit_or_rollback_transaction").Register(prefix+":finish_delete", finish("delete"))
+}
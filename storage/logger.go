@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// The request context rides along on the gorm handle, so callbacks can log
+// with the request and trace IDs
+const contextKey = "storage:ctx"
+
+func withContext(ctx context.Context, db *gorm.DB) *gorm.DB {
+	return db.Set(contextKey, ctx)
+}
+
+// The context a query was made with; Background for queries made outside
+// the stores, such as migrations
+func scopeContext(scope *gorm.Scope) context.Context {
+	if ctx, ok := scope.Get(contextKey); ok {
+		return ctx.(context.Context)
+	}
+	return context.Background()
+}
+
+// logErrors logs failed queries made through conn. Missing rows and unique
+// violations are expected; the stores report them as ErrNotFound and
+// ErrConflict.
+func logErrors(conn *gorm.DB) {
+	timeQueries(conn, "errors", func(scope *gorm.Scope, operation string, duration time.Duration) {
+		err := scope.DB().Error
+		if err == nil || gorm.IsRecordNotFoundError(err) || IsUniqueViolation(err) {
+			return
+		}
+		slog.ErrorContext(scopeContext(scope), "database error",
+			"operation", operation, "table", scope.TableName(), "err", err)
+	})
+}
+
+// gormLogger sends gorm's output to slog instead of stdout. Query arguments
+// are never logged; they hold passwords, emails and phone numbers.
+type gormLogger struct{}
+
+// gorm calls Print with ("sql", source, duration, query, args, rows) for
+// queries in debug mode and (level, source, messages...) otherwise. Errors
+// are left to logErrors, which has the request context.
+func (gormLogger) Print(values ...interface{}) {
+	if len(values) >= 6 && values[0] == "sql" {
+		slog.Debug("query", "source", fmt.Sprint(values[1]), "duration", values[2], "sql", values[3], "rows", values[5])
+	}
+}
@@ -0,0 +1,101 @@
+package storage_test
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"m/v2/storage"
+)
+
+type requestKey struct{}
+
+// Collects the contexts of the records logged at level or above
+type contextRecorder struct {
+	level slog.Level
+
+	mu       sync.Mutex
+	messages map[string][]context.Context
+}
+
+func (h *contextRecorder) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *contextRecorder) Handle(ctx context.Context, record slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.messages[record.Message] = append(h.messages[record.Message], ctx)
+	return nil
+}
+
+func (h *contextRecorder) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *contextRecorder) WithGroup(string) slog.Handler      { return h }
+
+func (h *contextRecorder) requests(message string) []interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var requests []interface{}
+	for _, ctx := range h.messages[message] {
+		requests = append(requests, ctx.Value(requestKey{}))
+	}
+	return requests
+}
+
+func TestQueryLogsCarryContext(t *testing.T) {
+	recorder := &contextRecorder{level: slog.LevelWarn, messages: map[string][]context.Context{}}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(recorder))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	conn := newSQLite(t)
+	storage.NewSlowQueryLog(0).Attach(conn)
+	stores := storage.NewSQL(conn)
+	ctx := context.WithValue(context.Background(), requestKey{}, "req-1")
+
+	// Slow queries, and expected errors that aren't logged
+	if _, err := stores.Accounts.Get(ctx, 42); err != storage.ErrNotFound {
+		t.Fatalf("Get = %v, want ErrNotFound", err)
+	}
+	account := storage.Account{Username: "ann", Role: "user"}
+	if err := stores.Accounts.Create(ctx, &account); err != nil {
+		t.Fatal(err)
+	}
+	duplicate := storage.Account{Username: "ANN", Role: "user"}
+	if err := stores.Accounts.Create(ctx, &duplicate); err != storage.ErrConflict {
+		t.Fatalf("Create = %v, want ErrConflict", err)
+	}
+	if requests := recorder.requests("database error"); len(requests) != 0 {
+		t.Fatalf("expected errors were logged: %v", requests)
+	}
+	slow := recorder.requests("slow query")
+	if len(slow) == 0 {
+		t.Fatal("no slow queries logged")
+	}
+	for _, request := range slow {
+		if request != "req-1" {
+			t.Fatalf("slow query logged with request %v", request)
+		}
+	}
+
+	// A failing query, also inside a transaction
+	if err := conn.Exec("DROP TABLE audit_log").Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stores.Audit.List(ctx, storage.AuditFilter{}); err == nil {
+		t.Fatal("listing a dropped table worked")
+	}
+	txCtx := context.WithValue(context.Background(), requestKey{}, "req-2")
+	err := stores.Tx.Run(txCtx, func(tx storage.Stores) error {
+		return tx.Audit.Append(txCtx, &storage.AuditEntry{Action: "user.create", CreatedAt: time.Now()})
+	})
+	if err == nil {
+		t.Fatal("appending to a dropped table worked")
+	}
+	requests := recorder.requests("database error")
+	if len(requests) != 2 || requests[0] != "req-1" || requests[1] != "req-2" {
+		t.Fatalf("database errors logged with requests %v, want [req-1 req-2]", requests)
+	}
+}
@@ -0,0 +1,973 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"maps"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewMemory returns stores that keep everything in process memory. They
+// follow the same uniqueness and not-found rules as the database stores, so
+// the whole API can run (and be tested) without a database.
+func NewMemory() Stores {
+	m := &memory{
+		accounts: map[uint]Account{},
+		products: map[uint]Product{},
+		trash: trash{
+			accounts: map[uint]Account{},
+			products: map[uint]Product{},
+		},
+		orders:     map[uint]Order{},
+		carts:      map[uint]map[uint]int{},
+		passkeys:   map[uint]PasskeyCredential{},
+		identities: map[uint]ExternalIdentity{},
+		sessions:   map[string]Session{},
+		apiKeys:    map[uint]APIKey{},
+	}
+	return m.stores(memTx{m: m})
+}
+
+func (m *memory) stores(tx memTx) Stores {
+	return Stores{
+		Accounts:   memAccounts{m},
+		Products:   memProducts{m},
+		Orders:     memOrders{m},
+		Carts:      memCarts{m},
+		Passkeys:   memPasskeys{m},
+		Identities: memIdentities{m},
+		Sessions:   memSessions{m},
+		APIKeys:    memAPIKeys{m},
+		Audit:      memAudit{m},
+		Tx:         tx,
+	}
+}
+
+// One lock for everything keeps multi-table operations such as Link atomic
+type memory struct {
+	mu     sync.Mutex
+	txMu   sync.Mutex // held for the whole of a Tx.Run
+	nextID uint
+
+	accounts   map[uint]Account
+	products   map[uint]Product
+	orders     map[uint]Order
+	carts      map[uint]map[uint]int
+	passkeys   map[uint]PasskeyCredential
+	identities map[uint]ExternalIdentity
+	sessions   map[string]Session
+	apiKeys    map[uint]APIKey
+	audit      []AuditEntry
+
+	// Deleted rows are moved here, out of sight of everything but the
+	// trash methods
+	trash trash
+}
+
+type trash struct {
+	accounts map[uint]Account
+	products map[uint]Product
+}
+
+func (m *memory) id() uint {
+	m.nextID++
+	return m.nextID
+}
+
+func fold(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+func sortedIDs[T any](rows map[uint]T) []uint {
+	ids := make([]uint, 0, len(rows))
+	for id := range rows {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+type memAccounts struct{ m *memory }
+
+// Callers hold the lock
+func (s memAccounts) conflict(account Account, except uint) bool {
+	for id, existing := range s.m.accounts {
+		if id == except {
+			continue
+		}
+		if account.Username != "" && fold(existing.Username) == fold(account.Username) {
+			return true
+		}
+		if account.Email != "" && fold(existing.Email) == fold(account.Email) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s memAccounts) find(match func(Account) bool) (Account, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	for _, id := range sortedIDs(s.m.accounts) {
+		if account := s.m.accounts[id]; match(account) {
+			return account, nil
+		}
+	}
+	return Account{}, ErrNotFound
+}
+
+func (s memAccounts) Create(ctx context.Context, account *Account) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	if s.conflict(*account, 0) {
+		return ErrConflict
+	}
+	account.ID = s.m.id()
+	account.Version = 1
+	account.CreatedAt = now()
+	s.m.accounts[account.ID] = *account
+	return nil
+}
+
+func (s memAccounts) Get(ctx context.Context, id uint) (Account, error) {
+	return s.find(func(a Account) bool { return a.ID == id })
+}
+
+func (s memAccounts) FindByUsername(ctx context.Context, username string) (Account, error) {
+	return s.find(func(a Account) bool { return fold(a.Username) == fold(username) })
+}
+
+func (s memAccounts) FindByEmail(ctx context.Context, email string) (Account, error) {
+	return s.find(func(a Account) bool { return fold(a.Email) == fold(email) })
+}
+
+func (s memAccounts) FindByLogin(ctx context.Context, login string) (Account, error) {
+	return s.find(func(a Account) bool { return fold(a.Username) == fold(login) || fold(a.Email) == fold(login) })
+}
+
+func (s memAccounts) Update(ctx context.Context, id uint, version int, patch AccountPatch) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	account, ok := s.m.accounts[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if version != 0 && account.Version != version {
+		return ErrStale
+	}
+	if patch.Age.Set && patch.Age.Value != nil {
+		age := *patch.Age.Value
+		patch.Age.Value = &age
+	}
+	if patch.Email.Set && fold(patch.Email.Value) != fold(account.Email) {
+		account.EmailVerifiedAt = nil
+	}
+	patch.apply(&account)
+	if s.conflict(account, id) {
+		return ErrConflict
+	}
+	account.Version++
+	s.m.accounts[id] = account
+	return nil
+}
+
+func (s memAccounts) SetPassword(ctx context.Context, id uint, hash string) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	account, ok := s.m.accounts[id]
+	if !ok {
+		return ErrNotFound
+	}
+	account.Password = hash
+	s.m.accounts[id] = account
+	return nil
+}
+
+func (s memAccounts) ReplacePassword(ctx context.Context, id uint, current, replacement string) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	account, ok := s.m.accounts[id]
+	if !ok || account.Password != current {
+		return ErrNotFound
+	}
+	account.Password = replacement
+	s.m.accounts[id] = account
+	return nil
+}
+
+func (s memAccounts) Delete(ctx context.Context, id uint) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	account, ok := s.m.accounts[id]
+	if !ok {
+		return ErrNotFound
+	}
+	account.DeletedAt = now()
+	delete(s.m.accounts, id)
+	s.m.trash.accounts[id] = account
+
+	for hash, session := range s.m.sessions {
+		if session.AccountID == id {
+			delete(s.m.sessions, hash)
+		}
+	}
+	return nil
+}
+
+func (s memAccounts) List(ctx context.Context) ([]Account, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	accounts := []Account{}
+	for _, id := range sortedIDs(s.m.accounts) {
+		accounts = append(accounts, s.m.accounts[id])
+	}
+	return accounts, nil
+}
+
+func (s memAccounts) Usernames(ctx context.Context) ([]string, error) {
+	accounts, _ := s.List(ctx)
+	usernames := make([]string, 0, len(accounts))
+	for _, account := range accounts {
+		usernames = append(usernames, account.Username)
+	}
+	return usernames, nil
+}
+
+func (s memAccounts) ListDeleted(ctx context.Context) ([]Account, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	accounts := []Account{}
+	for _, id := range sortedIDs(s.m.trash.accounts) {
+		accounts = append(accounts, s.m.trash.accounts[id])
+	}
+	sort.SliceStable(accounts, func(i, j int) bool {
+		return accounts[i].DeletedAt.After(*accounts[j].DeletedAt)
+	})
+	return accounts, nil
+}
+
+func (s memAccounts) Restore(ctx context.Context, id uint) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	account, ok := s.m.trash.accounts[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if s.conflict(account, id) {
+		return ErrConflict
+	}
+	account.DeletedAt = nil
+	delete(s.m.trash.accounts, id)
+	s.m.accounts[id] = account
+	return nil
+}
+
+func (s memAccounts) Purge(ctx context.Context, cutoff time.Time) (int64, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	var purged int64
+	for id, account := range s.m.trash.accounts {
+		if !account.DeletedAt.Before(cutoff) {
+			continue
+		}
+		delete(s.m.trash.accounts, id)
+		purged++
+
+		// Same cascade as the foreign keys
+		for passkeyID, passkey := range s.m.passkeys {
+			if passkey.AccountID == id {
+				delete(s.m.passkeys, passkeyID)
+			}
+		}
+		for identityID, identity := range s.m.identities {
+			if identity.AccountID == id {
+				delete(s.m.identities, identityID)
+			}
+		}
+
+		// As the SQL stores do by hand
+		delete(s.m.carts, id)
+		for orderID, order := range s.m.orders {
+			if order.AccountID == id {
+				order.AccountID = 0
+				s.m.orders[orderID] = order
+			}
+		}
+	}
+	return purged, nil
+}
+
+func (s memAccounts) RecordLogin(ctx context.Context, id uint, at time.Time) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	account, ok := s.m.accounts[id]
+	if !ok {
+		return ErrNotFound
+	}
+	at = at.UTC()
+	account.LastLoginAt = &at
+	s.m.accounts[id] = account
+	return nil
+}
+
+func (s memAccounts) VerifyEmail(ctx context.Context, id uint, version int, at time.Time) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	account, ok := s.m.accounts[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if version != 0 && account.Version != version {
+		return ErrStale
+	}
+	at = at.UTC()
+	account.EmailVerifiedAt = &at
+	account.Version++
+	s.m.accounts[id] = account
+	return nil
+}
+
+func (s memAccounts) Directory(ctx context.Context, filter AccountFilter) ([]AccountSummary, int64, error) {
+	field, descending, ok := parseSort(filter.Sort, AccountSorts)
+	if !ok {
+		return nil, 0, ErrInvalidSort
+	}
+
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	orderCounts := map[uint]int64{}
+	for _, order := range s.m.orders {
+		orderCounts[order.AccountID]++
+	}
+
+	search := strings.ToLower(filter.Search)
+	summaries := []AccountSummary{}
+	for _, rows := range []map[uint]Account{s.m.accounts, s.m.trash.accounts} {
+		for _, account := range rows {
+			deleted, verified := account.DeletedAt != nil, account.EmailVerifiedAt != nil
+			switch {
+			case search != "" &&
+				!strings.Contains(strings.ToLower(account.Fullname), search) &&
+				!strings.Contains(strings.ToLower(account.Email), search) &&
+				!strings.Contains(strings.ToLower(account.Username), search),
+				filter.Role != "" && account.Role != filter.Role,
+				filter.Deleted != nil && deleted != *filter.Deleted,
+				filter.Verified != nil && verified != *filter.Verified,
+				!filter.SignedUpFrom.IsZero() && (account.CreatedAt == nil || account.CreatedAt.Before(filter.SignedUpFrom)),
+				!filter.SignedUpTo.IsZero() && (account.CreatedAt == nil || !account.CreatedAt.Before(filter.SignedUpTo)):
+				continue
+			}
+			summaries = append(summaries, AccountSummary{Account: account, OrderCount: orderCounts[account.ID]})
+		}
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		a, b := summaries[i], summaries[j]
+		if order := compareSummaries(a, b, field); order != 0 {
+			return order < 0 != (descending && !unknownTime(a, b, field))
+		}
+		return a.ID < b.ID
+	})
+
+	total := int64(len(summaries))
+	if filter.Offset >= len(summaries) {
+		return []AccountSummary{}, total, nil
+	}
+	summaries = summaries[filter.Offset:]
+	if filter.Limit > 0 && len(summaries) > filter.Limit {
+		summaries = summaries[:filter.Limit]
+	}
+	return summaries, total, nil
+}
+
+// Order two directory entries by field, ascending, with unknown times last
+func compareSummaries(a, b AccountSummary, field string) int {
+	switch field {
+	case "username":
+		return strings.Compare(strings.ToLower(a.Username), strings.ToLower(b.Username))
+	case "fullname":
+		return strings.Compare(strings.ToLower(a.Fullname), strings.ToLower(b.Fullname))
+	case "email":
+		return strings.Compare(strings.ToLower(a.Email), strings.ToLower(b.Email))
+	case "created_at":
+		return compareTimes(a.CreatedAt, b.CreatedAt)
+	case "last_login_at":
+		return compareTimes(a.LastLoginAt, b.LastLoginAt)
+	case "order_count":
+		return int(a.OrderCount - b.OrderCount)
+	}
+	return 0
+}
+
+func compareTimes(a, b *time.Time) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return 1
+	case b == nil:
+		return -1
+	}
+	return a.Compare(*b)
+}
+
+// Whether one of the two has an unknown time for field, which sorts last
+// whatever the direction
+func unknownTime(a, b AccountSummary, field string) bool {
+	switch field {
+	case "created_at":
+		return a.CreatedAt == nil || b.CreatedAt == nil
+	case "last_login_at":
+		return a.LastLoginAt == nil || b.LastLoginAt == nil
+	}
+	return false
+}
+
+type memProducts struct{ m *memory }
+
+func (s memProducts) Create(ctx context.Context, product *Product) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	product.ID = s.m.id()
+	product.Version = 1
+	stored := *product
+	stored.ImageData = cloneBytes(product.ImageData)
+	s.m.products[product.ID] = stored
+	return nil
+}
+
+func (s memProducts) Get(ctx context.Context, id uint) (Product, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	product, ok := s.m.products[id]
+	if !ok {
+		return Product{}, ErrNotFound
+	}
+	product.ImageData = cloneBytes(product.ImageData)
+	return product, nil
+}
+
+func (s memProducts) FindByTitle(ctx context.Context, title string) (Product, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	for _, id := range sortedIDs(s.m.products) {
+		if product := s.m.products[id]; product.Title == title {
+			product.ImageData = cloneBytes(product.ImageData)
+			return product, nil
+		}
+	}
+	return Product{}, ErrNotFound
+}
+
+func (s memProducts) Update(ctx context.Context, id uint, version int, patch ProductPatch) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	product, ok := s.m.products[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if version != 0 && product.Version != version {
+		return ErrStale
+	}
+	patch.ImageData.Value = cloneBytes(patch.ImageData.Value)
+	patch.apply(&product)
+	product.Version++
+	s.m.products[id] = product
+	return nil
+}
+
+func (s memProducts) TakeStock(ctx context.Context, id uint, quantity int) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	product, ok := s.m.products[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if product.Quantity < quantity {
+		return ErrOutOfStock
+	}
+	product.Quantity -= quantity
+	product.Version++
+	s.m.products[id] = product
+	return nil
+}
+
+func (s memProducts) Delete(ctx context.Context, id uint) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	product, ok := s.m.products[id]
+	if !ok {
+		return ErrNotFound
+	}
+	now := time.Now()
+	product.DeletedAt = &now
+	delete(s.m.products, id)
+	s.m.trash.products[id] = product
+	return nil
+}
+
+func (s memProducts) List(ctx context.Context) ([]Product, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	products := []Product{}
+	for _, id := range sortedIDs(s.m.products) {
+		product := s.m.products[id]
+		if len(product.ImageData) > 0 {
+			product.ImageData = []byte{}
+		} else {
+			product.ImageData = nil
+		}
+		products = append(products, product)
+	}
+	return products, nil
+}
+
+func (s memProducts) Titles(ctx context.Context) ([]string, error) {
+	products, _ := s.List(ctx)
+	titles := make([]string, 0, len(products))
+	for _, product := range products {
+		titles = append(titles, product.Title)
+	}
+	return titles, nil
+}
+
+func (s memProducts) Image(ctx context.Context, id uint) ([]byte, error) {
+	product, err := s.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(product.ImageData) == 0 {
+		return nil, ErrNotFound
+	}
+	return product.ImageData, nil
+}
+
+func (s memProducts) ListDeleted(ctx context.Context) ([]Product, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	products := []Product{}
+	for _, id := range sortedIDs(s.m.trash.products) {
+		product := s.m.trash.products[id]
+		product.ImageData = nil
+		products = append(products, product)
+	}
+	sort.SliceStable(products, func(i, j int) bool {
+		return products[i].DeletedAt.After(*products[j].DeletedAt)
+	})
+	return products, nil
+}
+
+func (s memProducts) Restore(ctx context.Context, id uint) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	product, ok := s.m.trash.products[id]
+	if !ok {
+		return ErrNotFound
+	}
+	product.DeletedAt = nil
+	delete(s.m.trash.products, id)
+	s.m.products[id] = product
+	return nil
+}
+
+func (s memProducts) Purge(ctx context.Context, cutoff time.Time) (int64, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	var purged int64
+	for id, product := range s.m.trash.products {
+		if product.DeletedAt.Before(cutoff) {
+			delete(s.m.trash.products, id)
+			purged++
+			for _, items := range s.m.carts {
+				delete(items, id)
+			}
+		}
+	}
+	return purged, nil
+}
+
+type memOrders struct{ m *memory }
+
+func (s memOrders) Create(ctx context.Context, order *Order) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	order.ID = s.m.id()
+	s.m.orders[order.ID] = *order
+	return nil
+}
+
+func (s memOrders) List(ctx context.Context) ([]Order, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	orders := []Order{}
+	for _, id := range sortedIDs(s.m.orders) {
+		orders = append(orders, s.m.orders[id])
+	}
+	return orders, nil
+}
+
+type memCarts struct{ m *memory }
+
+// Callers hold the lock
+func (s memCarts) copyOf(accountID uint) map[uint]int {
+	cart := map[uint]int{}
+	for productID, quantity := range s.m.carts[accountID] {
+		cart[productID] = quantity
+	}
+	return cart
+}
+
+func (s memCarts) Items(ctx context.Context, accountID uint) (map[uint]int, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	return s.copyOf(accountID), nil
+}
+
+func (s memCarts) Add(ctx context.Context, accountID, productID uint, quantity int) (map[uint]int, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	if s.m.carts[accountID] == nil {
+		s.m.carts[accountID] = map[uint]int{}
+	}
+	s.m.carts[accountID][productID] += quantity
+	return s.copyOf(accountID), nil
+}
+
+func (s memCarts) Remove(ctx context.Context, accountID, productID uint) (map[uint]int, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	delete(s.m.carts[accountID], productID)
+	return s.copyOf(accountID), nil
+}
+
+type memPasskeys struct{ m *memory }
+
+func (s memPasskeys) Create(ctx context.Context, credential *PasskeyCredential) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	for _, existing := range s.m.passkeys {
+		if bytes.Equal(existing.CredentialID, credential.CredentialID) {
+			return ErrConflict
+		}
+	}
+	credential.ID = s.m.id()
+	s.m.passkeys[credential.ID] = *credential
+	return nil
+}
+
+func (s memPasskeys) ListByAccount(ctx context.Context, accountID uint) ([]PasskeyCredential, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	credentials := []PasskeyCredential{}
+	for _, id := range sortedIDs(s.m.passkeys) {
+		if credential := s.m.passkeys[id]; credential.AccountID == accountID {
+			credentials = append(credentials, credential)
+		}
+	}
+	return credentials, nil
+}
+
+func (s memPasskeys) RecordUse(ctx context.Context, credentialID []byte, signCount uint32, at time.Time) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	for id, credential := range s.m.passkeys {
+		if bytes.Equal(credential.CredentialID, credentialID) {
+			credential.SignCount = signCount
+			credential.LastUsedAt = at
+			s.m.passkeys[id] = credential
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s memPasskeys) Delete(ctx context.Context, id, accountID uint) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	credential, ok := s.m.passkeys[id]
+	if !ok || credential.AccountID != accountID {
+		return ErrNotFound
+	}
+	delete(s.m.passkeys, id)
+	return nil
+}
+
+type memIdentities struct{ m *memory }
+
+func (s memIdentities) Find(ctx context.Context, provider, subject string) (ExternalIdentity, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	for _, identity := range s.m.identities {
+		if identity.Provider == provider && identity.Subject == subject {
+			return identity, nil
+		}
+	}
+	return ExternalIdentity{}, ErrNotFound
+}
+
+func (s memIdentities) Link(ctx context.Context, identity ExternalIdentity, newAccount Account) (Account, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	for _, existing := range s.m.identities {
+		if existing.Provider == identity.Provider && existing.Subject == identity.Subject {
+			return Account{}, ErrConflict
+		}
+	}
+
+	var account Account
+	found := false
+	for _, id := range sortedIDs(s.m.accounts) {
+		if candidate := s.m.accounts[id]; fold(candidate.Email) == fold(identity.Email) {
+			account, found = candidate, true
+			break
+		}
+	}
+
+	if found && account.EmailVerifiedAt == nil {
+		return Account{}, ErrUnverified
+	}
+	if !found {
+		accounts := memAccounts{s.m}
+		account = newAccount
+		base := strings.TrimSpace(newAccount.Username)
+		for i := 2; accounts.conflict(Account{Username: account.Username}, 0); i++ {
+			account.Username = base + strconv.Itoa(i)
+		}
+		if accounts.conflict(account, 0) {
+			return Account{}, ErrConflict
+		}
+		account.ID = s.m.id()
+		account.Version = 1
+		account.CreatedAt = now()
+		s.m.accounts[account.ID] = account
+	}
+
+	identity.AccountID = account.ID
+	identity.ID = s.m.id()
+	s.m.identities[identity.ID] = identity
+	return account, nil
+}
+
+type memSessions struct{ m *memory }
+
+func (s memSessions) Create(ctx context.Context, session *Session) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	if _, ok := s.m.sessions[session.TokenHash]; ok {
+		return ErrConflict
+	}
+	session.ID = s.m.id()
+	s.m.sessions[session.TokenHash] = *session
+	return nil
+}
+
+func (s memSessions) FindValid(ctx context.Context, tokenHash string, now time.Time) (Session, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	session, ok := s.m.sessions[tokenHash]
+	if !ok || !session.ExpiresAt.After(now) {
+		return Session{}, ErrNotFound
+	}
+	return session, nil
+}
+
+func (s memSessions) Delete(ctx context.Context, tokenHash string) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	delete(s.m.sessions, tokenHash)
+	return nil
+}
+
+func (s memSessions) DeleteExpired(ctx context.Context, now time.Time) (int64, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	var deleted int64
+	for tokenHash, session := range s.m.sessions {
+		if !session.ExpiresAt.After(now) {
+			delete(s.m.sessions, tokenHash)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+type memAPIKeys struct{ m *memory }
+
+func (s memAPIKeys) Create(ctx context.Context, key *APIKey) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	for _, existing := range s.m.apiKeys {
+		if existing.Prefix == key.Prefix {
+			return ErrConflict
+		}
+	}
+	key.ID = s.m.id()
+	s.m.apiKeys[key.ID] = *key
+	return nil
+}
+
+func (s memAPIKeys) Get(ctx context.Context, id uint) (APIKey, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	key, ok := s.m.apiKeys[id]
+	if !ok {
+		return APIKey{}, ErrNotFound
+	}
+	return key, nil
+}
+
+func (s memAPIKeys) FindByPrefix(ctx context.Context, prefix string) (APIKey, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	for _, key := range s.m.apiKeys {
+		if key.Prefix == prefix {
+			return key, nil
+		}
+	}
+	return APIKey{}, ErrNotFound
+}
+
+func (s memAPIKeys) Touch(ctx context.Context, id uint, at time.Time) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	key, ok := s.m.apiKeys[id]
+	if !ok {
+		return ErrNotFound
+	}
+	key.LastUsedAt = &at
+	s.m.apiKeys[id] = key
+	return nil
+}
+
+func (s memAPIKeys) List(ctx context.Context) ([]APIKey, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	keys := []APIKey{}
+	for _, id := range sortedIDs(s.m.apiKeys) {
+		keys = append(keys, s.m.apiKeys[id])
+	}
+	return keys, nil
+}
+
+func (s memAPIKeys) Delete(ctx context.Context, id uint) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	if _, ok := s.m.apiKeys[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.m.apiKeys, id)
+	return nil
+}
+
+type memAudit struct{ m *memory }
+
+func (s memAudit) Append(ctx context.Context, entry *AuditEntry) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	entry.ID = s.m.id()
+	s.m.audit = append(s.m.audit, *entry)
+	return nil
+}
+
+func (s memAudit) List(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	entries := []AuditEntry{}
+	for i := len(s.m.audit) - 1; i >= 0; i-- {
+		entry := s.m.audit[i]
+		switch {
+		case filter.ActorType != "" && entry.ActorType != filter.ActorType,
+			filter.ActorID != 0 && entry.ActorID != filter.ActorID,
+			filter.Action != "" && entry.Action != filter.Action,
+			filter.TargetType != "" && entry.TargetType != filter.TargetType,
+			filter.TargetID != 0 && entry.TargetID != filter.TargetID,
+			!filter.From.IsZero() && entry.CreatedAt.Before(filter.From),
+			!filter.To.IsZero() && !entry.CreatedAt.Before(filter.To):
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	if filter.Offset >= len(entries) {
+		return []AuditEntry{}, nil
+	}
+	entries = entries[filter.Offset:]
+	if filter.Limit > 0 && len(entries) > filter.Limit {
+		entries = entries[:filter.Limit]
+	}
+	return entries, nil
+}
+
+// A transaction snapshots every table and puts the snapshot back when fn
+// fails. Transactions run one at a time, but there is no isolation from
+// writes made outside one: they are undone too if it rolls back, and fn sees
+// them as they happen.
+type memTx struct {
+	m      *memory
+	joined bool // inside another Run, which owns the snapshot
+}
+
+func (s memTx) Run(ctx context.Context, fn func(tx Stores) error) error {
+	if s.joined {
+		return fn(s.m.stores(s))
+	}
+	s.m.txMu.Lock()
+	defer s.m.txMu.Unlock()
+
+	s.m.mu.Lock()
+	saved := s.m.snapshot()
+	s.m.mu.Unlock()
+
+	if err := fn(s.m.stores(memTx{m: s.m, joined: true})); err != nil {
+		s.m.mu.Lock()
+		s.m.restore(saved)
+		s.m.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// A copy of every table. Rows are values that are replaced rather than
+// changed in place, so copying the maps is enough; only the carts nest.
+func (m *memory) snapshot() *memory {
+	carts := make(map[uint]map[uint]int, len(m.carts))
+	for accountID, items := range m.carts {
+		carts[accountID] = maps.Clone(items)
+	}
+	return &memory{
+		nextID:     m.nextID,
+		accounts:   maps.Clone(m.accounts),
+		products:   maps.Clone(m.products),
+		orders:     maps.Clone(m.orders),
+		carts:      carts,
+		passkeys:   maps.Clone(m.passkeys),
+		identities: maps.Clone(m.identities),
+		sessions:   maps.Clone(m.sessions),
+		apiKeys:    maps.Clone(m.apiKeys),
+		audit:      slices.Clone(m.audit),
+		trash: trash{
+			accounts: maps.Clone(m.trash.accounts),
+			products: maps.Clone(m.trash.products),
+		},
+	}
+}
+
+func (m *memory) restore(saved *memory) {
+	m.nextID = saved.nextID
+	m.accounts, m.products, m.orders, m.carts = saved.accounts, saved.products, saved.orders, saved.carts
+	m.passkeys, m.identities, m.sessions, m.apiKeys = saved.passkeys, saved.identities, saved.sessions, saved.apiKeys
+	m.audit, m.trash = saved.audit, saved.trash
+}
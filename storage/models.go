@@ -0,0 +1,131 @@
+package storage
+
+import "time"
+
+// Account is a row of the account table; DeletedAt is set while it is in
+// the trash. Version counts the writes, for optimistic locking. CreatedAt is
+// unknown for accounts older than the 0007 migration. EmailVerifiedAt is set
+// for accounts created from an email an identity provider verified, or once
+// an admin verifies it; identity providers can only be linked to an existing
+// account after that.
+type Account struct {
+	ID              uint `gorm:"primary_key"`
+	Fullname        string
+	Email           string
+	Username        string
+	Password        string
+	Role            string
+	Age             *int
+	Address         string
+	Version         int
+	CreatedAt       *time.Time
+	LastLoginAt     *time.Time
+	EmailVerifiedAt *time.Time
+	DeletedAt       *time.Time
+}
+
+// AccountSummary is an account in the user directory, with its stats
+type AccountSummary struct {
+	Account
+	OrderCount int64
+}
+
+// Product is a row of the product table; DeletedAt is set while it is in
+// the trash. Version counts the writes, for optimistic locking.
+type Product struct {
+	ID          uint `gorm:"primary_key"`
+	Title       string
+	Description string
+	Price       float64
+	Quantity    int
+	ImageData   []byte
+	Version     int
+	DeletedAt   *time.Time
+}
+
+// Order is a row of the orders table; AccountID 0 is an anonymous purchase or
+// one by an account since purged
+type Order struct {
+	ID         uint `gorm:"primary_key"`
+	AccountID  uint
+	Fullname   string
+	Mobile     string
+	Address    string
+	ItemTitle  string
+	Quantity   int
+	PurchaseID uint
+}
+
+// CartItem is a row of the cart_items table, in the cart of AccountID
+type CartItem struct {
+	ID        uint `gorm:"primary_key"`
+	AccountID uint
+	ProductID uint
+	Quantity  int
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// PasskeyCredential is one WebAuthn credential; an account may have several
+type PasskeyCredential struct {
+	ID           uint `gorm:"primary_key"`
+	AccountID    uint
+	Name         string
+	CredentialID []byte
+	PublicKey    []byte
+	SignCount    uint32
+	AAGUID       []byte `gorm:"column:aaguid"`
+	Transports   string
+	CreatedAt    time.Time
+	LastUsedAt   time.Time
+}
+
+// ExternalIdentity links an identity provider subject to an account
+type ExternalIdentity struct {
+	ID        uint `gorm:"primary_key"`
+	AccountID uint
+	Provider  string
+	Subject   string
+	Email     string
+	CreatedAt time.Time
+}
+
+// Session is a login session; only a hash of the bearer token is stored
+type Session struct {
+	ID        uint `gorm:"primary_key"`
+	AccountID uint
+	TokenHash string
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+// AuditEntry is a row of the audit_log table. ActorType is account or
+// api_key; OldValues and NewValues are JSON objects holding just the fields
+// the change touched.
+type AuditEntry struct {
+	ID         uint `gorm:"primary_key"`
+	ActorType  string
+	ActorID    uint
+	ActorName  string
+	Action     string
+	TargetType string
+	TargetID   uint
+	OldValues  string
+	NewValues  string
+	IP         string
+	RequestID  string
+	CreatedAt  time.Time
+}
+
+// APIKey is a server-to-server credential; only a hash of the key is stored
+type APIKey struct {
+	ID         uint `gorm:"primary_key"`
+	Name       string
+	Prefix     string
+	KeyHash    string
+	Scopes     string
+	CreatedBy  uint
+	CreatedAt  time.Time
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+}
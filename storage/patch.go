@@ -0,0 +1,83 @@
+package storage
+
+// Field is one column of a patch. Only fields with Set are written, zero
+// values included.
+type Field[T any] struct {
+	Set   bool
+	Value T
+}
+
+// SetTo returns a field that writes value
+func SetTo[T any](value T) Field[T] {
+	return Field[T]{Set: true, Value: value}
+}
+
+// AccountPatch is a partial update of an account's profile; a nil Age
+// clears it
+type AccountPatch struct {
+	Fullname Field[string]
+	Email    Field[string]
+	Username Field[string]
+	Age      Field[*int]
+	Address  Field[string]
+}
+
+// ProductPatch is a partial update of a product
+type ProductPatch struct {
+	Title       Field[string]
+	Description Field[string]
+	Price       Field[float64]
+	Quantity    Field[int]
+	ImageData   Field[[]byte]
+}
+
+// Add the column to columns when the field is set
+func column[T any](columns map[string]interface{}, name string, field Field[T]) {
+	if field.Set {
+		columns[name] = field.Value
+	}
+}
+
+func (p AccountPatch) columns() map[string]interface{} {
+	columns := map[string]interface{}{}
+	column(columns, "fullname", p.Fullname)
+	column(columns, "email", p.Email)
+	column(columns, "username", p.Username)
+	column(columns, "age", p.Age)
+	column(columns, "address", p.Address)
+	return columns
+}
+
+func (p ProductPatch) columns() map[string]interface{} {
+	columns := map[string]interface{}{}
+	column(columns, "title", p.Title)
+	column(columns, "description", p.Description)
+	column(columns, "price", p.Price)
+	column(columns, "quantity", p.Quantity)
+	column(columns, "image_data", p.ImageData)
+	return columns
+}
+
+// Write the set fields onto account
+func (p AccountPatch) apply(account *Account) {
+	assign(&account.Fullname, p.Fullname)
+	assign(&account.Email, p.Email)
+	assign(&account.Username, p.Username)
+	assign(&account.Age, p.Age)
+	assign(&account.Address, p.Address)
+}
+
+// Write the set fields onto product
+func (p ProductPatch) apply(product *Product) {
+	assign(&product.Title, p.Title)
+	assign(&product.Description, p.Description)
+	assign(&product.Price, p.Price)
+	assign(&product.Quantity, p.Quantity)
+	assign(&product.ImageData, p.ImageData)
+}
+
+func assign[T any](target *T, field Field[T]) {
+	if field.Set {
+		*target = field.Value
+	}
+}
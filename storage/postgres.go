@@ -1,45 +1,76 @@
 package storage
 
 import (
-	"fmt"
-	"log"
-	// "os"
+	"context"
+	"log/slog"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
-	"github.com/joho/godotenv"
 )
 
-// Config represents the database configuration
-type Config struct {
-	Host     string
-	Port     string
-	User     string
-	Password string
-	DBName   string
-	SSLMode  string
-}
-
 var db *gorm.DB
 
-// NewConnection establishes a new database connection and returns it
-func NewConnection(config *Config) (*gorm.DB, error) {
-	if err := godotenv.Load(); err != nil {
-		log.Fatalf("Error loading .env file: %v", err)
-	}
-
-	dbURI := fmt.Sprintf("localhost=%s 5432=%s postgres=%s postgres=%s postgres=%s sslmode=disable",
-		config.Host, config.Port, config.User, config.DBName, config.Password)
+// Pool limits the connections database/sql keeps open; zero leaves a limit off
+type Pool struct {
+	MaxOpen     int
+	MaxIdle     int
+	MaxLifetime time.Duration
+	MaxIdleTime time.Duration
+}
 
-	var err error
-	db, err = gorm.Open("postgres", dbURI)
+// NewConnection opens a Postgres connection for the given DSN or URL and checks it
+func NewConnection(dsn string, pool Pool) (*gorm.DB, error) {
+	conn, err := gorm.Open("postgres", dsn)
 	if err != nil {
-		log.Fatalf("Error connecting to the database: %v", err)
+		return nil, err
 	}
+	conn.SetLogger(gormLogger{})
+	logErrors(conn)
+
+	sqlDB := conn.DB()
+	sqlDB.SetMaxOpenConns(pool.MaxOpen)
+	sqlDB.SetMaxIdleConns(pool.MaxIdle)
+	sqlDB.SetConnMaxLifetime(pool.MaxLifetime)
+	sqlDB.SetConnMaxIdleTime(pool.MaxIdleTime)
 
+	db = conn
 	return db, nil
 }
 
+// Backoff between connection attempts: doubling from the first delay up to the cap
+const (
+	connectFirstDelay = 250 * time.Millisecond
+	connectMaxDelay   = 5 * time.Second
+)
+
+// ConnectWithRetry calls open until it succeeds or timeout has passed, backing
+// off between attempts, so the server can start alongside its database. A zero
+// timeout tries once.
+func ConnectWithRetry(ctx context.Context, timeout time.Duration, open func() (*gorm.DB, error)) (*gorm.DB, error) {
+	deadline := time.Now().Add(timeout)
+	delay := connectFirstDelay
+	for attempt := 1; ; attempt++ {
+		conn, err := open()
+		if err == nil {
+			return conn, nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return nil, err
+		}
+
+		slog.Warn("database unavailable, retrying", "attempt", attempt, "retry_in", delay.String(), "err", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, err
+		}
+		if delay *= 2; delay > connectMaxDelay {
+			delay = connectMaxDelay
+		}
+	}
+}
+
 // GetDB returns the database instance
 func GetDB() *gorm.DB {
 	return db
@@ -0,0 +1,85 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"m/v2/storage"
+)
+
+func TestPurgeLeavesNoOrphans(t *testing.T) {
+	ctx := context.Background()
+
+	for name, stores := range newStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ann := storage.Account{Username: "ann", Email: "ann@example.com", Role: "user"}
+			ben := storage.Account{Username: "ben", Email: "ben@example.com", Role: "user"}
+			lamp := storage.Product{Title: "Lamp", Price: 10, Quantity: 5}
+			desk := storage.Product{Title: "Desk", Price: 90, Quantity: 2}
+			for _, account := range []*storage.Account{&ann, &ben} {
+				if err := stores.Accounts.Create(ctx, account); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, product := range []*storage.Product{&lamp, &desk} {
+				if err := stores.Products.Create(ctx, product); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, accountID := range []uint{ann.ID, ben.ID} {
+				for _, productID := range []uint{lamp.ID, desk.ID} {
+					if _, err := stores.Carts.Add(ctx, accountID, productID, 1); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			for _, order := range []storage.Order{
+				{AccountID: ann.ID, Fullname: "Ann A", ItemTitle: "Lamp", Quantity: 1},
+				{AccountID: ben.ID, Fullname: "Ben B", ItemTitle: "Desk", Quantity: 1},
+			} {
+				if err := stores.Orders.Create(ctx, &order); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Purge Ann and the lamp
+			if err := stores.Accounts.Delete(ctx, ann.ID); err != nil {
+				t.Fatal(err)
+			}
+			if err := stores.Products.Delete(ctx, lamp.ID); err != nil {
+				t.Fatal(err)
+			}
+			cutoff := time.Now().Add(time.Second)
+			if purged, err := stores.Accounts.Purge(ctx, cutoff); err != nil || purged != 1 {
+				t.Fatalf("purged %d accounts (%v), want 1", purged, err)
+			}
+			if purged, err := stores.Products.Purge(ctx, cutoff); err != nil || purged != 1 {
+				t.Fatalf("purged %d products (%v), want 1", purged, err)
+			}
+
+			// Ann's cart went with her, and the lamp left Ben's
+			if items, err := stores.Carts.Items(ctx, ann.ID); err != nil || len(items) != 0 {
+				t.Errorf("the purged account's cart is %v (%v)", items, err)
+			}
+			items, err := stores.Carts.Items(ctx, ben.ID)
+			if err != nil || len(items) != 1 || items[desk.ID] != 1 {
+				t.Errorf("Ben's cart is %v (%v), want just the desk", items, err)
+			}
+
+			// Both orders are kept; Ann's is anonymous now
+			orders, err := stores.Orders.List(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(orders) != 2 || orders[0].AccountID != 0 || orders[0].ItemTitle != "Lamp" || orders[1].AccountID != ben.ID {
+				t.Errorf("orders after the purge: %+v", orders)
+			}
+
+			// A second purge finds nothing
+			if purged, err := stores.Accounts.Purge(ctx, cutoff); err != nil || purged != 0 {
+				t.Errorf("purged %d accounts again (%v)", purged, err)
+			}
+		})
+	}
+}
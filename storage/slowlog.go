@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Distinct statements tracked by a SlowQueryLog; slower statements past this
+// are still logged but not aggregated
+const maxSlowFingerprints = 500
+
+// SlowQuery aggregates the slow runs of one statement shape
+type SlowQuery struct {
+	Fingerprint string
+	Table       string
+	Count       int
+	Total       time.Duration
+	Max         time.Duration
+	LastSeen    time.Time
+}
+
+// SlowQueryLog logs gorm queries taking at least Threshold and keeps
+// statistics per fingerprint since it was created. Only fingerprints are
+// recorded: literals and bound values never reach the log.
+type SlowQueryLog struct {
+	Threshold time.Duration
+	Since     time.Time
+
+	mu      sync.Mutex
+	queries map[string]*SlowQuery
+}
+
+// NewSlowQueryLog records queries taking at least threshold
+func NewSlowQueryLog(threshold time.Duration) *SlowQueryLog {
+	return &SlowQueryLog{
+		Threshold: threshold,
+		Since:     time.Now(),
+		queries:   map[string]*SlowQuery{},
+	}
+}
+
+// Attach times every query made through conn. Raw statements run with Exec
+// bypass gorm's callbacks and are not seen.
+func (l *SlowQueryLog) Attach(conn *gorm.DB) {
+	timeQueries(conn, "slowlog", func(scope *gorm.Scope, operation string, duration time.Duration) {
+		if duration >= l.Threshold {
+			l.record(scopeContext(scope), Fingerprint(scope.SQL), scope.TableName(), duration)
+		}
+	})
+}
+
+func (l *SlowQueryLog) record(ctx context.Context, fingerprint, table string, duration time.Duration) {
+	slog.WarnContext(ctx, "slow query", "fingerprint", fingerprint, "table", table,
+		"duration_ms", float64(duration.Microseconds())/1000)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	query, ok := l.queries[fingerprint]
+	if !ok {
+		if len(l.queries) >= maxSlowFingerprints {
+			return
+		}
+		query = &SlowQuery{Fingerprint: fingerprint, Table: table}
+		l.queries[fingerprint] = query
+	}
+	query.Count++
+	query.Total += duration
+	if duration > query.Max {
+		query.Max = duration
+	}
+	query.LastSeen = time.Now()
+}
+
+// Top returns up to n statements, the most total time spent first. A nil log
+// has recorded nothing.
+func (l *SlowQueryLog) Top(n int) []SlowQuery {
+	if l == nil {
+		return []SlowQuery{}
+	}
+
+	l.mu.Lock()
+	queries := make([]SlowQuery, 0, len(l.queries))
+	for _, query := range l.queries {
+		queries = append(queries, *query)
+	}
+	l.mu.Unlock()
+
+	sort.Slice(queries, func(i, j int) bool {
+		if queries[i].Total != queries[j].Total {
+			return queries[i].Total > queries[j].Total
+		}
+		return queries[i].Fingerprint < queries[j].Fingerprint
+	})
+	if len(queries) > n {
+		queries = queries[:n]
+	}
+	return queries
+}
+
+var (
+	stringLiteral = regexp.MustCompile(`'(?:[^']|'')*'`)
+	numberLiteral = regexp.MustCompile(`\b\d+(?:\.\d+)?\b`)
+	placeholder   = regexp.MustCompile(`\$\d+|\?`)
+	valueList     = regexp.MustCompile(`\(\s*\?(?:\s*,\s*\?)+\s*\)`)
+	whitespace    = regexp.MustCompile(`\s+`)
+)
+
+// Fingerprint reduces a statement to its shape: literals and placeholders
+// become ?, lists of them collapse to (?...) and whitespace is squeezed, so
+// the same query with different values gets the same fingerprint
+func Fingerprint(sql string) string {
+	sql = placeholder.ReplaceAllString(sql, "?")
+	sql = stringLiteral.ReplaceAllString(sql, "?")
+	sql = numberLiteral.ReplaceAllString(sql, "?")
+	sql = valueList.ReplaceAllString(sql, "(?...)")
+	return strings.TrimSpace(whitespace.ReplaceAllString(sql, " "))
+}
@@ -0,0 +1,708 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// NewSQL returns stores backed by a Postgres or SQLite database. The queries
+// stick to SQL both understand, so the two drivers behave the same.
+func NewSQL(db *gorm.DB) Stores {
+	return Stores{
+		Accounts:   &sqlAccounts{db},
+		Products:   &sqlProducts{db},
+		Orders:     &sqlOrders{db},
+		Carts:      &sqlCarts{db},
+		Passkeys:   &sqlPasskeys{db},
+		Identities: &sqlIdentities{db},
+		Sessions:   &sqlSessions{db},
+		APIKeys:    &sqlAPIKeys{db},
+		Audit:      &sqlAudit{db},
+		Tx:         &sqlTx{db},
+	}
+}
+
+// Usernames and emails are matched case-insensitively and ignoring
+// surrounding spaces. These expressions line up with the unique indexes in
+// the 0001_initial migrations.
+const (
+	usernameMatch = "lower(trim(username)) = lower(trim(?))"
+	emailMatch    = "lower(trim(email)) = lower(trim(?))"
+)
+
+// Map gorm and driver errors onto the package errors
+func translate(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case gorm.IsRecordNotFoundError(err):
+		return ErrNotFound
+	case IsUniqueViolation(err):
+		return ErrConflict
+	}
+	return err
+}
+
+// The current time as stored: in UTC, since SQLite compares timestamps as text
+func now() *time.Time {
+	t := time.Now().UTC()
+	return &t
+}
+
+// Rows in the trash have deleted_at set. Queries loading an Account or
+// Product skip them already (gorm's soft delete); the rest add this.
+const live = "deleted_at IS NULL"
+
+// Deletes and updates that touch nothing mean the row doesn't exist
+func affected(result *gorm.DB) error {
+	if result.Error != nil {
+		return translate(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Bump the version of a live row, checking it first unless version is zero.
+// Updates do this before writing anything else, which also locks the row for
+// the rest of the transaction.
+func bumpVersion(table *gorm.DB, id uint, version int) error {
+	query := table.Where("id = ?", id).Where(live)
+	if version != 0 {
+		query = query.Where("version = ?", version)
+	}
+	result := query.UpdateColumn("version", gorm.Expr("version + 1"))
+	if result.Error != nil || result.RowsAffected > 0 {
+		return result.Error
+	}
+	if version == 0 {
+		return ErrNotFound
+	}
+
+	// Tell a stale version from a missing row
+	var count int
+	if err := table.Where("id = ?", id).Where(live).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNotFound
+	}
+	return ErrStale
+}
+
+type sqlAccounts struct{ db *gorm.DB }
+
+func (s *sqlAccounts) table(ctx context.Context) *gorm.DB {
+	return withContext(ctx, s.db).Table("account")
+}
+
+func (s *sqlAccounts) Create(ctx context.Context, account *Account) error {
+	account.Version = 1
+	account.CreatedAt = now()
+	return translate(s.table(ctx).Create(account).Error)
+}
+
+func (s *sqlAccounts) Get(ctx context.Context, id uint) (Account, error) {
+	var account Account
+	err := s.table(ctx).Where("id = ?", id).First(&account).Error
+	return account, translate(err)
+}
+
+func (s *sqlAccounts) FindByUsername(ctx context.Context, username string) (Account, error) {
+	var account Account
+	err := s.table(ctx).Where(usernameMatch, username).First(&account).Error
+	return account, translate(err)
+}
+
+func (s *sqlAccounts) FindByEmail(ctx context.Context, email string) (Account, error) {
+	var account Account
+	err := s.table(ctx).Where(emailMatch, email).First(&account).Error
+	return account, translate(err)
+}
+
+func (s *sqlAccounts) FindByLogin(ctx context.Context, login string) (Account, error) {
+	var account Account
+	err := s.table(ctx).Where(usernameMatch+" OR "+emailMatch, login, login).First(&account).Error
+	return account, translate(err)
+}
+
+func (s *sqlAccounts) Update(ctx context.Context, id uint, version int, patch AccountPatch) error {
+	return translate(transaction(withContext(ctx, s.db), func(tx *gorm.DB) error {
+		if err := bumpVersion(tx.Table("account"), id, version); err != nil {
+			return err
+		}
+		columns := patch.columns()
+		if patch.Email.Set {
+			// A new email hasn't been verified
+			columns["email_verified_at"] = gorm.Expr("CASE WHEN "+emailMatch+" THEN email_verified_at END", patch.Email.Value)
+		}
+		if len(columns) > 0 {
+			return tx.Table("account").Where("id = ?", id).Updates(columns).Error
+		}
+		return nil
+	}))
+}
+
+func (s *sqlAccounts) SetPassword(ctx context.Context, id uint, hash string) error {
+	return affected(s.table(ctx).Where("id = ?", id).Where(live).Update("password", hash))
+}
+
+func (s *sqlAccounts) ReplacePassword(ctx context.Context, id uint, current, replacement string) error {
+	return affected(s.table(ctx).Where("id = ? AND password = ?", id, current).Where(live).Update("password", replacement))
+}
+
+// Timestamps are stored in UTC, as for sessions, so Purge can compare them
+func (s *sqlAccounts) Delete(ctx context.Context, id uint) error {
+	return translate(transaction(withContext(ctx, s.db), func(tx *gorm.DB) error {
+		err := affected(tx.Table("account").Where("id = ?", id).Where(live).Update("deleted_at", time.Now().UTC()))
+		if err != nil {
+			return err
+		}
+		return tx.Table("session").Where("account_id = ?", id).Delete(&Session{}).Error
+	}))
+}
+
+func (s *sqlAccounts) List(ctx context.Context) ([]Account, error) {
+	var accounts []Account
+	err := s.table(ctx).Order("id").Find(&accounts).Error
+	return accounts, translate(err)
+}
+
+func (s *sqlAccounts) Usernames(ctx context.Context) ([]string, error) {
+	var usernames []string
+	err := s.table(ctx).Where(live).Order("id").Pluck("username", &usernames).Error
+	return usernames, translate(err)
+}
+
+func (s *sqlAccounts) ListDeleted(ctx context.Context) ([]Account, error) {
+	var accounts []Account
+	err := s.table(ctx).Unscoped().Where("deleted_at IS NOT NULL").Order("deleted_at DESC, id DESC").Find(&accounts).Error
+	return accounts, translate(err)
+}
+
+func (s *sqlAccounts) Restore(ctx context.Context, id uint) error {
+	return affected(s.table(ctx).Where("id = ? AND deleted_at IS NOT NULL", id).Update("deleted_at", gorm.Expr("NULL")))
+}
+
+// Passkeys, identities and sessions go with them through the foreign keys.
+// Carts and orders have none: carts are deleted and orders handed to the
+// anonymous account 0, in the same transaction.
+func (s *sqlAccounts) Purge(ctx context.Context, cutoff time.Time) (int64, error) {
+	var purged int64
+	err := transaction(withContext(ctx, s.db), func(tx *gorm.DB) error {
+		expired := tx.Table("account").Unscoped().Select("id").Where("deleted_at < ?", cutoff.UTC()).SubQuery()
+		if err := tx.Table("cart_items").Where("account_id IN ?", expired).Delete(&CartItem{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Table("orders").Where("account_id IN ?", expired).UpdateColumn("account_id", 0).Error; err != nil {
+			return err
+		}
+		result := tx.Table("account").Unscoped().Where("deleted_at < ?", cutoff.UTC()).Delete(&Account{})
+		purged = result.RowsAffected
+		return result.Error
+	})
+	return purged, translate(err)
+}
+
+func (s *sqlAccounts) RecordLogin(ctx context.Context, id uint, at time.Time) error {
+	return affected(s.table(ctx).Where("id = ?", id).Where(live).UpdateColumn("last_login_at", at.UTC()))
+}
+
+func (s *sqlAccounts) VerifyEmail(ctx context.Context, id uint, version int, at time.Time) error {
+	return translate(transaction(withContext(ctx, s.db), func(tx *gorm.DB) error {
+		if err := bumpVersion(tx.Table("account"), id, version); err != nil {
+			return err
+		}
+		return tx.Table("account").Where("id = ?", id).UpdateColumn("email_verified_at", at.UTC()).Error
+	}))
+}
+
+// Directory columns; times that may be unknown sort last either way
+var accountSortColumns = map[string]string{
+	"username":      "lower(username)",
+	"fullname":      "lower(fullname)",
+	"email":         "lower(email)",
+	"created_at":    "created_at",
+	"last_login_at": "last_login_at",
+	"order_count":   "order_count",
+}
+
+func (s *sqlAccounts) Directory(ctx context.Context, filter AccountFilter) ([]AccountSummary, int64, error) {
+	field, descending, ok := parseSort(filter.Sort, AccountSorts)
+	if !ok {
+		return nil, 0, ErrInvalidSort
+	}
+
+	query := s.table(ctx).Unscoped()
+	if filter.Search != "" {
+		pattern := "%" + likeEscaper.Replace(strings.ToLower(filter.Search)) + "%"
+		query = query.Where(
+			`lower(fullname) LIKE ? ESCAPE '\' OR lower(email) LIKE ? ESCAPE '\' OR lower(username) LIKE ? ESCAPE '\'`,
+			pattern, pattern, pattern)
+	}
+	if filter.Role != "" {
+		query = query.Where("role = ?", filter.Role)
+	}
+	if filter.Deleted != nil {
+		if *filter.Deleted {
+			query = query.Where("deleted_at IS NOT NULL")
+		} else {
+			query = query.Where(live)
+		}
+	}
+	if filter.Verified != nil {
+		if *filter.Verified {
+			query = query.Where("email_verified_at IS NOT NULL")
+		} else {
+			query = query.Where("email_verified_at IS NULL")
+		}
+	}
+	if !filter.SignedUpFrom.IsZero() {
+		query = query.Where("created_at >= ?", filter.SignedUpFrom.UTC())
+	}
+	if !filter.SignedUpTo.IsZero() {
+		query = query.Where("created_at < ?", filter.SignedUpTo.UTC())
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, translate(err)
+	}
+
+	if column := accountSortColumns[field]; column != "" {
+		if field == "created_at" || field == "last_login_at" {
+			query = query.Order(column + " IS NULL")
+		}
+		if descending {
+			column += " DESC"
+		}
+		query = query.Order(column)
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+	if filter.Offset > 0 {
+		query = query.Offset(filter.Offset)
+	}
+
+	summaries := []AccountSummary{}
+	err := query.
+		Select("account.*, (SELECT count(*) FROM orders WHERE orders.account_id = account.id) AS order_count").
+		Order("id").
+		Find(&summaries).Error
+	return summaries, total, translate(err)
+}
+
+// Escape the LIKE wildcards, for the ESCAPE '\' clause
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+type sqlProducts struct{ db *gorm.DB }
+
+func (s *sqlProducts) table(ctx context.Context) *gorm.DB {
+	return withContext(ctx, s.db).Table("product")
+}
+
+func (s *sqlProducts) Create(ctx context.Context, product *Product) error {
+	product.Version = 1
+	return translate(s.table(ctx).Create(product).Error)
+}
+
+func (s *sqlProducts) Get(ctx context.Context, id uint) (Product, error) {
+	var product Product
+	err := s.table(ctx).Where("id = ?", id).First(&product).Error
+	return product, translate(err)
+}
+
+func (s *sqlProducts) FindByTitle(ctx context.Context, title string) (Product, error) {
+	var product Product
+	err := s.table(ctx).Where("title = ?", title).First(&product).Error
+	return product, translate(err)
+}
+
+func (s *sqlProducts) Update(ctx context.Context, id uint, version int, patch ProductPatch) error {
+	return translate(transaction(withContext(ctx, s.db), func(tx *gorm.DB) error {
+		if err := bumpVersion(tx.Table("product"), id, version); err != nil {
+			return err
+		}
+		if columns := patch.columns(); len(columns) > 0 {
+			return tx.Table("product").Where("id = ?", id).Updates(columns).Error
+		}
+		return nil
+	}))
+}
+
+// The quantity check and the decrement are one statement, so concurrent
+// orders can't both take the last item
+func (s *sqlProducts) TakeStock(ctx context.Context, id uint, quantity int) error {
+	result := s.table(ctx).
+		Where("id = ? AND quantity >= ?", id, quantity).
+		Where(live).
+		UpdateColumns(map[string]interface{}{
+			"quantity": gorm.Expr("quantity - ?", quantity),
+			"version":  gorm.Expr("version + 1"),
+		})
+	if result.Error != nil {
+		return translate(result.Error)
+	}
+	if result.RowsAffected > 0 {
+		return nil
+	}
+	if _, err := s.Get(ctx, id); err != nil {
+		return err
+	}
+	return ErrOutOfStock
+}
+
+func (s *sqlProducts) Delete(ctx context.Context, id uint) error {
+	return affected(s.table(ctx).Where("id = ?", id).Where(live).Update("deleted_at", time.Now().UTC()))
+}
+
+func (s *sqlProducts) List(ctx context.Context) ([]Product, error) {
+	var products []Product
+	err := s.table(ctx).
+		Select("id, title, description, price, quantity, version").
+		Order("id").
+		Find(&products).Error
+	if err != nil {
+		return nil, translate(err)
+	}
+
+	// Only flag which products have an image; the bytes are served separately
+	var withImage []uint
+	err = s.table(ctx).Where(live).Where("image_data IS NOT NULL AND length(image_data) > 0").Pluck("id", &withImage).Error
+	if err != nil {
+		return nil, translate(err)
+	}
+	has := map[uint]bool{}
+	for _, id := range withImage {
+		has[id] = true
+	}
+	for i := range products {
+		if has[products[i].ID] {
+			products[i].ImageData = []byte{}
+		}
+	}
+	return products, nil
+}
+
+func (s *sqlProducts) Titles(ctx context.Context) ([]string, error) {
+	var titles []string
+	err := s.table(ctx).Where(live).Order("id").Pluck("title", &titles).Error
+	return titles, translate(err)
+}
+
+func (s *sqlProducts) Image(ctx context.Context, id uint) ([]byte, error) {
+	var product Product
+	err := s.table(ctx).Select("image_data").Where("id = ?", id).First(&product).Error
+	if err != nil {
+		return nil, translate(err)
+	}
+	if len(product.ImageData) == 0 {
+		return nil, ErrNotFound
+	}
+	return product.ImageData, nil
+}
+
+func (s *sqlProducts) ListDeleted(ctx context.Context) ([]Product, error) {
+	var products []Product
+	err := s.table(ctx).Unscoped().
+		Select("id, title, description, price, quantity, version, deleted_at").
+		Where("deleted_at IS NOT NULL").
+		Order("deleted_at DESC, id DESC").
+		Find(&products).Error
+	return products, translate(err)
+}
+
+func (s *sqlProducts) Restore(ctx context.Context, id uint) error {
+	return affected(s.table(ctx).Where("id = ? AND deleted_at IS NOT NULL", id).Update("deleted_at", gorm.Expr("NULL")))
+}
+
+// Carts drop the purged products. Orders keep them: they name the product by
+// title, not ID.
+func (s *sqlProducts) Purge(ctx context.Context, cutoff time.Time) (int64, error) {
+	var purged int64
+	err := transaction(withContext(ctx, s.db), func(tx *gorm.DB) error {
+		expired := tx.Table("product").Unscoped().Select("id").Where("deleted_at < ?", cutoff.UTC()).SubQuery()
+		if err := tx.Table("cart_items").Where("product_id IN ?", expired).Delete(&CartItem{}).Error; err != nil {
+			return err
+		}
+		result := tx.Table("product").Unscoped().Where("deleted_at < ?", cutoff.UTC()).Delete(&Product{})
+		purged = result.RowsAffected
+		return result.Error
+	})
+	return purged, translate(err)
+}
+
+type sqlOrders struct{ db *gorm.DB }
+
+func (s *sqlOrders) Create(ctx context.Context, order *Order) error {
+	return translate(withContext(ctx, s.db).Table("orders").Create(order).Error)
+}
+
+func (s *sqlOrders) List(ctx context.Context) ([]Order, error) {
+	var orders []Order
+	err := withContext(ctx, s.db).Table("orders").Order("id").Find(&orders).Error
+	return orders, translate(err)
+}
+
+type sqlCarts struct{ db *gorm.DB }
+
+func (s *sqlCarts) Items(ctx context.Context, accountID uint) (map[uint]int, error) {
+	var items []CartItem
+	err := withContext(ctx, s.db).Table("cart_items").Where("account_id = ?", accountID).Find(&items).Error
+	if err != nil {
+		return nil, translate(err)
+	}
+	cart := map[uint]int{}
+	for _, item := range items {
+		cart[item.ProductID] += item.Quantity
+	}
+	return cart, nil
+}
+
+func (s *sqlCarts) Add(ctx context.Context, accountID, productID uint, quantity int) (map[uint]int, error) {
+	err := transaction(withContext(ctx, s.db), func(tx *gorm.DB) error {
+		result := tx.Table("cart_items").
+			Where("account_id = ? AND product_id = ?", accountID, productID).
+			Updates(map[string]interface{}{
+				"quantity":   gorm.Expr("quantity + ?", quantity),
+				"updated_at": time.Now().UTC(),
+			})
+		if result.Error != nil || result.RowsAffected > 0 {
+			return result.Error
+		}
+		now := time.Now().UTC()
+		return tx.Table("cart_items").Create(&CartItem{
+			AccountID: accountID,
+			ProductID: productID,
+			Quantity:  quantity,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}).Error
+	})
+	if err != nil {
+		return nil, translate(err)
+	}
+	return s.Items(ctx, accountID)
+}
+
+func (s *sqlCarts) Remove(ctx context.Context, accountID, productID uint) (map[uint]int, error) {
+	err := withContext(ctx, s.db).Table("cart_items").
+		Where("account_id = ? AND product_id = ?", accountID, productID).
+		Delete(&CartItem{}).Error
+	if err != nil {
+		return nil, translate(err)
+	}
+	return s.Items(ctx, accountID)
+}
+
+type sqlPasskeys struct{ db *gorm.DB }
+
+func (s *sqlPasskeys) table(ctx context.Context) *gorm.DB {
+	return withContext(ctx, s.db).Table("passkey_credential")
+}
+
+func (s *sqlPasskeys) Create(ctx context.Context, credential *PasskeyCredential) error {
+	return translate(s.table(ctx).Create(credential).Error)
+}
+
+func (s *sqlPasskeys) ListByAccount(ctx context.Context, accountID uint) ([]PasskeyCredential, error) {
+	var credentials []PasskeyCredential
+	err := s.table(ctx).Where("account_id = ?", accountID).Order("id").Find(&credentials).Error
+	return credentials, translate(err)
+}
+
+func (s *sqlPasskeys) RecordUse(ctx context.Context, credentialID []byte, signCount uint32, at time.Time) error {
+	return affected(s.table(ctx).
+		Where("credential_id = ?", credentialID).
+		Updates(map[string]interface{}{"sign_count": signCount, "last_used_at": at}))
+}
+
+func (s *sqlPasskeys) Delete(ctx context.Context, id, accountID uint) error {
+	return affected(s.table(ctx).Where("id = ? AND account_id = ?", id, accountID).Delete(&PasskeyCredential{}))
+}
+
+type sqlIdentities struct{ db *gorm.DB }
+
+func (s *sqlIdentities) Find(ctx context.Context, provider, subject string) (ExternalIdentity, error) {
+	var identity ExternalIdentity
+	err := withContext(ctx, s.db).Table("external_identity").
+		Where("provider = ? AND subject = ?", provider, subject).
+		First(&identity).Error
+	return identity, translate(err)
+}
+
+func (s *sqlIdentities) Link(ctx context.Context, identity ExternalIdentity, newAccount Account) (Account, error) {
+	var account Account
+	err := transaction(withContext(ctx, s.db), func(tx *gorm.DB) error {
+		err := tx.Table("account").Where(emailMatch, identity.Email).First(&account).Error
+		if gorm.IsRecordNotFoundError(err) {
+			username, err := freeUsername(tx, newAccount.Username)
+			if err != nil {
+				return err
+			}
+			account = newAccount
+			account.Username = username
+			account.Version = 1
+			account.CreatedAt = now()
+			if err := tx.Table("account").Create(&account).Error; err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		} else if account.EmailVerifiedAt == nil {
+			return ErrUnverified
+		}
+
+		identity.AccountID = account.ID
+		return tx.Table("external_identity").Create(&identity).Error
+	})
+	return account, translate(err)
+}
+
+// Pick base, or base2, base3, ... whichever is not taken
+func freeUsername(tx *gorm.DB, base string) (string, error) {
+	candidate := base
+	for i := 2; ; i++ {
+		var count int
+		err := tx.Table("account").Where(usernameMatch, candidate).Count(&count).Error
+		if err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return candidate, nil
+		}
+		candidate = strings.TrimSpace(base) + strconv.Itoa(i)
+	}
+}
+
+type sqlSessions struct{ db *gorm.DB }
+
+// SQLite compares timestamps as text, so they are always stored in UTC
+func (s *sqlSessions) Create(ctx context.Context, session *Session) error {
+	session.ExpiresAt = session.ExpiresAt.UTC()
+	session.CreatedAt = session.CreatedAt.UTC()
+	return translate(withContext(ctx, s.db).Table("session").Create(session).Error)
+}
+
+func (s *sqlSessions) FindValid(ctx context.Context, tokenHash string, now time.Time) (Session, error) {
+	var session Session
+	err := withContext(ctx, s.db).Table("session").
+		Where("token_hash = ? AND expires_at > ?", tokenHash, now.UTC()).
+		First(&session).Error
+	return session, translate(err)
+}
+
+func (s *sqlSessions) Delete(ctx context.Context, tokenHash string) error {
+	return translate(withContext(ctx, s.db).Table("session").Where("token_hash = ?", tokenHash).Delete(&Session{}).Error)
+}
+
+func (s *sqlSessions) DeleteExpired(ctx context.Context, now time.Time) (int64, error) {
+	result := withContext(ctx, s.db).Table("session").Where("expires_at <= ?", now.UTC()).Delete(&Session{})
+	return result.RowsAffected, translate(result.Error)
+}
+
+type sqlAPIKeys struct{ db *gorm.DB }
+
+func (s *sqlAPIKeys) table(ctx context.Context) *gorm.DB {
+	return withContext(ctx, s.db).Table("api_key")
+}
+
+func (s *sqlAPIKeys) Create(ctx context.Context, key *APIKey) error {
+	return translate(s.table(ctx).Create(key).Error)
+}
+
+func (s *sqlAPIKeys) Get(ctx context.Context, id uint) (APIKey, error) {
+	var key APIKey
+	err := s.table(ctx).Where("id = ?", id).First(&key).Error
+	return key, translate(err)
+}
+
+func (s *sqlAPIKeys) FindByPrefix(ctx context.Context, prefix string) (APIKey, error) {
+	var key APIKey
+	err := s.table(ctx).Where("prefix = ?", prefix).First(&key).Error
+	return key, translate(err)
+}
+
+func (s *sqlAPIKeys) Touch(ctx context.Context, id uint, at time.Time) error {
+	return translate(s.table(ctx).Where("id = ?", id).Update("last_used_at", at).Error)
+}
+
+func (s *sqlAPIKeys) List(ctx context.Context) ([]APIKey, error) {
+	var keys []APIKey
+	err := s.table(ctx).Order("id").Find(&keys).Error
+	return keys, translate(err)
+}
+
+func (s *sqlAPIKeys) Delete(ctx context.Context, id uint) error {
+	return affected(s.table(ctx).Where("id = ?", id).Delete(&APIKey{}))
+}
+
+type sqlAudit struct{ db *gorm.DB }
+
+func (s *sqlAudit) table(ctx context.Context) *gorm.DB {
+	return withContext(ctx, s.db).Table("audit_log")
+}
+
+// Timestamps are stored in UTC, as for sessions
+func (s *sqlAudit) Append(ctx context.Context, entry *AuditEntry) error {
+	entry.CreatedAt = entry.CreatedAt.UTC()
+	return translate(s.table(ctx).Create(entry).Error)
+}
+
+func (s *sqlAudit) List(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	query := s.table(ctx)
+	if filter.ActorType != "" {
+		query = query.Where("actor_type = ?", filter.ActorType)
+	}
+	if filter.ActorID != 0 {
+		query = query.Where("actor_id = ?", filter.ActorID)
+	}
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+	if filter.TargetType != "" {
+		query = query.Where("target_type = ?", filter.TargetType)
+	}
+	if filter.TargetID != 0 {
+		query = query.Where("target_id = ?", filter.TargetID)
+	}
+	if !filter.From.IsZero() {
+		query = query.Where("created_at >= ?", filter.From.UTC())
+	}
+	if !filter.To.IsZero() {
+		query = query.Where("created_at < ?", filter.To.UTC())
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+	if filter.Offset > 0 {
+		query = query.Offset(filter.Offset)
+	}
+
+	var entries []AuditEntry
+	err := query.Order("created_at DESC, id DESC").Find(&entries).Error
+	return entries, translate(err)
+}
+
+type sqlTx struct{ db *gorm.DB }
+
+func (s *sqlTx) Run(ctx context.Context, fn func(tx Stores) error) error {
+	return translate(transaction(withContext(ctx, s.db), func(tx *gorm.DB) error {
+		return fn(NewSQL(tx))
+	}))
+}
+
+// Run fn in a transaction, or in the current one when db is already in one
+func transaction(db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	if _, inTx := db.CommonDB().(*sql.Tx); inTx {
+		return fn(db)
+	}
+	return db.Transaction(fn)
+}
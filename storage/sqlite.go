@@ -0,0 +1,29 @@
+package storage
+
+import (
+	"net/url"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+// NewSQLiteConnection opens (creating when missing) the SQLite database file
+// at path. Foreign keys are switched on to match Postgres, and one connection
+// is shared because SQLite allows a single writer at a time anyway.
+func NewSQLiteConnection(path string) (*gorm.DB, error) {
+	params := url.Values{
+		"_foreign_keys": {"1"},
+		"_busy_timeout": {"5000"},
+		"_journal_mode": {"WAL"},
+	}
+	conn, err := gorm.Open("sqlite3", "file:"+path+"?"+params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	conn.DB().SetMaxOpenConns(1)
+	conn.SetLogger(gormLogger{})
+	logErrors(conn)
+
+	db = conn
+	return db, nil
+}
@@ -0,0 +1,234 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when the requested row does not exist
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when a write would break a uniqueness rule
+	ErrConflict = errors.New("conflict")
+	// ErrStale is returned when a conditional update finds the row at a
+	// different version than expected
+	ErrStale = errors.New("stale version")
+	// ErrOutOfStock is returned when a product has less stock than requested
+	ErrOutOfStock = errors.New("out of stock")
+	// ErrUnverified is returned when linking an identity to an account whose
+	// email has not been verified
+	ErrUnverified = errors.New("email not verified")
+	// ErrInvalidSort is returned for a sort order a store doesn't know
+	ErrInvalidSort = errors.New("invalid sort")
+)
+
+// AccountStore persists accounts. Usernames and emails are unique among live
+// accounts and matched case-insensitively, ignoring surrounding spaces.
+// Deleted accounts go to the trash, where only ListDeleted, Restore and Purge
+// see them. Version starts at 1 and goes up with every Update.
+type AccountStore interface {
+	Create(ctx context.Context, account *Account) error
+	Get(ctx context.Context, id uint) (Account, error)
+	FindByUsername(ctx context.Context, username string) (Account, error)
+	FindByEmail(ctx context.Context, email string) (Account, error)
+	// FindByLogin matches either the username or the email
+	FindByLogin(ctx context.Context, login string) (Account, error)
+	// Update writes the set fields of patch and bumps the version. A
+	// non-zero version must be the current one, or nothing is written and
+	// the error is ErrStale.
+	Update(ctx context.Context, id uint, version int, patch AccountPatch) error
+	SetPassword(ctx context.Context, id uint, hash string) error
+	// ReplacePassword swaps the hash only if it is still current, so a
+	// background rehash can't undo a concurrent password change
+	ReplacePassword(ctx context.Context, id uint, current, replacement string) error
+	// Delete moves the account to the trash and ends its sessions
+	Delete(ctx context.Context, id uint) error
+	List(ctx context.Context) ([]Account, error)
+	Usernames(ctx context.Context) ([]string, error)
+	// ListDeleted returns the trash, most recently deleted first
+	ListDeleted(ctx context.Context) ([]Account, error)
+	// Restore takes an account out of the trash; ErrConflict means its
+	// username or email has been taken since
+	Restore(ctx context.Context, id uint) error
+	// Purge removes accounts deleted before cutoff for good, with their
+	// passkeys, linked identities and carts, returning how many. Their
+	// orders are kept for the books but no longer point at them: they move
+	// to the anonymous account 0.
+	Purge(ctx context.Context, cutoff time.Time) (int64, error)
+	// RecordLogin sets the last login time without bumping the version
+	RecordLogin(ctx context.Context, id uint, at time.Time) error
+	// VerifyEmail marks the current email verified and bumps the version; a
+	// non-zero version must be the current one, as for Update
+	VerifyEmail(ctx context.Context, id uint, version int, at time.Time) error
+	// Directory returns a page of the accounts matching filter and how many
+	// match in all
+	Directory(ctx context.Context, filter AccountFilter) ([]AccountSummary, int64, error)
+}
+
+// AccountFilter narrows and orders the user directory; zero fields match
+// everything. SignedUpFrom is inclusive and SignedUpTo exclusive, and
+// accounts with no signup time only match when both are zero.
+type AccountFilter struct {
+	// Search matches a substring of the full name, email or username,
+	// ignoring case
+	Search string
+	Role   string
+	// Deleted picks the trash (true) or live accounts (false); nil means both
+	Deleted      *bool
+	Verified     *bool
+	SignedUpFrom time.Time
+	SignedUpTo   time.Time
+	// Sort is one of the AccountSorts, prefixed with - for descending order;
+	// empty sorts by ID. Ties go by ID, and unknown times sort last.
+	Sort string
+	// Limit 0 returns every match
+	Limit  int
+	Offset int
+}
+
+// AccountSorts are the orders the user directory can be sorted in
+var AccountSorts = []string{"username", "fullname", "email", "created_at", "last_login_at", "order_count"}
+
+// Split a sort into the field and direction; ok is false for unknown fields
+func parseSort(sort string, fields []string) (field string, descending, ok bool) {
+	if sort == "" {
+		return "", false, true
+	}
+	field = strings.TrimPrefix(sort, "-")
+	for _, known := range fields {
+		if field == known {
+			return field, field != sort, true
+		}
+	}
+	return "", false, false
+}
+
+// ProductStore persists products. Deleted products go to the trash, where
+// only ListDeleted, Restore and Purge see them. Version starts at 1 and goes
+// up with every Update and TakeStock.
+type ProductStore interface {
+	Create(ctx context.Context, product *Product) error
+	Get(ctx context.Context, id uint) (Product, error)
+	FindByTitle(ctx context.Context, title string) (Product, error)
+	// Update writes the set fields of patch and bumps the version. A
+	// non-zero version must be the current one, or nothing is written and
+	// the error is ErrStale.
+	Update(ctx context.Context, id uint, version int, patch ProductPatch) error
+	// TakeStock lowers the quantity in one conditional write, failing with
+	// ErrOutOfStock rather than going below zero
+	TakeStock(ctx context.Context, id uint, quantity int) error
+	Delete(ctx context.Context, id uint) error
+	// List leaves ImageData empty; use Image to fetch it
+	List(ctx context.Context) ([]Product, error)
+	Titles(ctx context.Context) ([]string, error)
+	Image(ctx context.Context, id uint) ([]byte, error)
+	// ListDeleted returns the trash, most recently deleted first, without
+	// image data
+	ListDeleted(ctx context.Context) ([]Product, error)
+	Restore(ctx context.Context, id uint) error
+	// Purge removes products deleted before cutoff for good, and from every
+	// cart, returning how many
+	Purge(ctx context.Context, cutoff time.Time) (int64, error)
+}
+
+// OrderStore persists orders
+type OrderStore interface {
+	Create(ctx context.Context, order *Order) error
+	List(ctx context.Context) ([]Order, error)
+}
+
+// CartStore keeps product quantities per account
+type CartStore interface {
+	// Add increases the quantity of a product and returns the whole cart
+	Add(ctx context.Context, accountID, productID uint, quantity int) (map[uint]int, error)
+	// Remove drops a product and returns the whole cart
+	Remove(ctx context.Context, accountID, productID uint) (map[uint]int, error)
+	Items(ctx context.Context, accountID uint) (map[uint]int, error)
+}
+
+// PasskeyStore persists WebAuthn credentials
+type PasskeyStore interface {
+	Create(ctx context.Context, credential *PasskeyCredential) error
+	ListByAccount(ctx context.Context, accountID uint) ([]PasskeyCredential, error)
+	RecordUse(ctx context.Context, credentialID []byte, signCount uint32, at time.Time) error
+	Delete(ctx context.Context, id, accountID uint) error
+}
+
+// IdentityStore links external identity provider subjects to accounts
+type IdentityStore interface {
+	Find(ctx context.Context, provider, subject string) (ExternalIdentity, error)
+	// Link atomically attaches identity to the account with identity.Email,
+	// or creates newAccount (picking a free username based on its Username)
+	// when no account has that email. It returns the linked account. An
+	// existing account is only linked once its email is verified, else the
+	// error is ErrUnverified; linking never marks an existing account's email
+	// verified.
+	Link(ctx context.Context, identity ExternalIdentity, newAccount Account) (Account, error)
+}
+
+// SessionStore persists login sessions
+type SessionStore interface {
+	Create(ctx context.Context, session *Session) error
+	// FindValid returns the unexpired session with the token hash
+	FindValid(ctx context.Context, tokenHash string, now time.Time) (Session, error)
+	Delete(ctx context.Context, tokenHash string) error
+	// DeleteExpired removes sessions that expired by now, returning how many
+	DeleteExpired(ctx context.Context, now time.Time) (int64, error)
+}
+
+// APIKeyStore persists API keys
+type APIKeyStore interface {
+	Create(ctx context.Context, key *APIKey) error
+	Get(ctx context.Context, id uint) (APIKey, error)
+	FindByPrefix(ctx context.Context, prefix string) (APIKey, error)
+	Touch(ctx context.Context, id uint, at time.Time) error
+	List(ctx context.Context) ([]APIKey, error)
+	Delete(ctx context.Context, id uint) error
+}
+
+// AuditFilter narrows an audit log query; zero fields match everything.
+// From is inclusive and To exclusive.
+type AuditFilter struct {
+	ActorType  string
+	ActorID    uint
+	Action     string
+	TargetType string
+	TargetID   uint
+	From       time.Time
+	To         time.Time
+	// Limit 0 returns every match
+	Limit  int
+	Offset int
+}
+
+// AuditStore is the append-only log of privileged changes; entries are never
+// updated or deleted
+type AuditStore interface {
+	Append(ctx context.Context, entry *AuditEntry) error
+	// List returns the entries matching filter, newest first
+	List(ctx context.Context, filter AuditFilter) ([]AuditEntry, error)
+}
+
+// Transactor makes several store calls atomic
+type Transactor interface {
+	// Run calls fn with stores bound to one transaction, committed when fn
+	// returns nil and rolled back otherwise. fn must only use the stores it
+	// is given; a Run inside fn joins the same transaction.
+	Run(ctx context.Context, fn func(tx Stores) error) error
+}
+
+// Stores bundles every store a server needs
+type Stores struct {
+	Accounts   AccountStore
+	Products   ProductStore
+	Orders     OrderStore
+	Carts      CartStore
+	Passkeys   PasskeyStore
+	Identities IdentityStore
+	Sessions   SessionStore
+	APIKeys    APIKeyStore
+	Audit      AuditStore
+	Tx         Transactor
+}
@@ -0,0 +1,423 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Traced wraps every store so each call runs in its own span, a child of the
+// span carried by ctx. Missing rows and conflicts are expected outcomes and
+// don't mark the span as failed.
+func Traced(stores Stores, tracer trace.Tracer) Stores {
+	return Stores{
+		Accounts:   tracedAccounts{stores.Accounts, tracer},
+		Products:   tracedProducts{stores.Products, tracer},
+		Orders:     tracedOrders{stores.Orders, tracer},
+		Carts:      tracedCarts{stores.Carts, tracer},
+		Passkeys:   tracedPasskeys{stores.Passkeys, tracer},
+		Identities: tracedIdentities{stores.Identities, tracer},
+		Sessions:   tracedSessions{stores.Sessions, tracer},
+		APIKeys:    tracedAPIKeys{stores.APIKeys, tracer},
+		Audit:      tracedAudit{stores.Audit, tracer},
+		Tx:         tracedTx{stores.Tx, tracer},
+	}
+}
+
+func startSpan(ctx context.Context, tracer trace.Tracer, name string) (context.Context, func(error)) {
+	ctx, span := tracer.Start(ctx, "store."+name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.operation", name)))
+	return ctx, func(err error) {
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrNotFound):
+			span.SetAttributes(attribute.String("store.result", "not_found"))
+		case errors.Is(err, ErrConflict):
+			span.SetAttributes(attribute.String("store.result", "conflict"))
+		case errors.Is(err, ErrStale):
+			span.SetAttributes(attribute.String("store.result", "stale"))
+		case errors.Is(err, ErrOutOfStock):
+			span.SetAttributes(attribute.String("store.result", "out_of_stock"))
+		default:
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+type tracedAccounts struct {
+	next   AccountStore
+	tracer trace.Tracer
+}
+
+func (s tracedAccounts) Create(ctx context.Context, account *Account) (err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Accounts.Create")
+	defer func() { end(err) }()
+	return s.next.Create(ctx, account)
+}
+
+func (s tracedAccounts) Get(ctx context.Context, id uint) (result Account, err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Accounts.Get")
+	defer func() { end(err) }()
+	return s.next.Get(ctx, id)
+}
+
+func (s tracedAccounts) FindByUsername(ctx context.Context, username string) (result Account, err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Accounts.FindByUsername")
+	defer func() { end(err) }()
+	return s.next.FindByUsername(ctx, username)
+}
+
+func (s tracedAccounts) FindByEmail(ctx context.Context, email string) (result Account, err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Accounts.FindByEmail")
+	defer func() { end(err) }()
+	return s.next.FindByEmail(ctx, email)
+}
+
+func (s tracedAccounts) FindByLogin(ctx context.Context, login string) (result Account, err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Accounts.FindByLogin")
+	defer func() { end(err) }()
+	return s.next.FindByLogin(ctx, login)
+}
+
+func (s tracedAccounts) Update(ctx context.Context, id uint, version int, patch AccountPatch) (err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Accounts.Update")
+	defer func() { end(err) }()
+	return s.next.Update(ctx, id, version, patch)
+}
+
+func (s tracedAccounts) SetPassword(ctx context.Context, id uint, hash string) (err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Accounts.SetPassword")
+	defer func() { end(err) }()
+	return s.next.SetPassword(ctx, id, hash)
+}
+
+func (s tracedAccounts) ReplacePassword(ctx context.Context, id uint, current, replacement string) (err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Accounts.ReplacePassword")
+	defer func() { end(err) }()
+	return s.next.ReplacePassword(ctx, id, current, replacement)
+}
+
+func (s tracedAccounts) Delete(ctx context.Context, id uint) (err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Accounts.Delete")
+	defer func() { end(err) }()
+	return s.next.Delete(ctx, id)
+}
+
+func (s tracedAccounts) List(ctx context.Context) (result []Account, err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Accounts.List")
+	defer func() { end(err) }()
+	return s.next.List(ctx)
+}
+
+func (s tracedAccounts) Usernames(ctx context.Context) (result []string, err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Accounts.Usernames")
+	defer func() { end(err) }()
+	return s.next.Usernames(ctx)
+}
+
+func (s tracedAccounts) ListDeleted(ctx context.Context) (result []Account, err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Accounts.ListDeleted")
+	defer func() { end(err) }()
+	return s.next.ListDeleted(ctx)
+}
+
+func (s tracedAccounts) Restore(ctx context.Context, id uint) (err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Accounts.Restore")
+	defer func() { end(err) }()
+	return s.next.Restore(ctx, id)
+}
+
+func (s tracedAccounts) Purge(ctx context.Context, cutoff time.Time) (result int64, err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Accounts.Purge")
+	defer func() { end(err) }()
+	return s.next.Purge(ctx, cutoff)
+}
+
+func (s tracedAccounts) RecordLogin(ctx context.Context, id uint, at time.Time) (err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Accounts.RecordLogin")
+	defer func() { end(err) }()
+	return s.next.RecordLogin(ctx, id, at)
+}
+
+func (s tracedAccounts) VerifyEmail(ctx context.Context, id uint, version int, at time.Time) (err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Accounts.VerifyEmail")
+	defer func() { end(err) }()
+	return s.next.VerifyEmail(ctx, id, version, at)
+}
+
+func (s tracedAccounts) Directory(ctx context.Context, filter AccountFilter) (result []AccountSummary, total int64, err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Accounts.Directory")
+	defer func() { end(err) }()
+	return s.next.Directory(ctx, filter)
+}
+
+type tracedProducts struct {
+	next   ProductStore
+	tracer trace.Tracer
+}
+
+func (s tracedProducts) Create(ctx context.Context, product *Product) (err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Products.Create")
+	defer func() { end(err) }()
+	return s.next.Create(ctx, product)
+}
+
+func (s tracedProducts) Get(ctx context.Context, id uint) (result Product, err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Products.Get")
+	defer func() { end(err) }()
+	return s.next.Get(ctx, id)
+}
+
+func (s tracedProducts) FindByTitle(ctx context.Context, title string) (result Product, err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Products.FindByTitle")
+	defer func() { end(err) }()
+	return s.next.FindByTitle(ctx, title)
+}
+
+func (s tracedProducts) Update(ctx context.Context, id uint, version int, patch ProductPatch) (err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Products.Update")
+	defer func() { end(err) }()
+	return s.next.Update(ctx, id, version, patch)
+}
+
+func (s tracedProducts) TakeStock(ctx context.Context, id uint, quantity int) (err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Products.TakeStock")
+	defer func() { end(err) }()
+	return s.next.TakeStock(ctx, id, quantity)
+}
+
+func (s tracedProducts) Delete(ctx context.Context, id uint) (err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Products.Delete")
+	defer func() { end(err) }()
+	return s.next.Delete(ctx, id)
+}
+
+func (s tracedProducts) List(ctx context.Context) (result []Product, err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Products.List")
+	defer func() { end(err) }()
+	return s.next.List(ctx)
+}
+
+func (s tracedProducts) Titles(ctx context.Context) (result []string, err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Products.Titles")
+	defer func() { end(err) }()
+	return s.next.Titles(ctx)
+}
+
+func (s tracedProducts) Image(ctx context.Context, id uint) (result []byte, err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Products.Image")
+	defer func() { end(err) }()
+	return s.next.Image(ctx, id)
+}
+
+func (s tracedProducts) ListDeleted(ctx context.Context) (result []Product, err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Products.ListDeleted")
+	defer func() { end(err) }()
+	return s.next.ListDeleted(ctx)
+}
+
+func (s tracedProducts) Restore(ctx context.Context, id uint) (err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Products.Restore")
+	defer func() { end(err) }()
+	return s.next.Restore(ctx, id)
+}
+
+func (s tracedProducts) Purge(ctx context.Context, cutoff time.Time) (result int64, err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Products.Purge")
+	defer func() { end(err) }()
+	return s.next.Purge(ctx, cutoff)
+}
+
+type tracedOrders struct {
+	next   OrderStore
+	tracer trace.Tracer
+}
+
+func (s tracedOrders) Create(ctx context.Context, order *Order) (err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Orders.Create")
+	defer func() { end(err) }()
+	return s.next.Create(ctx, order)
+}
+
+func (s tracedOrders) List(ctx context.Context) (result []Order, err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Orders.List")
+	defer func() { end(err) }()
+	return s.next.List(ctx)
+}
+
+type tracedCarts struct {
+	next   CartStore
+	tracer trace.Tracer
+}
+
+func (s tracedCarts) Add(ctx context.Context, accountID, productID uint, quantity int) (result map[uint]int, err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Carts.Add")
+	defer func() { end(err) }()
+	return s.next.Add(ctx, accountID, productID, quantity)
+}
+
+func (s tracedCarts) Remove(ctx context.Context, accountID, productID uint) (result map[uint]int, err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Carts.Remove")
+	defer func() { end(err) }()
+	return s.next.Remove(ctx, accountID, productID)
+}
+
+func (s tracedCarts) Items(ctx context.Context, accountID uint) (result map[uint]int, err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Carts.Items")
+	defer func() { end(err) }()
+	return s.next.Items(ctx, accountID)
+}
+
+type tracedPasskeys struct {
+	next   PasskeyStore
+	tracer trace.Tracer
+}
+
+func (s tracedPasskeys) Create(ctx context.Context, credential *PasskeyCredential) (err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Passkeys.Create")
+	defer func() { end(err) }()
+	return s.next.Create(ctx, credential)
+}
+
+func (s tracedPasskeys) ListByAccount(ctx context.Context, accountID uint) (result []PasskeyCredential, err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Passkeys.ListByAccount")
+	defer func() { end(err) }()
+	return s.next.ListByAccount(ctx, accountID)
+}
+
+func (s tracedPasskeys) RecordUse(ctx context.Context, credentialID []byte, signCount uint32, at time.Time) (err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Passkeys.RecordUse")
+	defer func() { end(err) }()
+	return s.next.RecordUse(ctx, credentialID, signCount, at)
+}
+
+func (s tracedPasskeys) Delete(ctx context.Context, id, accountID uint) (err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Passkeys.Delete")
+	defer func() { end(err) }()
+	return s.next.Delete(ctx, id, accountID)
+}
+
+type tracedIdentities struct {
+	next   IdentityStore
+	tracer trace.Tracer
+}
+
+func (s tracedIdentities) Find(ctx context.Context, provider, subject string) (result ExternalIdentity, err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Identities.Find")
+	defer func() { end(err) }()
+	return s.next.Find(ctx, provider, subject)
+}
+
+func (s tracedIdentities) Link(ctx context.Context, identity ExternalIdentity, newAccount Account) (result Account, err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Identities.Link")
+	defer func() { end(err) }()
+	return s.next.Link(ctx, identity, newAccount)
+}
+
+type tracedSessions struct {
+	next   SessionStore
+	tracer trace.Tracer
+}
+
+func (s tracedSessions) Create(ctx context.Context, session *Session) (err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Sessions.Create")
+	defer func() { end(err) }()
+	return s.next.Create(ctx, session)
+}
+
+func (s tracedSessions) FindValid(ctx context.Context, tokenHash string, now time.Time) (result Session, err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Sessions.FindValid")
+	defer func() { end(err) }()
+	return s.next.FindValid(ctx, tokenHash, now)
+}
+
+func (s tracedSessions) Delete(ctx context.Context, tokenHash string) (err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Sessions.Delete")
+	defer func() { end(err) }()
+	return s.next.Delete(ctx, tokenHash)
+}
+
+func (s tracedSessions) DeleteExpired(ctx context.Context, now time.Time) (result int64, err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Sessions.DeleteExpired")
+	defer func() { end(err) }()
+	return s.next.DeleteExpired(ctx, now)
+}
+
+type tracedAPIKeys struct {
+	next   APIKeyStore
+	tracer trace.Tracer
+}
+
+func (s tracedAPIKeys) Create(ctx context.Context, key *APIKey) (err error) {
+	ctx, end := startSpan(ctx, s.tracer, "APIKeys.Create")
+	defer func() { end(err) }()
+	return s.next.Create(ctx, key)
+}
+
+func (s tracedAPIKeys) Get(ctx context.Context, id uint) (result APIKey, err error) {
+	ctx, end := startSpan(ctx, s.tracer, "APIKeys.Get")
+	defer func() { end(err) }()
+	return s.next.Get(ctx, id)
+}
+
+func (s tracedAPIKeys) FindByPrefix(ctx context.Context, prefix string) (result APIKey, err error) {
+	ctx, end := startSpan(ctx, s.tracer, "APIKeys.FindByPrefix")
+	defer func() { end(err) }()
+	return s.next.FindByPrefix(ctx, prefix)
+}
+
+func (s tracedAPIKeys) Touch(ctx context.Context, id uint, at time.Time) (err error) {
+	ctx, end := startSpan(ctx, s.tracer, "APIKeys.Touch")
+	defer func() { end(err) }()
+	return s.next.Touch(ctx, id, at)
+}
+
+func (s tracedAPIKeys) List(ctx context.Context) (result []APIKey, err error) {
+	ctx, end := startSpan(ctx, s.tracer, "APIKeys.List")
+	defer func() { end(err) }()
+	return s.next.List(ctx)
+}
+
+func (s tracedAPIKeys) Delete(ctx context.Context, id uint) (err error) {
+	ctx, end := startSpan(ctx, s.tracer, "APIKeys.Delete")
+	defer func() { end(err) }()
+	return s.next.Delete(ctx, id)
+}
+
+type tracedAudit struct {
+	next   AuditStore
+	tracer trace.Tracer
+}
+
+func (s tracedAudit) Append(ctx context.Context, entry *AuditEntry) (err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Audit.Append")
+	defer func() { end(err) }()
+	return s.next.Append(ctx, entry)
+}
+
+func (s tracedAudit) List(ctx context.Context, filter AuditFilter) (result []AuditEntry, err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Audit.List")
+	defer func() { end(err) }()
+	return s.next.List(ctx, filter)
+}
+
+// The calls made inside the transaction are traced as children of its span
+type tracedTx struct {
+	next   Transactor
+	tracer trace.Tracer
+}
+
+func (s tracedTx) Run(ctx context.Context, fn func(tx Stores) error) (err error) {
+	ctx, end := startSpan(ctx, s.tracer, "Tx.Run")
+	defer func() { end(err) }()
+	return s.next.Run(ctx, func(tx Stores) error {
+		return fn(Traced(tx, s.tracer))
+	})
+}
@@ -0,0 +1,158 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+
+	"m/v2/migrate"
+	"m/v2/storage"
+)
+
+// A new SQLite database, migrated
+func newSQLite(t *testing.T) *gorm.DB {
+	t.Helper()
+	conn, err := storage.NewSQLiteConnection(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	migrator, err := migrate.New(conn.DB(), "sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// Every store implementation, empty
+func newStores(t *testing.T) map[string]storage.Stores {
+	t.Helper()
+	return map[string]storage.Stores{
+		"memory": storage.NewMemory(),
+		"sqlite": storage.NewSQL(newSQLite(t)),
+	}
+}
+
+func TestTxAtomic(t *testing.T) {
+	errFail := errors.New("fail")
+	ctx := context.Background()
+
+	for name, stores := range newStores(t) {
+		t.Run(name, func(t *testing.T) {
+			// Write to several tables in one transaction
+			write := func(tx storage.Stores, username string) error {
+				account := storage.Account{Username: username, Email: username + "@example.com", Role: "user"}
+				if err := tx.Accounts.Create(ctx, &account); err != nil {
+					return err
+				}
+				product := storage.Product{Title: "Lamp for " + username, Price: 10, Quantity: 5}
+				if err := tx.Products.Create(ctx, &product); err != nil {
+					return err
+				}
+				if _, err := tx.Carts.Add(ctx, account.ID, product.ID, 2); err != nil {
+					return err
+				}
+				return tx.Audit.Append(ctx, &storage.AuditEntry{Action: "user.create", TargetType: "user", TargetID: account.ID})
+			}
+			written := func(username string) bool {
+				t.Helper()
+				account, err := stores.Accounts.FindByUsername(ctx, username)
+				if errors.Is(err, storage.ErrNotFound) {
+					if _, err := stores.Products.FindByTitle(ctx, "Lamp for "+username); !errors.Is(err, storage.ErrNotFound) {
+						t.Errorf("%s: the product outlived the account (%v)", username, err)
+					}
+					return false
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				items, err := stores.Carts.Items(ctx, account.ID)
+				if err != nil || len(items) != 1 {
+					t.Errorf("%s: cart %v (%v)", username, items, err)
+				}
+				return true
+			}
+			auditEntries := func() int {
+				t.Helper()
+				entries, err := stores.Audit.List(ctx, storage.AuditFilter{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return len(entries)
+			}
+
+			// An error rolls back every write
+			err := stores.Tx.Run(ctx, func(tx storage.Stores) error {
+				if err := write(tx, "ann"); err != nil {
+					return err
+				}
+				return errFail
+			})
+			if err != errFail {
+				t.Fatalf("Run = %v, want fn's error", err)
+			}
+			if written("ann") || auditEntries() != 0 {
+				t.Fatal("a failed transaction left writes behind")
+			}
+
+			// A store error half way does too
+			err = stores.Tx.Run(ctx, func(tx storage.Stores) error {
+				if err := write(tx, "ben"); err != nil {
+					return err
+				}
+				return write(tx, "BEN")
+			})
+			if !errors.Is(err, storage.ErrConflict) {
+				t.Fatalf("Run = %v, want a conflict", err)
+			}
+			if written("ben") || auditEntries() != 0 {
+				t.Fatal("a transaction failing on a conflict left writes behind")
+			}
+
+			// A nested Run joins the outer transaction and rolls back with it
+			err = stores.Tx.Run(ctx, func(tx storage.Stores) error {
+				if err := tx.Tx.Run(ctx, func(tx storage.Stores) error { return write(tx, "cat") }); err != nil {
+					return err
+				}
+				return errFail
+			})
+			if err != errFail || written("cat") || auditEntries() != 0 {
+				t.Fatalf("nested: Run = %v; the inner writes outlived the outer transaction", err)
+			}
+
+			// Success commits everything
+			err = stores.Tx.Run(ctx, func(tx storage.Stores) error {
+				if err := write(tx, "dan"); err != nil {
+					return err
+				}
+				return tx.Tx.Run(ctx, func(tx storage.Stores) error { return write(tx, "eve") })
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !written("dan") || !written("eve") || auditEntries() != 2 {
+				t.Fatal("a committed transaction lost writes")
+			}
+
+			// Rolling back doesn't touch what was committed before
+			err = stores.Tx.Run(ctx, func(tx storage.Stores) error {
+				if _, err := tx.Accounts.FindByUsername(ctx, "dan"); err != nil {
+					return err
+				}
+				if err := write(tx, "fay"); err != nil {
+					return err
+				}
+				return errFail
+			})
+			if err != errFail || written("fay") || !written("dan") || auditEntries() != 2 {
+				t.Fatalf("Run = %v; rolling back changed committed rows", err)
+			}
+		})
+	}
+}
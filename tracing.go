@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"m/v2/config"
+)
+
+// Spans from handlers and password hashing. Store calls get their own spans
+// from storage.Traced. Until setupTracing installs a provider this is a no-op.
+var tracer = otel.Tracer("m/v2")
+
+// Install the tracer provider for cfg and the W3C trace context propagator.
+// The returned function flushes pending spans; call it on shutdown.
+func setupTracing(cfg config.Tracing) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case "none":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "otlp":
+		var options []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			// Validated by config
+			endpoint, _ := url.Parse(cfg.Endpoint)
+			options = append(options, otlptracehttp.WithEndpoint(endpoint.Host))
+			if endpoint.Scheme == "http" {
+				options = append(options, otlptracehttp.WithInsecure())
+			}
+			if endpoint.Path != "" && endpoint.Path != "/" {
+				options = append(options, otlptracehttp.WithURLPath(endpoint.Path))
+			}
+		}
+		exporter, err = otlptracehttp.New(context.Background(), options...)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating the %s trace exporter: %w", cfg.Exporter, err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceName(cfg.ServiceName)))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// fiberHeaders lets the propagator read and write Fiber request headers
+type fiberHeaders struct {
+	context *fiber.Ctx
+}
+
+func (h fiberHeaders) Get(key string) string {
+	return h.context.Get(key)
+}
+
+func (h fiberHeaders) Set(key, value string) {
+	h.context.Request().Header.Set(key, value)
+}
+
+func (h fiberHeaders) Keys() []string {
+	var keys []string
+	h.context.Request().Header.VisitAll(func(key, _ []byte) {
+		keys = append(keys, string(key))
+	})
+	return keys
+}
+
+// Tracing runs each request in a server span, continuing the caller's trace
+// when the request carries a traceparent header. Like Metrics, it sits
+// outside AccessLog so the recorded status is the one sent.
+func Tracing(context *fiber.Ctx) error {
+	ctx := otel.GetTextMapPropagator().Extract(context.UserContext(), fiberHeaders{context})
+	// Fiber reuses its buffers once the request is done; spans outlive it
+	method := utils.CopyString(context.Method())
+	ctx, span := tracer.Start(ctx, method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPMethod(method),
+			semconv.URLPath(utils.CopyString(context.Path())),
+			semconv.UserAgentOriginal(utils.CopyString(context.Get(fiber.HeaderUserAgent))),
+			semconv.ClientAddress(utils.CopyString(context.IP())),
+		))
+	defer span.End()
+	if requestID, ok := context.Locals("requestid").(string); ok {
+		span.SetAttributes(attribute.String("request_id", utils.CopyString(requestID)))
+	}
+
+	context.SetUserContext(ctx)
+	err := context.Next()
+
+	// The route is only known once routing has happened
+	route := context.Route().Path
+	span.SetName(method + " " + route)
+	status := context.Response().StatusCode()
+	span.SetAttributes(semconv.HTTPRoute(route), semconv.HTTPStatusCode(status))
+	if status >= fiber.StatusInternalServerError {
+		span.SetStatus(codes.Error, fmt.Sprint(status))
+	}
+	return err
+}
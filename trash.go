@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+
+	"m/v2/storage"
+)
+
+// Deleted accounts and products wait in the trash, hidden from every other
+// route, until an admin restores them or the purge job removes them after
+// the retention period.
+
+// List deleted accounts by Admin, most recently deleted first
+func (r *Repository) GetDeletedUsers(context *fiber.Ctx) error {
+	accounts, err := r.Stores.Accounts.ListDeleted(context.UserContext())
+	if err != nil {
+		return internalError(err)
+	}
+
+	return context.JSON(newAccountResponses(accounts))
+}
+
+// Restore a deleted account by Admin
+func (r *Repository) RestoreUser(context *fiber.Ctx) error {
+	accountID, err := paramID(context, "id", "user")
+	if err != nil {
+		return err
+	}
+
+	ctx := context.UserContext()
+	err = r.audited(context, AuditUserRestore, "user", func(tx storage.Stores) (auditChange, error) {
+		if err := tx.Accounts.Restore(ctx, accountID); err != nil {
+			return auditChange{}, err
+		}
+		account, err := tx.Accounts.Get(ctx, accountID)
+		return auditChange{TargetID: accountID, After: accountAuditFields(account)}, err
+	})
+	if err != nil {
+		return storeError(err, "User not found in the trash", "username or email is taken by another account")
+	}
+
+	return context.Status(http.StatusOK).JSON(
+		&fiber.Map{"message": "User account restored successfully"})
+}
+
+// List deleted products by Admin, most recently deleted first
+func (r *Repository) GetDeletedProducts(context *fiber.Ctx) error {
+	products, err := r.Stores.Products.ListDeleted(context.UserContext())
+	if err != nil {
+		return internalError(err)
+	}
+
+	return context.JSON(newProductResponses(products))
+}
+
+// Restore a deleted product by Admin
+func (r *Repository) RestoreProduct(context *fiber.Ctx) error {
+	productID, err := paramID(context, "id", "product")
+	if err != nil {
+		return err
+	}
+
+	ctx := context.UserContext()
+	err = r.audited(context, AuditProductRestore, "product", func(tx storage.Stores) (auditChange, error) {
+		if err := tx.Products.Restore(ctx, productID); err != nil {
+			return auditChange{}, err
+		}
+		product, err := tx.Products.Get(ctx, productID)
+		return auditChange{TargetID: productID, After: productAuditFields(product)}, err
+	})
+	if err != nil {
+		return storeError(err, "Product not found in the trash", "")
+	}
+
+	return context.Status(http.StatusOK).JSON(
+		&fiber.Map{"message": "Product restored successfully"})
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"m/v2/storage"
+)
+
+// Version 1 of the API: resources addressed by ID under /api/v1. The older
+// RPC-style routes in SetupRoutes call the same code and are deprecated.
+
+// Struct UpdateProfileRequest; zero fields are left unchanged
+type UpdateProfileRequest struct {
+	Fullname string `json:"fullname" validate:"max=100"`
+	Email    string `json:"email" validate:"omitempty,email,max=254"`
+	Age      int    `json:"age" validate:"gte=0,lte=150"`
+	Address  string `json:"address" validate:"max=500"`
+}
+
+func (request *UpdateProfileRequest) normalize() {
+	request.Email = normalizeEmail(request.Email)
+}
+
+func (request UpdateProfileRequest) patch() storage.AccountPatch {
+	return profilePatch(request.Fullname, request.Email, request.Address, request.Age)
+}
+
+// Struct PatchProfileRequest; absent fields are left unchanged, and a null
+// age clears it
+type PatchProfileRequest struct {
+	Fullname Optional[string] `json:"fullname" validate:"omitempty,max=100"`
+	Email    Optional[string] `json:"email" validate:"omitempty,email,max=254"`
+	Age      Optional[*int]   `json:"age" validate:"omitempty,gte=0,lte=150"`
+	Address  Optional[string] `json:"address" validate:"omitempty,max=500"`
+}
+
+func (request *PatchProfileRequest) normalize() {
+	request.Fullname.Value = strings.TrimSpace(request.Fullname.Value)
+	request.Email.Value = normalizeEmail(request.Email.Value)
+	request.Address.Value = strings.TrimSpace(request.Address.Value)
+}
+
+func (request PatchProfileRequest) patch() storage.AccountPatch {
+	return storage.AccountPatch{
+		Fullname: request.Fullname.Field(),
+		Email:    request.Email.Field(),
+		Age:      request.Age.Field(),
+		Address:  request.Address.Field(),
+	}
+}
+
+// Struct PatchProductRequest; absent fields are left unchanged
+type PatchProductRequest struct {
+	Title       Optional[string]  `json:"title" validate:"omitempty,min=1,max=200"`
+	Description Optional[string]  `json:"description" validate:"omitempty,max=5000"`
+	Price       Optional[float64] `json:"price" validate:"omitempty,gte=0"`
+	Quantity    Optional[int]     `json:"quantity" validate:"omitempty,gte=0"`
+	ImageData   Optional[[]byte]  `json:"image_data"`
+}
+
+func (request PatchProductRequest) patch() storage.ProductPatch {
+	return storage.ProductPatch{
+		Title:       request.Title.Field(),
+		Description: request.Description.Field(),
+		Price:       request.Price.Field(),
+		Quantity:    request.Quantity.Field(),
+		ImageData:   request.ImageData.Field(),
+	}
+}
+
+// Struct ChangePasswordRequest for the signed-in account
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	NewPassword     string `json:"new_password" validate:"required,max=256"`
+}
+
+// Routes under /api/v1
+func (r *Repository) setupV1Routes(v1 fiber.Router) {
+	// Accounts & sessions
+	v1.Post("/accounts", r.CreateAccount)
+	v1.Post("/sessions", countLogins("password", r.Login))
+	v1.Delete("/sessions/current", r.Logout)
+
+	// The signed-in account
+	v1.Get("/me", r.RequireAuth, r.GetMe)
+	v1.Put("/me", r.RequireAuth, requireIfMatch, r.UpdateMe)
+	v1.Patch("/me", r.RequireAuth, requireIfMatch, r.PatchMe)
+	v1.Put("/me/password", r.RequireAuth, r.UpdateMyPassword)
+
+	// Passkeys
+	v1.Post("/passkeys/registrations", r.BeginPasskeyRegistration)
+	v1.Post("/passkeys/registrations/finish", r.FinishPasskeyRegistration)
+	v1.Post("/passkeys/logins", r.BeginPasskeyLogin)
+	v1.Post("/passkeys/logins/finish", countLogins("passkey", r.FinishPasskeyLogin))
+	v1.Get("/passkeys", r.RequireAuth, r.GetPasskeys)
+	v1.Delete("/passkeys/:id", r.RequireAuth, r.DeletePasskey)
+
+	// Users (admin)
+	v1.Get("/users", r.RequireScope(ScopeUsersRead), r.GetUserDirectory)
+	v1.Get("/users/:id", r.RequireScope(ScopeUsersRead), r.GetUserByID)
+	v1.Put("/users/:id", r.RequireScope(ScopeUsersWrite), requireIfMatch, r.UpdateUserByID)
+	v1.Patch("/users/:id", r.RequireScope(ScopeUsersWrite), requireIfMatch, r.PatchUserByID)
+	v1.Delete("/users/:id", r.RequireScope(ScopeUsersWrite), r.DeleteUserByID)
+	v1.Post("/users/:id/email-verification", r.RequireScope(ScopeUsersWrite), r.VerifyUserEmail)
+
+	// Products
+	v1.Get("/products", r.GetAllProducts)
+	v1.Post("/products", r.RequireScope(ScopeProductsWrite), r.AddProduct)
+	v1.Get("/products/:id", r.GetProduct)
+	v1.Put("/products/:id", r.RequireScope(ScopeProductsWrite), requireIfMatch, r.UpdateProduct)
+	v1.Patch("/products/:id", r.RequireScope(ScopeProductsWrite), requireIfMatch, r.PatchProduct)
+	v1.Delete("/products/:id", r.RequireScope(ScopeProductsWrite), r.DeleteProductByID)
+	v1.Get("/products/:id/image", r.GetProductImageByID)
+
+	// Trash (admin)
+	v1.Get("/trash/users", r.RequireScope(ScopeUsersRead), r.GetDeletedUsers)
+	v1.Post("/trash/users/:id/restore", r.RequireScope(ScopeUsersWrite), r.RestoreUser)
+	v1.Get("/trash/products", r.RequireScope(ScopeProductsRead), r.GetDeletedProducts)
+	v1.Post("/trash/products/:id/restore", r.RequireScope(ScopeProductsWrite), r.RestoreProduct)
+
+	// Cart
+	v1.Get("/cart", r.RequireAuth, r.GetCart)
+	v1.Post("/cart/items", r.RequireAuth, r.AddToCart)
+	v1.Delete("/cart/items/:id", r.RequireAuth, r.RemoveCartItem)
+
+	// Orders
+	v1.Get("/orders", r.RequireScope(ScopeOrdersRead), r.GetAllOrders)
+	v1.Post("/orders", r.SubmitPurchase)
+
+	// API keys (admin sessions only)
+	v1.Get("/api-keys", r.RequireAdmin, r.GetAllAPIKeys)
+	v1.Post("/api-keys", r.RequireAdmin, r.CreateAPIKey)
+	v1.Delete("/api-keys/:id", r.RequireAdmin, r.DeleteAPIKey)
+
+	// Operations (admin sessions only)
+	v1.Get("/admin/slow-queries", r.RequireAdmin, r.GetSlowQueries)
+	v1.Get("/admin/audit", r.RequireAdmin, r.GetAuditLog)
+}
+
+// The legacy routes are removed after this date
+var legacySunset = time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC)
+
+// deprecated marks a legacy route: responses carry a Deprecation header, a
+// Sunset header with the removal date and a Link to the route replacing it
+func deprecated(successor string) fiber.Handler {
+	link := "<" + successor + `>; rel="successor-version"`
+	sunset := legacySunset.Format(http.TimeFormat)
+	return func(context *fiber.Ctx) error {
+		context.Set("Deprecation", "true")
+		context.Set("Sunset", sunset)
+		context.Append(fiber.HeaderLink, link)
+		return context.Next()
+	}
+}
+
+// Parse the numeric route parameter name; what names the resource in errors
+func paramID(context *fiber.Ctx, name, what string) (uint, error) {
+	id, err := strconv.ParseUint(context.Params(name), 10, 64)
+	if err != nil || id == 0 {
+		return 0, badRequest(CodeInvalidRequest, "Invalid "+what+" ID")
+	}
+	return uint(id), nil
+}
+
+// Get the signed-in account; fields= picks the members sent
+func (r *Repository) GetMe(context *fiber.Ctx) error {
+	principal := principalFrom(context)
+	if principal.Account == nil {
+		return forbidden("API keys have no account")
+	}
+
+	return sendAccount(context, *principal.Account)
+}
+
+// Send an account's profile, tagged with its version
+func sendAccount(context *fiber.Ctx, account storage.Account) error {
+	response, err := sparse(context, newAccountResponse(account))
+	if err != nil {
+		return err
+	}
+	return sendVersioned(context, account.Version, response)
+}
+
+// Update the signed-in account
+func (r *Repository) UpdateMe(context *fiber.Ctx) error {
+	principal := principalFrom(context)
+	if principal.Account == nil {
+		return forbidden("API keys have no account")
+	}
+
+	var request UpdateProfileRequest
+	if err := bindBody(context, &request); err != nil {
+		return err
+	}
+
+	return r.updateAccount(context, *principal.Account, request.patch(), "Account updated successfully")
+}
+
+// Update some fields of the signed-in account
+func (r *Repository) PatchMe(context *fiber.Ctx) error {
+	principal := principalFrom(context)
+	if principal.Account == nil {
+		return forbidden("API keys have no account")
+	}
+
+	var request PatchProfileRequest
+	if err := bindBody(context, &request); err != nil {
+		return err
+	}
+
+	return r.updateAccount(context, *principal.Account, request.patch(), "Account updated successfully")
+}
+
+// Change the signed-in account's password
+func (r *Repository) UpdateMyPassword(context *fiber.Ctx) error {
+	principal := principalFrom(context)
+	if principal.Account == nil {
+		return forbidden("API keys have no account")
+	}
+
+	var request ChangePasswordRequest
+	if err := bindBody(context, &request); err != nil {
+		return err
+	}
+
+	return r.changePassword(context, *principal.Account, request.CurrentPassword, request.NewPassword)
+}
+
+// Get a user account by Admin; fields= picks the members sent
+func (r *Repository) GetUserByID(context *fiber.Ctx) error {
+	accountID, err := paramID(context, "id", "user")
+	if err != nil {
+		return err
+	}
+
+	account, err := r.Stores.Accounts.Get(context.UserContext(), accountID)
+	if err != nil {
+		return storeError(err, "User not found", "")
+	}
+
+	return sendAccount(context, account)
+}
+
+// Update a user account by Admin
+func (r *Repository) UpdateUserByID(context *fiber.Ctx) error {
+	accountID, err := paramID(context, "id", "user")
+	if err != nil {
+		return err
+	}
+
+	var request UpdateProfileRequest
+	if err := bindBody(context, &request); err != nil {
+		return err
+	}
+
+	return r.updateUser(context, accountID, request.patch())
+}
+
+// Update some fields of a user account by Admin
+func (r *Repository) PatchUserByID(context *fiber.Ctx) error {
+	accountID, err := paramID(context, "id", "user")
+	if err != nil {
+		return err
+	}
+
+	var request PatchProfileRequest
+	if err := bindBody(context, &request); err != nil {
+		return err
+	}
+
+	return r.updateUser(context, accountID, request.patch())
+}
+
+// Delete a user account by Admin
+func (r *Repository) DeleteUserByID(context *fiber.Ctx) error {
+	accountID, err := paramID(context, "id", "user")
+	if err != nil {
+		return err
+	}
+
+	return r.deleteAccount(context, accountID)
+}
+
+// Mark a user's email verified by Admin, once its owner has shown they
+// receive mail there. Identity providers can then sign in to the account by
+// that email. With If-Match it only applies to the version named.
+func (r *Repository) VerifyUserEmail(context *fiber.Ctx) error {
+	accountID, err := paramID(context, "id", "user")
+	if err != nil {
+		return err
+	}
+
+	ctx := context.UserContext()
+	match := ifMatch(context)
+	err = r.audited(context, AuditUserVerify, "user", func(tx storage.Stores) (auditChange, error) {
+		before, err := tx.Accounts.Get(ctx, accountID)
+		if err != nil {
+			return auditChange{}, err
+		}
+		if before.Email == "" {
+			return auditChange{}, errNoEmail
+		}
+		version, err := match.version(before.Version)
+		if err != nil {
+			return auditChange{}, err
+		}
+		if err := tx.Accounts.VerifyEmail(ctx, accountID, version, time.Now()); err != nil {
+			return auditChange{}, err
+		}
+		after, err := tx.Accounts.Get(ctx, accountID)
+		return auditChange{accountID, accountAuditFields(before), accountAuditFields(after)}, err
+	})
+	if errors.Is(err, errNoEmail) {
+		return badRequest(CodeInvalidRequest, "The account has no email to verify")
+	}
+	if err != nil {
+		return storeError(err, "User not found", "")
+	}
+
+	return context.Status(http.StatusOK).JSON(
+		&fiber.Map{"message": "Email verified successfully"})
+}
+
+var errNoEmail = errors.New("account has no email")
+
+// Get one product
+func (r *Repository) GetProduct(context *fiber.Ctx) error {
+	productID, err := paramID(context, "id", "product")
+	if err != nil {
+		return err
+	}
+
+	product, err := r.Stores.Products.Get(context.UserContext(), productID)
+	if err != nil {
+		return storeError(err, "Product not found", "")
+	}
+
+	return sendVersioned(context, product.Version, newProductResponse(product))
+}
+
+// Update a product by Admin
+func (r *Repository) UpdateProduct(context *fiber.Ctx) error {
+	productID, err := paramID(context, "id", "product")
+	if err != nil {
+		return err
+	}
+
+	var request UpdateProductRequest
+	if err := bindBody(context, &request); err != nil {
+		return err
+	}
+
+	return r.updateProduct(context, productID, request.patch())
+}
+
+// Update some fields of a product by Admin
+func (r *Repository) PatchProduct(context *fiber.Ctx) error {
+	productID, err := paramID(context, "id", "product")
+	if err != nil {
+		return err
+	}
+
+	var request PatchProductRequest
+	if err := bindBody(context, &request); err != nil {
+		return err
+	}
+
+	return r.updateProduct(context, productID, request.patch())
+}
+
+// Delete a product by Admin
+func (r *Repository) DeleteProductByID(context *fiber.Ctx) error {
+	productID, err := paramID(context, "id", "product")
+	if err != nil {
+		return err
+	}
+
+	return r.deleteProduct(context, productID)
+}
+
+// Get a product's image
+func (r *Repository) GetProductImageByID(context *fiber.Ctx) error {
+	productID, err := paramID(context, "id", "product")
+	if err != nil {
+		return err
+	}
+
+	return r.sendProductImage(context, productID)
+}
+
+// Get the cart: quantities keyed by product ID
+func (r *Repository) GetCart(ctx *fiber.Ctx) error {
+	accountID, err := cartOwner(ctx)
+	if err != nil {
+		return err
+	}
+
+	cart, err := r.Stores.Carts.Items(ctx.UserContext(), accountID)
+	if err != nil {
+		return internalError(err)
+	}
+
+	return ctx.Status(http.StatusOK).JSON(&fiber.Map{"data": cart})
+}
+
+// Remove a product from the cart
+func (r *Repository) RemoveCartItem(ctx *fiber.Ctx) error {
+	productID, err := paramID(ctx, "id", "product")
+	if err != nil {
+		return err
+	}
+
+	return r.removeFromCart(ctx, productID)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Request types declare their rules in `validate` tags; see
+// github.com/go-playground/validator for the syntax. Besides the built-in
+// rules there are:
+//
+//	username  letters, digits and . _ -
+//	mobile    a phone number: digits, spaces, dashes, parentheses, leading +
+//	scope     one of the API key scopes
+var validate = newValidator()
+
+var (
+	usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+	mobilePattern   = regexp.MustCompile(`^\+?[0-9][0-9 ()-]{5,18}[0-9]$`)
+)
+
+func newValidator() *validator.Validate {
+	v := validator.New()
+
+	// Report fields by the names clients send
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		for _, tag := range []string{"json", "form", "query"} {
+			name, _, _ := strings.Cut(field.Tag.Get(tag), ",")
+			if name == "-" {
+				return ""
+			}
+			if name != "" {
+				return name
+			}
+		}
+		return field.Name
+	})
+
+	v.RegisterValidation("username", func(fl validator.FieldLevel) bool {
+		return usernamePattern.MatchString(fl.Field().String())
+	})
+	v.RegisterValidation("mobile", func(fl validator.FieldLevel) bool {
+		return mobilePattern.MatchString(fl.Field().String())
+	})
+	v.RegisterValidation("scope", func(fl validator.FieldLevel) bool {
+		return validScope(fl.Field().String())
+	})
+
+	// Rules on an Optional apply to its value
+	v.RegisterCustomTypeFunc(func(field reflect.Value) interface{} {
+		return field.Interface().(optional).validationValue()
+	}, optionalTypes...)
+	return v
+}
+
+// FieldViolation is one invalid field of a request
+type FieldViolation struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// Human readable reason for a failed rule
+func violationReason(fieldErr validator.FieldError) string {
+	param := fieldErr.Param()
+	text := fieldErr.Kind() == reflect.String
+	switch fieldErr.Tag() {
+	case "required":
+		return "is required"
+	case "email":
+		return "must be a valid email address"
+	case "username":
+		return "may only contain letters, digits, '.', '_' and '-'"
+	case "mobile":
+		return "must be a phone number such as +1 555 123 4567"
+	case "scope":
+		return "is not a known scope"
+	case "min":
+		if text {
+			return "must be at least " + param + " characters"
+		}
+		if fieldErr.Kind() == reflect.Slice {
+			return "must have at least " + param + " items"
+		}
+		return "must be at least " + param
+	case "max":
+		if text {
+			return "must be at most " + param + " characters"
+		}
+		if fieldErr.Kind() == reflect.Slice {
+			return "must have at most " + param + " items"
+		}
+		return "must be at most " + param
+	case "gte":
+		return "must be at least " + param
+	case "gt":
+		return "must be greater than " + param
+	case "lte":
+		return "must be at most " + param
+	case "oneof":
+		return "must be one of: " + strings.ReplaceAll(param, " ", ", ")
+	case "datetime":
+		return "must be an RFC 3339 time such as 2024-01-31T09:00:00Z"
+	}
+	return "is invalid (" + fieldErr.Tag() + ")"
+}
+
+// normalizer is implemented by requests that tidy their input (trimming,
+// lowercasing) before the rules run
+type normalizer interface {
+	normalize()
+}
+
+// bindBody parses the request body into out, normalizes it and checks its
+// rules. Invalid input becomes a 422 listing every bad field.
+func bindBody(context *fiber.Ctx, out interface{}) error {
+	if err := context.BodyParser(out); err != nil {
+		return invalidBody(err)
+	}
+	return check(out)
+}
+
+// bindQuery is bindBody for the query string, filled by the query tags
+func bindQuery(context *fiber.Ctx, out interface{}) error {
+	if err := context.QueryParser(out); err != nil {
+		return badRequest(CodeInvalidRequest, "Invalid query string")
+	}
+	return check(out)
+}
+
+// check runs the rules of an already parsed request
+func check(request interface{}) error {
+	if n, ok := request.(normalizer); ok {
+		n.normalize()
+	}
+
+	violations := nullViolations(request)
+	err := validate.Struct(request)
+	var fieldErrs validator.ValidationErrors
+	if !errors.As(err, &fieldErrs) {
+		if err != nil {
+			return internalError(err)
+		}
+		if len(violations) == 0 {
+			return nil
+		}
+	}
+
+	for _, fieldErr := range fieldErrs {
+		// Namespace is Type.field.sub; drop the type name
+		_, field, _ := strings.Cut(fieldErr.Namespace(), ".")
+		violations = append(violations, FieldViolation{Field: field, Reason: violationReason(fieldErr)})
+	}
+	return newAPIError(http.StatusUnprocessableEntity, CodeValidationFailed, "Request has invalid fields").
+		WithDetails(violations)
+}
+
+// Optional fields set to null that can't be null
+func nullViolations(request interface{}) []FieldViolation {
+	value := reflect.Indirect(reflect.ValueOf(request))
+	violations := []FieldViolation{}
+	if value.Kind() != reflect.Struct {
+		return violations
+	}
+	for i := 0; i < value.NumField(); i++ {
+		field, ok := value.Field(i).Interface().(optional)
+		if ok && field.invalidNull() {
+			name, _, _ := strings.Cut(value.Type().Field(i).Tag.Get("json"), ",")
+			violations = append(violations, FieldViolation{Field: name, Reason: "must not be null"})
+		}
+	}
+	return violations
+}
+
+// invalidField is the error check returns, for a rule checked by hand
+func invalidField(field, reason string) *APIError {
+	return newAPIError(http.StatusUnprocessableEntity, CodeValidationFailed, "Request has invalid fields").
+		WithDetails([]FieldViolation{{Field: field, Reason: reason}})
+}
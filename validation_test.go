@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+
+	"m/v2/storage"
+)
+
+func TestValidationReportsEveryField(t *testing.T) {
+	r, app := newTestServer(t)
+	admin := signIn(t, r, createAccount(t, r, "admin", RoleAdmin))
+	user := signIn(t, r, createAccount(t, r, "bob", RoleUser))
+	product := storage.Product{Title: "Lamp", Price: 10, Quantity: 5}
+	if err := r.Stores.Products.Create(context.Background(), &product); err != nil {
+		t.Fatal(err)
+	}
+	productPath := "/api/v1/products/" + strconv.Itoa(int(product.ID))
+
+	tests := []struct {
+		name         string
+		method, path string
+		token        string
+		body         interface{}
+		violations   []FieldViolation
+	}{
+		{"empty signup", http.MethodPost, "/api/v1/accounts", "", map[string]string{}, []FieldViolation{
+			{"email", "is required"},
+			{"username", "is required"},
+			{"password", "is required"},
+			{"confirm_password", "is required"},
+		}},
+		{"malformed signup", http.MethodPost, "/api/v1/accounts", "", map[string]string{
+			"email":            "not-an-email",
+			"username":         "b c",
+			"password":         testPassword,
+			"confirm_password": testPassword,
+		}, []FieldViolation{
+			{"email", "must be a valid email address"},
+			{"username", "may only contain letters, digits, '.', '_' and '-'"},
+		}},
+		{"short username", http.MethodPost, "/api/v1/accounts", "", RegisterRequest{Username: "bo", Email: "bo@example.com", Password: testPassword, Confirm_Password: testPassword}, []FieldViolation{
+			{"username", "must be at least 3 characters"},
+		}},
+		{"order", http.MethodPost, "/api/v1/orders", user, map[string]interface{}{
+			"fullname":  "Bob B",
+			"mobile":    "call me",
+			"itemTitle": "Lamp",
+			"quantity":  0,
+		}, []FieldViolation{
+			{"mobile", "must be a phone number such as +1 555 123 4567"},
+			{"address", "is required"},
+			{"quantity", "must be at least 1"},
+		}},
+		{"cart item", http.MethodPost, "/api/v1/cart/items", user, CartItem{ProductID: product.ID, Quantity: 0}, []FieldViolation{
+			{"quantity", "must be at least 1"},
+		}},
+		{"product patch", http.MethodPatch, productPath, admin, map[string]interface{}{
+			"title":    nil,
+			"price":    -1,
+			"quantity": -2,
+		}, []FieldViolation{
+			{"title", "must not be null"},
+			{"price", "must be at least 0"},
+			{"quantity", "must be at least 0"},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, data := send(t, app, test.method, test.path, test.token, map[string]string{fiber.HeaderIfMatch: "*"}, test.body)
+			envelope := checkErrorEnvelope(t, response, data, http.StatusUnprocessableEntity, CodeValidationFailed)
+
+			var details struct {
+				Details []FieldViolation `json:"details"`
+			}
+			decode(t, data, &details)
+			if !reflect.DeepEqual(details.Details, test.violations) {
+				t.Errorf("details %+v, want %+v", envelope.Details, test.violations)
+			}
+		})
+	}
+
+	// Nothing invalid was stored
+	if _, err := r.Stores.Accounts.FindByUsername(context.Background(), "bo"); err != storage.ErrNotFound {
+		t.Errorf("an invalid signup was stored (%v)", err)
+	}
+	if stored, err := r.Stores.Products.Get(context.Background(), product.ID); err != nil || stored.Title != "Lamp" || stored.Price != 10 || stored.Quantity != 5 {
+		t.Errorf("an invalid patch changed the product: %+v (%v)", stored, err)
+	}
+}
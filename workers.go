@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Workers runs periodic background jobs until the server shuts down
+type Workers struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewWorkers() *Workers {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Workers{ctx: ctx, cancel: cancel}
+}
+
+// Every runs job each interval. A job's context is cancelled on Stop, so
+// long jobs should check it.
+func (w *Workers) Every(name string, interval time.Duration, job func(ctx context.Context) error) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.ctx.Done():
+				return
+			case <-ticker.C:
+				if err := job(w.ctx); err != nil && w.ctx.Err() == nil {
+					slog.Error("background job failed", "worker", name, "err", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop cancels every job and waits for running ones to return
+func (w *Workers) Stop() {
+	w.cancel()
+	w.wg.Wait()
+}
+
+const sessionSweepInterval = time.Hour
+
+// Delete expired sessions so the table doesn't grow without bound
+func (r *Repository) sweepSessions(ctx context.Context) error {
+	deleted, err := r.Stores.Sessions.DeleteExpired(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+	if deleted > 0 {
+		slog.Info("deleted expired sessions", "count", deleted)
+	}
+	return nil
+}
+
+const trashPurgeInterval = time.Hour
+
+// Permanently remove accounts and products deleted longer ago than the
+// retention period
+func (r *Repository) purgeTrash(ctx context.Context) error {
+	cutoff := time.Now().Add(-r.TrashRetention)
+	accounts, err := r.Stores.Accounts.Purge(ctx, cutoff)
+	if err != nil {
+		return err
+	}
+	products, err := r.Stores.Products.Purge(ctx, cutoff)
+	if err != nil {
+		return err
+	}
+	if accounts > 0 || products > 0 {
+		slog.Info("purged deleted rows", "accounts", accounts, "products", products)
+	}
+	return nil
+}